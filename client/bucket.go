@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//TokenBucket client-side limit, rate tokens per second up to burst
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+//NewTokenBucket new instance, starts full
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+//Allow take 1 token if there is one
+func (b *TokenBucket) Allow() bool {
+	return b.reserve(false) == 0
+}
+
+//Wait take 1 token, block till it is available or the context is done
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	wait := b.reserve(true)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		//not used, give it back
+		b.lock.Lock()
+		b.tokens++
+		b.lock.Unlock()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+//reserve take 1 token now or (if booking) ahead of time, returns how long till it is usable
+func (b *TokenBucket) reserve(booking bool) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	//never refills
+	wait := time.Duration(1<<63 - 1)
+	if b.rate > 0 {
+		wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	if booking {
+		b.tokens--
+	}
+	return wait
+}
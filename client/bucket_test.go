@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+//TestTokenBucket burst first, then the rate
+func TestTokenBucket(t *testing.T) {
+
+	//never refills
+	b := NewTokenBucket(0, 2)
+	mockLists := []bool{true, true, false, false}
+	for i, want := range mockLists {
+		if got := b.Allow(); got != want {
+			t.Fatalf("%d Allow failed: %v", i+1, got)
+		}
+		t.Log(i+1, "OKAY", want)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wait failed: %v", err)
+	}
+
+	//100/s, 1 every 10ms
+	b = NewTokenBucket(100, 1)
+	if !b.Allow() || b.Allow() {
+		t.Fatal("Allow failed: burst")
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := b.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if took := time.Since(start); took < 40*time.Millisecond || took > time.Second {
+		t.Fatalf("Wait failed: %v", took)
+	}
+
+	//the cancelled wait gives back its booking
+	b = NewTokenBucket(10, 1)
+	b.Allow()
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := b.Wait(ctx); err != context.Canceled {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	time.Sleep(110 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("Allow failed: booking is not given back")
+	}
+	t.Log("OK")
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ErrRetryTooLong server asked to wait longer than the max backoff
+var ErrRetryTooLong = errors.New("http: retry wait is over the max backoff")
+
+type HttpCurl struct {
+	HttpClient *http.Client
+	Timeout    time.Duration
+
+	//retries on 429/503, the throttle-ip 409 in the body (and network errors for idempotent verbs)
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	//optional client-side limit, stay under the server limits
+	Bucket *TokenBucket
+}
+
+func NewHttpCurl() *HttpCurl {
+	h := &HttpCurl{
+		Timeout:    30 * time.Second,
+		Retries:    3,
+		Backoff:    200 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+	}
+	h.Init()
+	return h
+
+}
+
+//Init start prep, connections are pooled and kept alive
+func (g *HttpCurl) Init() {
+	//web
+	g.HttpClient = &http.Client{
+		Timeout: g.Timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   g.Timeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: g.Timeout,
+		},
+	}
+}
+
+//Get request via get
+func (g *HttpCurl) Get(url string) (string, int, error) {
+	return g.Do(context.Background(), "GET", url, nil, nil)
+}
+
+//GetContext request via get
+func (g *HttpCurl) GetContext(ctx context.Context, url string, headers map[string]string) (string, int, error) {
+	return g.Do(ctx, "GET", url, nil, headers)
+}
+
+//PostContext request via post
+func (g *HttpCurl) PostContext(ctx context.Context, url string, body []byte, headers map[string]string) (string, int, error) {
+	return g.Do(ctx, "POST", url, body, headers)
+}
+
+//PutContext request via put
+func (g *HttpCurl) PutContext(ctx context.Context, url string, body []byte, headers map[string]string) (string, int, error) {
+	return g.Do(ctx, "PUT", url, body, headers)
+}
+
+//DeleteContext request via delete
+func (g *HttpCurl) DeleteContext(ctx context.Context, url string, headers map[string]string) (string, int, error) {
+	return g.Do(ctx, "DELETE", url, nil, headers)
+}
+
+//Do send the request, waits on the bucket first and retries while throttled
+func (g *HttpCurl) Do(ctx context.Context, method, url string, body []byte, headers map[string]string) (string, int, error) {
+	for attempt := 0; ; attempt++ {
+		if g.Bucket != nil {
+			if err := g.Bucket.Wait(ctx); err != nil {
+				return "", -1, err
+			}
+		}
+		contents, code, hint, err := g.send(ctx, method, url, body, headers)
+
+		//done or no more tries
+		retry := code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable ||
+			(err == nil && Denied(code, contents)) ||
+			(err != nil && code == -1 && idempotent(method))
+		if !retry || attempt >= g.Retries {
+			return contents, code, err
+		}
+
+		//server hint first, otherwise exponential
+		wait := g.backoff(attempt)
+		if hint > 0 {
+			if hint > g.MaxBackoff {
+				return contents, code, ErrRetryTooLong
+			}
+			wait = hint + jitter(g.Backoff)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return contents, code, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (g *HttpCurl) send(ctx context.Context, method, url string, body []byte, headers map[string]string) (string, int, time.Duration, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return "", -1, 0, err
+	}
+	req = req.WithContext(ctx)
+	//settings
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if len(body) > 0 && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := g.HttpClient.Do(req)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return "", -1, 0, err
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", resp.StatusCode, 0, err
+	}
+	// read the body
+	return strings.TrimSpace(string(contents)), resp.StatusCode, RetryAfter(resp.Header), nil
+}
+
+//backoff exponential with full jitter, capped
+func (g *HttpCurl) backoff(attempt int) time.Duration {
+	wait := g.Backoff << uint(attempt)
+	if wait <= 0 || wait > g.MaxBackoff {
+		wait = g.MaxBackoff
+	}
+	return wait/2 + jitter(wait/2)
+}
+
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+//Denied check for the throttle-ip deny, http 200 with {"Code":409,...} in the body
+func Denied(code int, contents string) bool {
+	if code != http.StatusOK || !strings.HasPrefix(contents, "{") {
+		return false
+	}
+	var reply struct {
+		Code int
+	}
+	return json.Unmarshal([]byte(contents), &reply) == nil && reply.Code == http.StatusConflict
+}
+
+func idempotent(method string) bool {
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+//RetryAfter how long the server asked to wait, from Retry-After (seconds or date) or RateLimit-Reset (seconds)
+func RetryAfter(h http.Header) time.Duration {
+	if v := strings.TrimSpace(h.Get("Retry-After")); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+		if at, err := http.ParseTime(v); err == nil {
+			if d := time.Until(at); d > 0 {
+				return d
+			}
+			return 0
+		}
+	}
+	if secs, err := strconv.Atoi(strings.TrimSpace(h.Get("RateLimit-Reset"))); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return 0
+}
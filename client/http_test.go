@@ -0,0 +1,131 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//TestRetryAfter seconds or date from Retry-After, otherwise RateLimit-Reset
+func TestRetryAfter(t *testing.T) {
+	mockLists := []struct {
+		RetryAfter string
+		Reset      string
+		Min        time.Duration
+		Max        time.Duration
+	}{
+		{"", "", 0, 0},
+		{"3", "", 3 * time.Second, 3 * time.Second},
+		{"0", "7", 0, 0},
+		{"3", "7", 3 * time.Second, 3 * time.Second},
+		{"", "7", 7 * time.Second, 7 * time.Second},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), "", 59 * time.Minute, time.Hour},
+		//already passed
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), "7", 0, 0},
+		{"soon", "7", 7 * time.Second, 7 * time.Second},
+		{"-1", "-7", 0, 0},
+	}
+	for i, rec := range mockLists {
+		h := http.Header{}
+		if rec.RetryAfter != "" {
+			h.Set("Retry-After", rec.RetryAfter)
+		}
+		if rec.Reset != "" {
+			h.Set("RateLimit-Reset", rec.Reset)
+		}
+		if got := RetryAfter(h); got < rec.Min || got > rec.Max {
+			t.Fatalf("%d RetryAfter failed: %v", i+1, got)
+		}
+		t.Log(i+1, "OKAY", rec.RetryAfter, rec.Reset)
+	}
+	t.Log("OK")
+}
+
+//TestBackoff exponential with full jitter on the upper half, capped
+func TestBackoff(t *testing.T) {
+	g := &HttpCurl{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	mockLists := []struct {
+		Attempt int
+		Min     time.Duration
+		Max     time.Duration
+	}{
+		{0, 50 * time.Millisecond, 100 * time.Millisecond},
+		{1, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond, 800 * time.Millisecond},
+		{4, 500 * time.Millisecond, time.Second},
+		//overflow
+		{70, 500 * time.Millisecond, time.Second},
+	}
+	for i, rec := range mockLists {
+		seen := map[time.Duration]bool{}
+		for n := 0; n < 50; n++ {
+			wait := g.backoff(rec.Attempt)
+			if wait < rec.Min || wait >= rec.Max {
+				t.Fatalf("%d Backoff failed: %v", i+1, wait)
+			}
+			seen[wait] = true
+		}
+		if len(seen) < 2 {
+			t.Fatalf("%d Jitter failed", i+1)
+		}
+		t.Log(i+1, "OKAY", rec.Attempt, len(seen))
+	}
+	t.Log("OK")
+}
+
+//TestDo retries on 429/503 and the 409 in the body, not on the other replies
+func TestDo(t *testing.T) {
+	mockLists := []struct {
+		Replies []int
+		Hits    int32
+		Code    int
+		Err     error
+	}{
+		{[]int{200}, 1, 200, nil},
+		{[]int{409, 409, 200}, 3, 200, nil},
+		{[]int{429, 503, 200}, 3, 200, nil},
+		//no more tries
+		{[]int{409, 409, 409, 409, 200}, 4, 200, nil},
+		{[]int{429, 429, 429, 429, 200}, 4, 429, nil},
+		{[]int{400, 200}, 1, 400, nil},
+		{[]int{-409, 200}, 1, 409, nil},
+		//retry-after over the max backoff
+		{[]int{-60, 200}, 1, 429, ErrRetryTooLong},
+	}
+	for i, rec := range mockLists {
+		var hits int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&hits, 1)
+			switch reply := rec.Replies[n-1]; reply {
+			case 409:
+				//throttle-ip deny
+				w.Header().Set("Retry-After", "0")
+				w.Write([]byte(`{"Code":409,"Status":"IP is not allowed."}`))
+			case -409:
+				//a real conflict
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"Code":409}`))
+			case -60:
+				w.Header().Set("Retry-After", "60")
+				w.WriteHeader(http.StatusTooManyRequests)
+			case 200:
+				w.Write([]byte(`{"Code":200}`))
+			default:
+				w.WriteHeader(reply)
+			}
+		}))
+		curl := NewHttpCurl()
+		curl.Backoff = time.Millisecond
+		curl.MaxBackoff = time.Second
+		_, code, err := curl.GetContext(context.Background(), ts.URL, nil)
+		ts.Close()
+		if code != rec.Code || err != rec.Err || hits != rec.Hits {
+			t.Fatalf("%d Do failed: %d %v %d", i+1, code, err, hits)
+		}
+		t.Log(i+1, "OKAY", code, hits)
+	}
+	t.Log("OK")
+}
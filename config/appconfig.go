@@ -7,6 +7,8 @@ import (
 	"log"
 	"os"
 
+	"github.com/bayugyug/rest-api-throttleip/driver"
+	"github.com/bayugyug/rest-api-throttleip/models"
 	"github.com/bayugyug/rest-api-throttleip/utils"
 )
 
@@ -14,6 +16,8 @@ const (
 	//status
 	usageConfig       = "use to set the config file parameter with http-port/redis-host"
 	RequestsPerMinute = 10
+	//EnvJwtSecret env var of the jwt secret, over the jwt_secret of the config
+	EnvJwtSecret = "API_THROTTLE_IP_JWT_SECRET"
 )
 
 var (
@@ -23,9 +27,42 @@ var (
 
 //ParameterConfig optional parameter structure
 type ParameterConfig struct {
-	HttpPort  string `json:"http_port"`
-	RedisHost string `json:"redis_host"`
-	Showlog   bool   `json:"showlog"`
+	HttpPort   string                    `json:"http_port"`
+	RedisHost  string                    `json:"redis_host"`
+	Redis      *driver.RedisConfig       `json:"redis"`
+	Showlog    bool                      `json:"showlog"`
+	Policies   models.PolicyList         `json:"policies"`
+	Quotas     models.QuotaList          `json:"quotas"`
+	QuotaStore string                    `json:"quota_store"`
+	Mysql      *driver.DbConnectorConfig `json:"mysql"`
+
+	MaxInflight   int    `json:"max_inflight"`
+	InflightStore string `json:"inflight_store"`
+
+	Adaptive *models.AdaptiveConfig `json:"adaptive"`
+
+	Priorities []*models.PriorityRule `json:"priorities"`
+	ApiKeys    map[string]string      `json:"api_keys"`
+	Shedding   *models.ShedConfig     `json:"shedding"`
+
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	Upstreams []*models.Upstream `json:"upstreams"`
+
+	GrpcPort  string `json:"grpc_port"`
+	RlsDomain string `json:"rls_domain"`
+
+	Counters *models.CounterConfig `json:"counters"`
+	Hybrid   *models.HybridConfig  `json:"hybrid"`
+
+	Shards *models.ShardConfig `json:"redis_shards"`
+	Keys   *models.KeyConfig   `json:"keys"`
+
+	HistoryStore string                     `json:"history_store"`
+	HistoryMysql *models.MysqlHistoryConfig `json:"history_mysql"`
+
+	UserStore string `json:"user_store"`
+	JwtSecret string `json:"jwt_secret"`
 }
 
 //AppSettings app mapping on its config
@@ -116,6 +153,10 @@ func (g *ApiSettings) Initializer() {
 	}
 	//set dump flag
 	utils.ShowMeLog = g.Config.Showlog
+	//secrets are better off the config file
+	if s := os.Getenv(EnvJwtSecret); s != "" {
+		g.Config.JwtSecret = s
+	}
 
 }
 
@@ -126,5 +167,98 @@ func (g *ApiSettings) FormatParameterConfig(s string) *ParameterConfig {
 		log.Println("FormatParameterConfig", err)
 		return nil
 	}
+	for _, p := range cfg.Policies {
+		if err := p.Validate(); err != nil {
+			log.Println("FormatParameterConfig", err)
+			return nil
+		}
+	}
+	for _, q := range cfg.Quotas {
+		if err := q.Validate(); err != nil {
+			log.Println("FormatParameterConfig", err)
+			return nil
+		}
+	}
+	if cfg.Adaptive != nil {
+		if _, err := models.NewAdaptiveLimiter(cfg.Adaptive); err != nil {
+			log.Println("FormatParameterConfig", err)
+			return nil
+		}
+	}
+	for _, u := range cfg.Upstreams {
+		if err := u.Validate(); err != nil {
+			log.Println("FormatParameterConfig", err)
+			return nil
+		}
+	}
+	if _, err := models.NewPriorityClassifier(cfg.Priorities, cfg.ApiKeys); err != nil {
+		log.Println("FormatParameterConfig", err)
+		return nil
+	}
+	if _, err := models.ParseCIDRs(cfg.TrustedProxies); err != nil {
+		log.Println("FormatParameterConfig", err)
+		return nil
+	}
+	if cfg.Hybrid != nil {
+		if err := cfg.Hybrid.Validate(); err != nil {
+			log.Println("FormatParameterConfig", err)
+			return nil
+		}
+	}
+	if cfg.Keys != nil {
+		if err := cfg.Keys.Validate(); err != nil {
+			log.Println("FormatParameterConfig", err)
+			return nil
+		}
+	}
+	if cfg.Shards != nil {
+		if err := cfg.Shards.Validate(); err != nil {
+			log.Println("FormatParameterConfig", err)
+			return nil
+		}
+	}
+	if cfg.Redis != nil {
+		//redis host is the addr if not set
+		r := *cfg.Redis
+		if r.Addr == "" && len(r.Addrs) == 0 {
+			r.Addr = cfg.RedisHost
+		}
+		if err := r.Validate(); err != nil {
+			log.Println("FormatParameterConfig", err)
+			return nil
+		}
+	}
+	switch cfg.QuotaStore {
+	case "", "redis":
+	case "mysql":
+		if cfg.Mysql == nil {
+			log.Println("FormatParameterConfig", "quota_store mysql needs the mysql config")
+			return nil
+		}
+	default:
+		log.Println("FormatParameterConfig", "invalid quota_store", cfg.QuotaStore)
+		return nil
+	}
+	switch cfg.HistoryStore {
+	case "", "redis":
+	case "mysql", "both":
+		if cfg.Mysql == nil {
+			log.Println("FormatParameterConfig", "history_store", cfg.HistoryStore, "needs the mysql config")
+			return nil
+		}
+	default:
+		log.Println("FormatParameterConfig", "invalid history_store", cfg.HistoryStore)
+		return nil
+	}
+	if cfg.UserStore == "mysql" && cfg.Mysql == nil {
+		log.Println("FormatParameterConfig", "user_store mysql needs the mysql config")
+		return nil
+	}
+	if cfg.HistoryMysql != nil {
+		if err := cfg.HistoryMysql.Validate(); err != nil {
+			log.Println("FormatParameterConfig", err)
+			return nil
+		}
+	}
 	return &cfg
 }
@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/go-chi/render"
+)
+
+//PolicyResponse decisions per policy
+type PolicyResponse struct {
+	Code     int
+	Status   string
+	Policies []*models.PolicyReport
+}
+
+//PolicyInfo decisions of the shadow and enforced policies side by side
+func (api *ApiHandler) PolicyInfo(w http.ResponseWriter, r *http.Request) {
+	//good
+	render.JSON(w, r, PolicyResponse{
+		Code:     200,
+		Status:   "PolicyInfo::Welcome",
+		Policies: api.svc.Metrics.PolicyReports(api.svc.Policies, api.svc.Default),
+	})
+}
+
+//MetricsInfo the throttle counters of the service in the expvar format, not the expvar
+//defaults as these have the command line (config secrets)
+func (api *ApiHandler) MetricsInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n%q: %s\n}\n", "throttle", api.svc.Metrics.String())
+}
+
+//HistoryResponse decision counts of a time range
+type HistoryResponse struct {
+	Code   int
+	Status string
+	Report *models.HistoryReport
+}
+
+//HistoryInfo counts by status and policy, top denied ips and hourly timeline
+//
+//  from, to = RFC3339 (default the last 24 hours)
+//  top      = denied ips to show (default 10)
+func (api *ApiHandler) HistoryInfo(w http.ResponseWriter, r *http.Request) {
+	reporter, oks := api.svc.History.(models.HistoryReporter)
+	if !oks {
+		render.Status(r, http.StatusNotImplemented)
+		api.ReplyErrContent(w, r, http.StatusNotImplemented, "History store has no reports.")
+		return
+	}
+	//records are on wall time
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	top := 10
+	var err error
+	if s := r.URL.Query().Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			api.ReplyErrContent(w, r, http.StatusBadRequest, "Invalid from, RFC3339 is required.")
+			return
+		}
+	}
+	if s := r.URL.Query().Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			api.ReplyErrContent(w, r, http.StatusBadRequest, "Invalid to, RFC3339 is required.")
+			return
+		}
+	}
+	if s := r.URL.Query().Get("top"); s != "" {
+		if top, err = strconv.Atoi(s); err != nil || top < 0 {
+			render.Status(r, http.StatusBadRequest)
+			api.ReplyErrContent(w, r, http.StatusBadRequest, "Invalid top, must not be negative.")
+			return
+		}
+	}
+	report, err := reporter.Report(from, to, top)
+	if err != nil {
+		log.Println("HISTORY_REPORT", err)
+		render.Status(r, http.StatusInternalServerError)
+		api.ReplyErrContent(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	//good
+	render.JSON(w, r, HistoryResponse{
+		Code:   200,
+		Status: "HistoryInfo::Welcome",
+		Report: report,
+	})
+}
+
+//LockoutResponse locked failure keys
+type LockoutResponse struct {
+	Code     int
+	Status   string
+	Lockouts []*models.Lockout
+	Unlocked int `json:",omitempty"`
+}
+
+//LockoutInfo locked failure keys of the brute-force policies
+func (api *ApiHandler) LockoutInfo(w http.ResponseWriter, r *http.Request) {
+	all, err := api.svc.Lockouts.List()
+	if err != nil {
+		log.Println("LOCKOUT", err)
+		render.Status(r, http.StatusInternalServerError)
+		api.ReplyErrContent(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	//good
+	render.JSON(w, r, LockoutResponse{
+		Code:     200,
+		Status:   "LockoutInfo::Welcome",
+		Lockouts: all,
+	})
+}
+
+//LockoutUnlock unlock and reset the failures of the ip and/or username
+//
+//  policy   = only this brute-force policy (default all)
+//  ip       = the ip, and the ip+username keys of the ip
+//  username = the username, and the ip+username keys of the username
+func (api *ApiHandler) LockoutUnlock(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name, ip, username := q.Get("policy"), q.Get("ip"), strings.ToLower(q.Get("username"))
+	if ip == "" && username == "" {
+		render.Status(r, http.StatusBadRequest)
+		api.ReplyErrContent(w, r, http.StatusBadRequest, "Invalid unlock, ip or username is required.")
+		return
+	}
+	locked, err := api.svc.Lockouts.List()
+	if err != nil {
+		log.Println("LOCKOUT", err)
+		render.Status(r, http.StatusInternalServerError)
+		api.ReplyErrContent(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	unlocked := 0
+	for _, p := range api.svc.Policies {
+		if p == nil || !p.CountsFailures() || (name != "" && p.Name != name) {
+			continue
+		}
+		keys := p.FailureKeysOf(ip, username)
+		//ip+username keys of the other half
+		for _, l := range locked {
+			dim, lip, luser, oks := models.ParseFailureKey(l.Key)
+			if l.Policy != p.Name || !oks || dim != models.FailureKeyIPUsername {
+				continue
+			}
+			if (ip != "" && lip == ip) || (username != "" && luser == username) {
+				keys = append(keys, l.Key)
+			}
+		}
+		for _, key := range keys {
+			oks, err := api.svc.Lockouts.Unlock(p.Name, key)
+			if err != nil {
+				log.Println("LOCKOUT", err)
+			}
+			if oks {
+				unlocked++
+			}
+			api.svc.Limiter.Refund(key, p, p.MaxLimit())
+		}
+		log.Println("LOCKOUT unlock", p.Name, ip, username, len(keys))
+	}
+	//good
+	render.JSON(w, r, LockoutResponse{
+		Code:     200,
+		Status:   "LockoutUnlock::Welcome",
+		Unlocked: unlocked,
+	})
+}
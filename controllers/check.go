@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+)
+
+//CheckRequest decision endpoint for nginx auth_request and traefik forwardauth,
+//200 or 429 with the rate-limit headers and no body
+//
+//  nginx  : X-Original-Method, X-Original-URI, X-Real-IP/X-Forwarded-For
+//  traefik: X-Forwarded-Method, X-Forwarded-Uri, X-Forwarded-For
+func (api *ApiHandler) CheckRequest(w http.ResponseWriter, r *http.Request) {
+
+	//the original request as seen by the edge proxy
+	orig := r.WithContext(r.Context())
+	orig.Method = firstHeader(r, "X-Original-Method", "X-Forwarded-Method")
+	if orig.Method == "" {
+		orig.Method = http.MethodGet
+	}
+	uri := firstHeader(r, "X-Original-URI", "X-Forwarded-Uri")
+	if uri == "" {
+		uri = "/"
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	orig.URL = u
+	orig.RequestURI = uri
+
+	//check ip details
+	tracker := models.NewTrackerIP()
+	trkInfo := tracker.GetIPInfo(api.svc.Context, orig)
+	if trkInfo == nil || trkInfo.IP == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//policy of the original route
+	policy := api.svc.Policies.Match(orig, api.svc.Default)
+	trkInfo.Priority = api.svc.Classifier.Classify(orig, models.PeerIP(r), policy.Priority)
+	orig = orig.WithContext(models.WithPriority(orig.Context(), trkInfo.Priority))
+
+	_, code, _ := api.DecideIPInfo(w, orig, trkInfo, policy, policy.Cost.Upfront(orig))
+	if code != http.StatusOK {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func firstHeader(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if s := strings.TrimSpace(r.Header.Get(name)); s != "" {
+			return s
+		}
+	}
+	return ""
+}
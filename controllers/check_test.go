@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+)
+
+//TestCheckRequest the original request is taken from the nginx/traefik headers,
+//200 or 429 with the rate-limit headers and no body
+func TestCheckRequest(t *testing.T) {
+
+	//1 post per minute on the orders
+	policy := models.NewPolicy("check-test", "/orders", 1, "minute")
+	policy.Methods = []string{"POST"}
+	svc, err := NewApiService(
+		WithSvcOptRedisHost(StoreMemory),
+		WithSvcOptPolicies(models.PolicyList{policy}),
+		WithSvcOptTrustedProxies([]string{"127.0.0.1", "::1"}),
+		WithSvcOptClock(models.NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	ts := httptest.NewServer(svc.Router)
+	defer ts.Close()
+
+	nginx := func(method, uri, ip string) map[string]string {
+		return map[string]string{"X-Original-Method": method, "X-Original-URI": uri, "X-Real-IP": ip}
+	}
+	traefik := func(method, uri, ip string) map[string]string {
+		return map[string]string{"X-Forwarded-Method": method, "X-Forwarded-Uri": uri, "X-Forwarded-For": ip}
+	}
+	mockLists := []struct {
+		Headers map[string]string
+		Code    int
+		Policy  string
+	}{
+		{nginx("POST", "/orders?id=1", "198.51.100.1"), http.StatusOK, "1;w=60"},
+		{nginx("POST", "/orders?id=2", "198.51.100.1"), http.StatusTooManyRequests, "1;w=60"},
+		//other client
+		{traefik("POST", "/orders", "198.51.100.2"), http.StatusOK, "1;w=60"},
+		{traefik("POST", "/orders", "198.51.100.2"), http.StatusTooManyRequests, "1;w=60"},
+		//other method, default policy
+		{nginx("GET", "/orders", "198.51.100.1"), http.StatusOK, ""},
+		{traefik("", "", "198.51.100.1"), http.StatusOK, ""},
+		{nginx("POST", "orders", "198.51.100.1"), http.StatusBadRequest, ""},
+	}
+	for i, rec := range mockLists {
+		req, err := http.NewRequest("GET", ts.URL+"/check", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range rec.Headers {
+			if v != "" {
+				req.Header.Set(k, v)
+			}
+		}
+		ret, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret.Body.Close()
+		if ret.StatusCode != rec.Code {
+			t.Fatalf("%d Check failed: %d", i+1, ret.StatusCode)
+		}
+		if ret.ContentLength > 0 {
+			t.Fatalf("%d Body failed: %d", i+1, ret.ContentLength)
+		}
+		if rec.Policy != "" && ret.Header.Get("RateLimit-Policy") != rec.Policy {
+			t.Fatalf("%d Policy failed: %s", i+1, ret.Header.Get("RateLimit-Policy"))
+		}
+		if rec.Code != http.StatusBadRequest && ret.Header.Get("RateLimit-Limit") == "" {
+			t.Fatalf("%d Headers failed", i+1)
+		}
+		if retry := ret.Header.Get("Retry-After"); (rec.Code == http.StatusTooManyRequests) != (retry == "60") {
+			t.Fatalf("%d Retry-After failed: %s", i+1, retry)
+		}
+		t.Log(i+1, "OKAY", ret.StatusCode, ret.Header.Get("RateLimit-Remaining"))
+	}
+	t.Log("OK")
+}
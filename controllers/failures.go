@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/go-chi/chi/middleware"
+)
+
+const (
+	//FailureMaxBody bytes of the body read for the username
+	FailureMaxBody = 64 << 10
+	//FailureMaxUsername longer usernames are cut, so the keys stay small
+	FailureMaxUsername = 128
+)
+
+//ThrottleFailures deny if a failure window of the ip/username is used up or locked,
+//only the responses with the failure statuses are counted
+func (api *ApiHandler) ThrottleFailures(w http.ResponseWriter, r *http.Request, next http.Handler, trk *models.TrackerIP, policy *models.Policy) {
+	keys := policy.FailureKeysOf(trk.IP, api.failureUsername(r, policy))
+	//the slots are taken before serving, so parallel attempts can not pass the limit
+	var held []*models.Decision
+	release := func() {
+		for _, dec := range held {
+			api.svc.Limiter.Adjust(dec, -dec.Cost)
+		}
+	}
+	for _, key := range keys {
+		locked, err := api.svc.Lockouts.Locked(policy.Name, key)
+		if err != nil {
+			log.Println("LOCKOUT", err)
+		}
+		var dec *models.Decision
+		if !locked {
+			if dec = api.svc.Limiter.Allow(key, policy, 1); dec.Allowed {
+				held = append(held, dec)
+				continue
+			}
+		} else {
+			dec = api.svc.Limiter.Peek(key, policy)
+		}
+		release()
+		dec.Allowed = false
+		if d := policy.LockoutDuration(); locked && d > dec.Reset {
+			dec.Reset = d
+		}
+		api.SetRateLimitHeaders(w, dec)
+		trk.Status = "Denied"
+		api.SaveIPInfo(w, r, trk)
+		//409 is sent on the body only
+		api.ReplyErrContent(w, r, http.StatusConflict, "Too many failed attempts. Try again later.")
+		return
+	}
+
+	//serve
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	next.ServeHTTP(ww, r)
+	if !policy.IsFailure(ww.Status()) {
+		//not a failure, give the slots back
+		release()
+		api.SaveIPInfo(w, r, trk)
+		return
+	}
+	trk.Status = models.StatusFailed
+	api.SaveIPInfo(w, r, trk)
+	for i, dec := range held {
+		api.svc.Metrics.Policy(policy, dec)
+		if d := policy.LockoutDuration(); dec.Remaining <= 0 && d > 0 {
+			log.Println("LOCKOUT", policy.Name, keys[i], d)
+			if err := api.svc.Lockouts.Lock(policy.Name, keys[i], d); err != nil {
+				log.Println("LOCKOUT", err)
+			}
+		}
+	}
+}
+
+//failureUsername username of the header, otherwise of the json body; the body is put back
+func (api *ApiHandler) failureUsername(r *http.Request, policy *models.Policy) string {
+	username := ""
+	if policy.UsernameHeader != "" {
+		username = r.Header.Get(policy.UsernameHeader)
+	}
+	if username == "" && r.Body != nil {
+		field := policy.UsernameField
+		if field == "" {
+			field = models.UsernameField
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(r.Body, FailureMaxBody))
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		var fields map[string]interface{}
+		if json.Unmarshal(body, &fields) == nil {
+			username, _ = fields[field].(string)
+		}
+	}
+	if len(username) > FailureMaxUsername {
+		username = username[:FailureMaxUsername]
+	}
+	return username
+}
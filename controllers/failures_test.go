@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/go-chi/chi"
+)
+
+//TestThrottleFailures parallel attempts can not pass the failure limit, the rest give their slot back
+func TestThrottleFailures(t *testing.T) {
+
+	policy := models.NewPolicy("fail-test", "/v1/api/request", 2, "minute")
+	policy.FailureStatuses = []int{401}
+	policy.FailureKeys = []string{models.FailureKeyIP}
+	store := models.NewMemoryHistoryStore()
+	svc, err := NewApiService(
+		WithSvcOptRedisHost(StoreMemory),
+		WithSvcOptPolicies(models.PolicyList{policy}),
+		WithSvcOptHistoryStore(store),
+		WithSvcOptClock(models.NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	var entered int32
+	gate := make(chan struct{})
+	handler := chi.NewRouter()
+	handler.With(svc.Api.ThrottleIP).Post("/v1/api/request/{dummy}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Test-Status") == "ok" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		atomic.AddInt32(&entered, 1)
+		<-gate
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	serve := func(ip, status string) string {
+		r := httptest.NewRequest("POST", "/v1/api/request/fail-test", nil)
+		r.RemoteAddr = ip + ":5000"
+		r.Header.Set("X-Test-Status", status)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	//5 at once, 2 are served and fail while the rest wait
+	replies := make(chan string, 5)
+	for i := 0; i < 5; i++ {
+		go func() { replies <- serve("10.1.2.3", "") }()
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case body := <-replies:
+			if !strings.Contains(body, `"Code":409`) {
+				t.Fatalf("%d Failures failed: %s", i+1, body)
+			}
+			t.Log(i+1, "OKAY", "denied")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Failures failed: %d served at once", atomic.LoadInt32(&entered))
+		}
+	}
+	if n := atomic.LoadInt32(&entered); n != 2 {
+		t.Fatalf("Failures failed: %d served", n)
+	}
+	close(gate)
+	for i := 0; i < 2; i++ {
+		<-replies
+	}
+	if body := serve("10.1.2.3", "ok"); !strings.Contains(body, `"Code":409`) {
+		t.Fatalf("Failures failed: not denied %s", body)
+	}
+	t.Log("OKAY", "parallel")
+
+	//not failures, the slot is given back each time
+	for i := 0; i < 5; i++ {
+		if body := serve("10.1.2.4", "ok"); strings.Contains(body, `"Code":409`) {
+			t.Fatalf("%d Failures failed: %s", i+1, body)
+		}
+	}
+	if dec := svc.Limiter.Peek("fail::ip::10.1.2.4", policy); dec.Remaining != 2 {
+		t.Fatalf("Failures failed: %d remaining", dec.Remaining)
+	}
+	t.Log("OKAY", "refunded")
+
+	svc.IPHistory.Close()
+	if !svc.IPHistory.WaitHistory(time.Second) {
+		t.Fatal("History failed: not saved")
+	}
+	statuses := make(map[string]int)
+	for _, key := range []string{models.DefaultKeys.IPAllowed, models.DefaultKeys.IPDenied} {
+		for _, rec := range store.Records(key) {
+			statuses[rec.Status]++
+		}
+	}
+	if statuses[models.StatusFailed] != 2 || statuses["Denied"] != 4 || statuses["Allowed"] != 5 {
+		t.Fatalf("History failed: %v", statuses)
+	}
+	t.Log("OKAY", statuses)
+
+	//the ip+username keys of the ip only, not of the ipv6 with the same head
+	for _, ip := range []string{"2001:db8::1", "2001:db8::1:5"} {
+		if err := svc.Lockouts.Lock(policy.Name, "fail::ip_user::"+ip+"::jerry", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mockLists := []struct {
+		Query    string
+		Unlocked int
+	}{
+		{"ip=2001:db8", 0},
+		{"ip=2001:db8::1", 1},
+		{"username=jerry", 1},
+	}
+	for i, rec := range mockLists {
+		w := httptest.NewRecorder()
+		svc.Api.LockoutUnlock(w, httptest.NewRequest("DELETE", "/v1/api/admin/lockouts?"+rec.Query, nil))
+		var reply LockoutResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply.Code != 200 || reply.Unlocked != rec.Unlocked {
+			t.Fatalf("%d Unlock failed: %s", i+1, w.Body.String())
+		}
+		t.Log(i+1, "OKAY", rec.Query, reply.Unlocked)
+	}
+	t.Log("OK")
+}
+
+//TestFailuresForwarded a rotating x-forwarded-for of an untrusted peer still locks the peer
+func TestFailuresForwarded(t *testing.T) {
+
+	policy := models.NewPolicy("fail-xff", "/v1/api/request", 2, "minute")
+	policy.FailureStatuses = []int{401}
+	policy.FailureKeys = []string{models.FailureKeyIP}
+	policy.Lockout = "15m"
+	svc, err := NewApiService(
+		WithSvcOptRedisHost(StoreMemory),
+		WithSvcOptPolicies(models.PolicyList{policy}),
+		WithSvcOptTrustedProxies([]string{"10.0.0.5"}),
+		WithSvcOptClock(models.NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	handler := chi.NewRouter()
+	handler.Use(svc.RealIP)
+	handler.With(svc.Api.ThrottleIP).Post("/v1/api/request/{dummy}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	mockLists := []struct {
+		Remote string
+		XFF    string
+		Denied bool
+	}{
+		{"203.0.113.9:5000", "198.51.100.1", false},
+		{"203.0.113.9:5000", "198.51.100.2", false},
+		{"203.0.113.9:5000", "198.51.100.3", true},
+		{"203.0.113.9:5000", "198.51.100.4, 10.0.0.5", true},
+		{"203.0.113.9:5000", "", true},
+		//forwarded by the trusted proxy, 1 key per client
+		{"10.0.0.5:5000", "198.51.100.5", false},
+		{"10.0.0.5:5000", "198.51.100.6", false},
+		{"10.0.0.5:5000", "198.51.100.7", false},
+	}
+	for i, rec := range mockLists {
+		r := httptest.NewRequest("POST", "/v1/api/request/fail-xff", nil)
+		r.RemoteAddr = rec.Remote
+		if rec.XFF != "" {
+			r.Header.Set("X-Forwarded-For", rec.XFF)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if denied := strings.Contains(w.Body.String(), `"Code":409`); denied != rec.Denied {
+			t.Fatalf("%d Failures failed: %s", i+1, w.Body.String())
+		}
+		t.Log(i+1, "OKAY", rec.Remote, rec.XFF, rec.Denied)
+	}
+
+	locked, err := svc.Lockouts.List()
+	if err != nil || len(locked) != 1 || locked[0].Key != "fail::ip::203.0.113.9" {
+		t.Fatalf("Lockout failed: %v %v", locked, err)
+	}
+	t.Log("OKAY", locked[0].Key)
+	t.Log("OK")
+}
@@ -4,8 +4,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
-	"github.com/bayugyug/rest-api-throttleip/config"
 	"github.com/bayugyug/rest-api-throttleip/models"
 	"github.com/bayugyug/rest-api-throttleip/utils"
 	"github.com/go-chi/render"
@@ -16,26 +17,19 @@ type APIResponse struct {
 	Status string
 }
 
+//QuotaResponse remaining quotas of the caller
+type QuotaResponse struct {
+	Code   int
+	Status string
+	Quotas []*models.QuotaStatus
+}
+
+//ApiHandler the http handlers of 1 service
 type ApiHandler struct {
+	svc *ApiService
 }
 
 func (api *ApiHandler) IndexPage(w http.ResponseWriter, r *http.Request) {
-
-	//check ip details
-	tracker := models.NewTrackerIP()
-	trkInfo := tracker.GetIPInfo(ApiInstance.Context, r)
-
-	//206
-	if trkInfo == nil {
-		api.ReplyErrContent(w, r, http.StatusPartialContent, http.StatusText(http.StatusPartialContent))
-		return
-	}
-
-	//check
-	if !api.CheckIPInfo(w, r, trkInfo) {
-		return
-	}
-
 	//good
 	render.JSON(w, r, APIResponse{
 		Code:   200,
@@ -44,22 +38,6 @@ func (api *ApiHandler) IndexPage(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *ApiHandler) DummyReqGet(w http.ResponseWriter, r *http.Request) {
-
-	//check ip details
-	tracker := models.NewTrackerIP()
-	trkInfo := tracker.GetIPInfo(ApiInstance.Context, r)
-
-	//206
-	if trkInfo == nil {
-		api.ReplyErrContent(w, r, http.StatusPartialContent, http.StatusText(http.StatusPartialContent))
-		return
-	}
-
-	//check
-	if !api.CheckIPInfo(w, r, trkInfo) {
-		return
-	}
-
 	//good
 	render.JSON(w, r, APIResponse{
 		Code:   200,
@@ -68,24 +46,6 @@ func (api *ApiHandler) DummyReqGet(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *ApiHandler) DummyReqPost(w http.ResponseWriter, r *http.Request) {
-
-	//check ip details
-	tracker := models.NewTrackerIP()
-	trkInfo := tracker.GetIPInfo(ApiInstance.Context, r)
-
-	//206
-	if trkInfo == nil {
-		api.ReplyErrContent(w, r, http.StatusPartialContent, http.StatusText(http.StatusPartialContent))
-		return
-	}
-
-	//check
-	if !api.CheckIPInfo(w, r, trkInfo) {
-		trkInfo.Status = "Denied"
-		utils.Dumper(trkInfo)
-		return
-	}
-
 	//good
 	render.JSON(w, r, APIResponse{
 		Code:   200,
@@ -94,22 +54,6 @@ func (api *ApiHandler) DummyReqPost(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *ApiHandler) DummyReqPut(w http.ResponseWriter, r *http.Request) {
-
-	//check ip details
-	tracker := models.NewTrackerIP()
-	trkInfo := tracker.GetIPInfo(ApiInstance.Context, r)
-
-	//206
-	if trkInfo == nil {
-		api.ReplyErrContent(w, r, http.StatusPartialContent, http.StatusText(http.StatusPartialContent))
-		return
-	}
-
-	//check
-	if !api.CheckIPInfo(w, r, trkInfo) {
-		return
-	}
-
 	//good
 	render.JSON(w, r, APIResponse{
 		Code:   200,
@@ -118,10 +62,19 @@ func (api *ApiHandler) DummyReqPut(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *ApiHandler) DummyReqDelete(w http.ResponseWriter, r *http.Request) {
+	//good
+	render.JSON(w, r, APIResponse{
+		Code:   200,
+		Status: "DummyReqDelete::Welcome",
+	})
+}
+
+//QuotaInfo show the remaining quotas without spending
+func (api *ApiHandler) QuotaInfo(w http.ResponseWriter, r *http.Request) {
 
 	//check ip details
 	tracker := models.NewTrackerIP()
-	trkInfo := tracker.GetIPInfo(ApiInstance.Context, r)
+	trkInfo := tracker.GetIPInfo(api.svc.Context, r)
 
 	//206
 	if trkInfo == nil {
@@ -129,15 +82,14 @@ func (api *ApiHandler) DummyReqDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//check
-	if !api.CheckIPInfo(w, r, trkInfo) {
-		return
-	}
+	quotas := api.svc.Quotas.Peek(r, trkInfo.IP)
+	api.SetQuotaHeaders(w, quotas)
 
 	//good
-	render.JSON(w, r, APIResponse{
+	render.JSON(w, r, QuotaResponse{
 		Code:   200,
-		Status: "DummyReqDelete::Welcome",
+		Status: "QuotaInfo::Welcome",
+		Quotas: quotas,
 	})
 }
 
@@ -153,31 +105,149 @@ func (api ApiHandler) ReplyErrContent(w http.ResponseWriter, r *http.Request, co
 }
 
 //CheckIPInfo check history and send error message
-func (api *ApiHandler) CheckIPInfo(w http.ResponseWriter, r *http.Request, trk *models.TrackerIP) bool {
+func (api *ApiHandler) CheckIPInfo(w http.ResponseWriter, r *http.Request, trk *models.TrackerIP, policy *models.Policy, cost int) (*models.Decision, bool) {
+	dec, code, msg := api.DecideIPInfo(w, r, trk, policy, cost)
+	if code != http.StatusOK {
+		//409 is sent on the body only
+		if code != http.StatusConflict {
+			render.Status(r, code)
+		}
+		api.ReplyErrContent(w, r, code, msg)
+		return dec, false
+	}
+	return dec, true
+}
+
+//DecideIPInfo check the policy windows and quotas, set the headers and save the logs without replying
+func (api *ApiHandler) DecideIPInfo(w http.ResponseWriter, r *http.Request, trk *models.TrackerIP, policy *models.Policy, cost int) (*models.Decision, int, string) {
 
-	//check
-	tot := ApiInstance.IPHistory.GetIP(trk.IP)
-	log.Println("IP Total:", trk.IP, tot)
+	//dry-run policies, recorded only
+	api.ShadowIPInfo(r, trk)
+	trk.Policy = policy.Name
+
+	//check all windows of the matching policy
+	dec := api.svc.Limiter.Allow(trk.IP, policy, cost)
+	if !dec.Allowed && policy.Shapes() {
+		dec = api.ShapeIPInfo(r, trk, policy, cost, dec)
+	}
+	api.svc.Metrics.Policy(policy, dec)
+	log.Println("IP Total:", trk.IP, dec.Policy, dec.Used, dec.Limit, dec.Window, "cost", cost)
+
+	//tightest window
+	api.SetRateLimitHeaders(w, dec)
 
 	//check max reached
-	if tot > config.RequestsPerMinute {
+	if !dec.Allowed {
+		trk.Status = "Denied"
+		//save to logs
+		api.SaveIPInfo(w, r, trk)
+		code := http.StatusConflict
+		if policy.Shapes() {
+			//wait is too long
+			code = http.StatusTooManyRequests
+		}
+		return dec, code, fmt.Sprintf("IP is not allowed. Already reached %d/%d per %s.", dec.Used, dec.Limit, dec.Window)
+	}
+	//long-term quotas
+	quotas, blocked := api.svc.Quotas.Hit(r, trk.IP)
+	api.SetQuotaHeaders(w, quotas)
+	if blocked != nil {
+		//not served, give back the tokens
+		api.svc.Limiter.Adjust(dec, -dec.Cost)
 		trk.Status = "Denied"
 		//save to logs
 		api.SaveIPInfo(w, r, trk)
-		//reply
-		api.ReplyErrContent(w, r,
-			http.StatusConflict,
-			fmt.Sprintf("IP is not allowed. Already reached %d/%d per minute.", tot, config.RequestsPerMinute))
-		return false
+		return dec, http.StatusConflict, fmt.Sprintf("Quota %s is used up. Already reached %d/%d until %s.", blocked.Name, blocked.Used, blocked.Limit, blocked.ResetAt)
+	}
+	for _, q := range quotas {
+		if !q.Exceeded {
+			continue
+		}
+		switch q.Overage {
+		case models.QuotaOverageWarn:
+			w.Header().Add("X-Quota-Warning", fmt.Sprintf("%s exceeded %d/%d", q.Name, q.Used, q.Limit))
+		case models.QuotaOverageBill:
+			trk.Status = "Overage"
+		}
 	}
+
 	//save logs
 	api.SaveIPInfo(w, r, trk)
-	return true
+	return dec, http.StatusOK, ""
 
 }
 
+//ShadowIPInfo run the shadow policies of the request and record what they would deny
+func (api *ApiHandler) ShadowIPInfo(r *http.Request, trk *models.TrackerIP) {
+	for _, p := range api.svc.Policies.Shadows(r) {
+		dec := api.svc.Limiter.Allow(trk.IP, p, p.Cost.Upfront(r))
+		api.svc.Metrics.Policy(p, dec)
+		if dec.Allowed {
+			continue
+		}
+		log.Println("IP Shadow deny:", trk.IP, p.Name, dec.Used, dec.Limit, dec.Window)
+		shadow := *trk
+		shadow.Status = models.StatusWouldDeny
+		shadow.Extra = "policy=" + p.Name
+		shadow.Policy = p.Name
+		api.svc.IPHistory.HistoryChannel <- &shadow
+	}
+}
+
+//ShapeIPInfo hold the request until a slot opens or the max wait is reached
+func (api *ApiHandler) ShapeIPInfo(r *http.Request, trk *models.TrackerIP, policy *models.Policy, cost int, dec *models.Decision) *models.Decision {
+	key := trk.IP + "::" + policy.Name
+	if !api.svc.Shaper.Enter(key, policy.MaxQueue) {
+		log.Println("IP Shape queue full:", key)
+		return dec
+	}
+	defer api.svc.Shaper.Leave(key)
+
+	deadline := api.svc.Clock.Now().Add(policy.MaxWaitDuration())
+	for !dec.Allowed {
+		//leaky bucket, from the reset the waiting ones drain 1 per window/limit
+		var spacing time.Duration
+		if dec.Limit > 0 {
+			spacing = dec.Window / time.Duration(dec.Limit)
+		}
+		now := api.svc.Clock.Now()
+		at, oks := api.svc.Shaper.Next(key, now.Add(dec.Reset), spacing, deadline)
+		if !oks {
+			return dec
+		}
+		wait := at.Sub(now)
+		log.Println("IP Shape wait:", key, wait)
+		select {
+		case <-r.Context().Done():
+			//client is gone
+			return dec
+		case <-api.svc.Clock.After(wait):
+		}
+		dec = api.svc.Limiter.Allow(trk.IP, policy, cost)
+	}
+	return dec
+}
+
+//SetQuotaHeaders report the quota with the least remaining
+func (api *ApiHandler) SetQuotaHeaders(w http.ResponseWriter, quotas []*models.QuotaStatus) {
+	tight := api.svc.Quotas.Tightest(quotas)
+	if tight == nil {
+		return
+	}
+	w.Header().Set("X-Quota-Limit", strconv.FormatInt(tight.Limit, 10))
+	w.Header().Set("X-Quota-Remaining", strconv.FormatInt(tight.Remaining, 10))
+	w.Header().Set("X-Quota-Reset", tight.ResetAt)
+}
+
+//SetRateLimitHeaders report the window details
+func (api *ApiHandler) SetRateLimitHeaders(w http.ResponseWriter, dec *models.Decision) {
+	for k, v := range RateLimitHeaders(dec) {
+		w.Header().Set(k, v)
+	}
+}
+
 func (api *ApiHandler) SaveIPInfo(w http.ResponseWriter, r *http.Request, trk *models.TrackerIP) {
 	//pipe to redis
-	ApiInstance.IPHistory.HistoryChannel <- trk
+	api.svc.IPHistory.HistoryChannel <- trk
 	utils.Dumper(trk)
 }
@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+)
+
+//TestHistoryReport counts of the saved decisions on the admin report
+func TestHistoryReport(t *testing.T) {
+
+	svc, err := NewApiService(
+		WithSvcOptRedisHost(StoreMemory),
+		WithSvcOptPolicies(models.PolicyList{models.NewPolicy("report", "/v1/api/request", 2, "minute")}),
+		WithSvcOptClock(models.NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	ts := httptest.NewServer(svc.Router)
+	defer ts.Close()
+	for i := 0; i < 5; i++ {
+		testRequest(t, ts, "GET", "/v1/api/request/report", nil, "")
+	}
+	//queued records are saved on close
+	svc.IPHistory.Close()
+	if !svc.IPHistory.WaitHistory(time.Second) {
+		t.Fatal("History failed: not saved")
+	}
+
+	now := time.Now()
+	mockLists := []struct {
+		Query  url.Values
+		Code   int
+		Total  int64
+		Denied int
+	}{
+		{url.Values{}, http.StatusOK, 5, 1},
+		{url.Values{"top": {"0"}}, http.StatusOK, 5, 0},
+		{url.Values{"from": {now.Add(time.Hour).Format(time.RFC3339)}, "to": {now.Add(2 * time.Hour).Format(time.RFC3339)}}, http.StatusOK, 0, 0},
+		{url.Values{"from": {"yesterday"}}, http.StatusBadRequest, 0, 0},
+		{url.Values{"top": {"-1"}}, http.StatusBadRequest, 0, 0},
+	}
+
+	for i, rec := range mockLists {
+		w := httptest.NewRecorder()
+		svc.Api.HistoryInfo(w, httptest.NewRequest("GET", "/v1/api/admin/history?"+rec.Query.Encode(), nil))
+		var reply HistoryResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("%d Response failed", i+1)
+		}
+		if reply.Code != rec.Code {
+			t.Fatalf("%d Report failed: %d %s", i+1, reply.Code, w.Body.String())
+		}
+		if rec.Code != http.StatusOK {
+			t.Log(i+1, "OKAY", reply.Code, reply.Status)
+			continue
+		}
+		if reply.Report.Total != rec.Total || len(reply.Report.TopDenied) != rec.Denied {
+			t.Fatalf("%d Report failed: %s", i+1, w.Body.String())
+		}
+		if rec.Total > 0 {
+			statuses := make(map[string]int64)
+			for _, c := range reply.Report.Statuses {
+				statuses[c.Name] = c.Count
+			}
+			if statuses["Allowed"] != 2 || statuses["Denied"] != 3 {
+				t.Fatalf("%d Report failed: %v", i+1, statuses)
+			}
+			if len(reply.Report.Policies) != 1 || reply.Report.Policies[0].Policy != "report" {
+				t.Fatalf("%d Report failed: policies %s", i+1, w.Body.String())
+			}
+		}
+		t.Log(i+1, "OKAY", reply.Report.Total, len(reply.Report.TopDenied))
+	}
+
+	t.Log("OK")
+}
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+)
+
+//TestKeySpace namespaced keys, the old fixed keys by default
+func TestKeySpace(t *testing.T) {
+
+	mockLists := []struct {
+		Cfg     *models.KeyConfig
+		Denied  string
+		Hybrid  string
+		Invalid bool
+	}{
+		{nil, models.IPDeniedKey, "THROTTLE::HYBRID", false},
+		{&models.KeyConfig{Prefix: "shop:"}, "shop:" + models.IPDeniedKey, "shop:THROTTLE::HYBRID", false},
+		{&models.KeyConfig{Template: "{app}:{env}:throttle:{name}", App: "shop", Env: "prod"},
+			"shop:prod:throttle:ip:denied", "shop:prod:throttle:hybrid", false},
+		{&models.KeyConfig{Template: "{APP}-{name}"}, "{APP}-ip:denied", "{APP}-hybrid", false},
+		{&models.KeyConfig{Template: "{app}:throttle:{name}"}, "", "", true},
+		{&models.KeyConfig{Template: "throttle"}, "", "", true},
+	}
+
+	for i, rec := range mockLists {
+		keys, err := models.NewKeySpace(rec.Cfg)
+		if rec.Invalid {
+			if err == nil {
+				t.Fatalf("%d Validate failed", i+1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys.IPDenied != rec.Denied || keys.Hybrid != rec.Hybrid {
+			t.Fatalf("%d Keys failed: %s %s", i+1, keys.IPDenied, keys.Hybrid)
+		}
+		t.Log(i+1, "OKAY", keys.IPDenied, keys.Hybrid)
+	}
+	//the old fixed keys
+	if k := models.DefaultKeys; k.IPAllowed != models.IPAllowedKey || k.IPShadow != "THROTTLE::IP::SHADOW" ||
+		k.Quota != models.QuotaKey || k.QuotaOverage != "THROTTLE::QUOTA::OVERAGE" || k.Inflight != "THROTTLE::INFLIGHT" {
+		t.Fatalf("Default keys failed: %+v", k)
+	}
+
+	//2 deployments on 1 store do not mix their counts
+	clock := models.NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))
+	store := models.NewMemoryCounterStore()
+	store.Clock = clock
+	share := 0.0
+	policy := models.NewPolicy("tenant", "/v1/api/request", 2, "minute")
+	newService := func(prefix string) *ApiService {
+		svc, err := NewApiService(
+			WithSvcOptRedisHost(StoreMemory),
+			WithSvcOptClock(clock),
+			WithSvcOptCounterStore(store),
+			WithSvcOptHybrid(&models.HybridConfig{LocalShare: &share}),
+			WithSvcOptKeys(&models.KeyConfig{Prefix: prefix}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return svc
+	}
+	blue, green := newService("blue:"), newService("green:")
+	defer blue.Close()
+	defer green.Close()
+	for i, svc := range []*ApiService{blue, blue, green, green} {
+		if dec := svc.Limiter.Allow("10.0.0.1", policy, 1); !dec.Allowed {
+			t.Fatalf("%d Namespace failed: denied", i+1)
+		}
+		svc.Limiter.(*models.HybridLimiter).Sync()
+	}
+	for _, prefix := range []string{"blue:", "green:"} {
+		keys, _ := store.Keys(prefix + models.DefaultKeys.Hybrid)
+		if len(keys) != 1 || !strings.HasPrefix(keys[0], prefix) {
+			t.Fatalf("Namespace failed: %s %v", prefix, keys)
+		}
+		if n, _ := store.Get(keys[0]); n != 2 {
+			t.Fatalf("Namespace failed: %s %d", keys[0], n)
+		}
+		t.Log("OKAY", keys[0])
+	}
+
+	t.Log("OK")
+}
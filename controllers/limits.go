@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/go-chi/render"
+)
+
+const (
+	//LimitsMaxItems max keys per call
+	LimitsMaxItems = 100
+)
+
+//LimitsItem 1 key to decide
+//
+//  policy: name of the policy, default if empty
+//  cost:   tokens to take/refund, default 1
+//  max_wait: reserve only, how far ahead to book (Go duration)
+type LimitsItem struct {
+	Key     string `json:"key"`
+	Policy  string `json:"policy"`
+	Cost    int    `json:"cost"`
+	MaxWait string `json:"max_wait"`
+}
+
+//LimitsRequest batch of keys
+type LimitsRequest struct {
+	Items []*LimitsItem `json:"items"`
+}
+
+//LimitsDecision decision of 1 key, durations are in seconds
+type LimitsDecision struct {
+	Key       string  `json:"key"`
+	Allowed   bool    `json:"allowed"`
+	Policy    string  `json:"policy"`
+	Limit     int     `json:"limit"`
+	Used      int     `json:"used"`
+	Remaining int     `json:"remaining"`
+	Window    float64 `json:"window"`
+	Reset     float64 `json:"reset"`
+	Wait      float64 `json:"wait"`
+	Cost      int     `json:"cost"`
+}
+
+//LimitsResponse decisions in the same order as the items
+type LimitsResponse struct {
+	Code      int
+	Status    string
+	Decisions []*LimitsDecision
+}
+
+//LimitsCheck take the cost from each key if allowed
+func (api *ApiHandler) LimitsCheck(w http.ResponseWriter, r *http.Request) {
+	api.decideLimits(w, r, "LimitsCheck", func(item *LimitsItem, p *models.Policy) *models.Decision {
+		return api.svc.Limiter.Allow(item.Key, p, item.Cost)
+	})
+}
+
+//LimitsReserve book the cost on each key, the wait is when the tokens can be used
+func (api *ApiHandler) LimitsReserve(w http.ResponseWriter, r *http.Request) {
+	api.decideLimits(w, r, "LimitsReserve", func(item *LimitsItem, p *models.Policy) *models.Decision {
+		maxWait := p.MaxWaitDuration()
+		if d, err := time.ParseDuration(item.MaxWait); err == nil && d >= 0 {
+			maxWait = d
+		}
+		return api.svc.Limiter.Reserve(item.Key, p, item.Cost, maxWait)
+	})
+}
+
+//LimitsPeek remaining budget of each key without spending
+func (api *ApiHandler) LimitsPeek(w http.ResponseWriter, r *http.Request) {
+	api.decideLimits(w, r, "LimitsPeek", func(item *LimitsItem, p *models.Policy) *models.Decision {
+		return api.svc.Limiter.Peek(item.Key, p)
+	})
+}
+
+//LimitsRefund give back the cost to each key
+func (api *ApiHandler) LimitsRefund(w http.ResponseWriter, r *http.Request) {
+	api.decideLimits(w, r, "LimitsRefund", func(item *LimitsItem, p *models.Policy) *models.Decision {
+		return api.svc.Limiter.Refund(item.Key, p, item.Cost)
+	})
+}
+
+func (api *ApiHandler) decideLimits(w http.ResponseWriter, r *http.Request, name string, decide func(*LimitsItem, *models.Policy) *models.Decision) {
+	var req LimitsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Items) == 0 {
+		render.Status(r, http.StatusBadRequest)
+		api.ReplyErrContent(w, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if len(req.Items) > LimitsMaxItems {
+		render.Status(r, http.StatusRequestEntityTooLarge)
+		api.ReplyErrContent(w, r, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+		return
+	}
+	policies := make([]*models.Policy, len(req.Items))
+	for i, item := range req.Items {
+		if item == nil || item.Key == "" || item.Cost < 0 {
+			render.Status(r, http.StatusBadRequest)
+			api.ReplyErrContent(w, r, http.StatusBadRequest, "Invalid item, key is required and cost must not be negative.")
+			return
+		}
+		policies[i] = api.svc.Default
+		if item.Policy != "" {
+			if policies[i] = api.svc.Policies.ByName(item.Policy, nil); policies[i] == nil {
+				render.Status(r, http.StatusBadRequest)
+				api.ReplyErrContent(w, r, http.StatusBadRequest, "Unknown policy: "+item.Policy)
+				return
+			}
+		}
+	}
+
+	decisions := make([]*LimitsDecision, 0, len(req.Items))
+	for i, item := range req.Items {
+		if item.Cost == 0 {
+			item.Cost = 1
+		}
+		dec := decide(item, policies[i])
+		decisions = append(decisions, &LimitsDecision{
+			Key:       item.Key,
+			Allowed:   dec.Allowed,
+			Policy:    dec.Policy,
+			Limit:     dec.Limit,
+			Used:      dec.Used,
+			Remaining: dec.Remaining,
+			Window:    dec.Window.Seconds(),
+			Reset:     dec.Reset.Seconds(),
+			Wait:      dec.Wait.Seconds(),
+			Cost:      dec.Cost,
+		})
+	}
+
+	//good
+	render.JSON(w, r, LimitsResponse{
+		Code:      200,
+		Status:    name + "::Welcome",
+		Decisions: decisions,
+	})
+}
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+)
+
+//TestLimits check, reserve, peek and refund on the same key
+func TestLimits(t *testing.T) {
+
+	//2 per minute
+	svc, err := NewApiService(
+		WithSvcOptRedisHost(StoreMemory),
+		WithSvcOptPolicies(models.PolicyList{models.NewPolicy("limits-test", "/limits-test", 2, "minute")}),
+		WithSvcOptClock(models.NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	api := svc.Api
+	mockLists := []struct {
+		Handler   http.HandlerFunc
+		Body      string
+		Code      int
+		Allowed   bool
+		Policy    string
+		Remaining int
+		Wait      float64
+	}{
+		{api.LimitsCheck, `{"items":[{"key":"k1","policy":"limits-test"}]}`, 200, true, "limits-test", 1, 0},
+		{api.LimitsPeek, `{"items":[{"key":"k1","policy":"limits-test"}]}`, 200, true, "limits-test", 1, 0},
+		{api.LimitsCheck, `{"items":[{"key":"k1","policy":"limits-test","cost":2}]}`, 200, false, "limits-test", 0, 0},
+		{api.LimitsRefund, `{"items":[{"key":"k1","policy":"limits-test"}]}`, 200, true, "limits-test", 2, 0},
+		{api.LimitsReserve, `{"items":[{"key":"k1","policy":"limits-test","cost":2}]}`, 200, true, "limits-test", 0, 0},
+		//booked on the next window
+		{api.LimitsReserve, `{"items":[{"key":"k1","policy":"limits-test","max_wait":"2m"}]}`, 200, true, "limits-test", 1, 60},
+		{api.LimitsReserve, `{"items":[{"key":"k1","policy":"limits-test","max_wait":"1s"}]}`, 200, false, "limits-test", 0, 60},
+		{api.LimitsPeek, `{"items":[{"key":"k1","policy":"limits-test"}]}`, 200, false, "limits-test", 0, 0},
+		//default policy
+		{api.LimitsCheck, `{"items":[{"key":"k1"}]}`, 200, true, "default", 0, 0},
+		{api.LimitsCheck, `{"items":[{"key":"k1","policy":"limits-tset"}]}`, 400, false, "", 0, 0},
+		{api.LimitsPeek, `{"items":[{"key":"k1"},{"key":"k1","policy":"limits-tset"}]}`, 400, false, "", 0, 0},
+		{api.LimitsRefund, `{"items":[{"key":"k1","cost":-1}]}`, 400, false, "", 0, 0},
+		{api.LimitsCheck, `{"items":[]}`, 400, false, "", 0, 0},
+	}
+	for i, rec := range mockLists {
+		w := httptest.NewRecorder()
+		rec.Handler(w, httptest.NewRequest("POST", "/v1/api/limits", strings.NewReader(rec.Body)))
+		var reply LimitsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("%d Response failed", i+1)
+		}
+		if reply.Code != rec.Code {
+			t.Fatalf("%d Limits failed: %s", i+1, w.Body.String())
+		}
+		if rec.Code != 200 {
+			t.Log(i+1, "OKAY", reply.Code, reply.Status)
+			continue
+		}
+		dec := reply.Decisions[0]
+		if dec.Allowed != rec.Allowed || dec.Policy != rec.Policy || (rec.Policy != "default" && dec.Remaining != rec.Remaining) || dec.Wait != rec.Wait {
+			t.Fatalf("%d Decision failed: %s", i+1, w.Body.String())
+		}
+		t.Log(i+1, "OKAY", dec.Allowed, dec.Remaining, dec.Wait)
+	}
+	t.Log("OK")
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+)
+
+//ThrottleIP check the matching policy before the handler and settle its cost after
+func (api *ApiHandler) ThrottleIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		//check ip details
+		tracker := models.NewTrackerIP()
+		trkInfo := tracker.GetIPInfo(api.svc.Context, r)
+
+		//206
+		if trkInfo == nil {
+			api.ReplyErrContent(w, r, http.StatusPartialContent, http.StatusText(http.StatusPartialContent))
+			return
+		}
+
+		policy := api.svc.Policies.Match(r, api.svc.Default)
+		trkInfo.Policy = policy.Name
+
+		//brute-force, only the failures are counted
+		if policy.CountsFailures() {
+			api.ThrottleFailures(w, r, next, trkInfo, policy)
+			return
+		}
+
+		//in-flight slots
+		if api.svc.Inflight.Enabled(policy.Concurrency) {
+			release, oks := api.svc.Inflight.Acquire(trkInfo.IP+"::"+policy.Name, policy.Concurrency)
+			if !oks {
+				trkInfo.Status = "Denied"
+				api.SaveIPInfo(w, r, trkInfo)
+				render.Status(r, http.StatusTooManyRequests)
+				api.ReplyErrContent(w, r, http.StatusTooManyRequests, "IP is not allowed. Too many requests in flight.")
+				return
+			}
+			defer release()
+			//client is gone
+			stop := context.AfterFunc(r.Context(), release)
+			defer stop()
+		}
+
+		//check
+		cost := policy.Cost.Upfront(r)
+		dec, oks := api.CheckIPInfo(w, r, trkInfo, policy, cost)
+		if !oks {
+			return
+		}
+
+		//serve
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+
+		api.SettleCost(dec, policy, ww, time.Since(start))
+	})
+}
+
+//SettleCost refund the tokens on handler failure, otherwise charge the final cost
+func (api *ApiHandler) SettleCost(dec *models.Decision, policy *models.Policy, ww middleware.WrapResponseWriter, took time.Duration) {
+	if ww.Status() >= http.StatusInternalServerError {
+		api.svc.Limiter.Adjust(dec, -dec.Cost)
+		return
+	}
+	if final := policy.Cost.Settle(dec.Cost, int64(ww.BytesWritten()), took); final != dec.Cost {
+		api.svc.Limiter.Adjust(dec, final-dec.Cost)
+	}
+}
+
+//Classify set the priority class of the request, policy priority is the fallback
+func (svc *ApiService) Classify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := svc.Policies.Match(r, svc.Default)
+		//x-forwarded-for is only taken from the trusted proxies (RealIP)
+		class := svc.Classifier.Classify(r, models.PeerIP(r), policy.Priority)
+		next.ServeHTTP(w, r.WithContext(models.WithPriority(r.Context(), class)))
+	})
+}
+
+//ShedLoad drop the lower classes first once the in-flight or queued requests are over the threshold
+func (svc *ApiService) ShedLoad(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if svc.Shedder == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		class := models.PriorityFromContext(r.Context())
+		leave, oks := svc.Shedder.Enter(class, svc.Shaper.Total())
+		if !oks {
+			svc.ReplyShed(w, r, "shedding", class)
+			return
+		}
+		defer leave()
+		next.ServeHTTP(w, r)
+	})
+}
+
+//ReplyShed record the shed class then send 503
+func (svc *ApiService) ReplyShed(w http.ResponseWriter, r *http.Request, stage, class string) {
+	svc.Metrics.Add("shed::"+stage+"::"+class, 1)
+	if trk := models.NewTrackerIP().GetIPInfo(svc.Context, r); trk != nil {
+		trk.Status = "Shed"
+		svc.Api.SaveIPInfo(w, r, trk)
+	}
+	w.Header().Set("Retry-After", "1")
+	render.Status(r, http.StatusServiceUnavailable)
+	svc.Api.ReplyErrContent(w, r, http.StatusServiceUnavailable, "Service is busy. Please try again later.")
+}
+
+//AdaptiveLimit shed the requests once the latency based global limit is reached
+func (svc *ApiService) AdaptiveLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if svc.Adaptive == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		//lower priorities are shed first
+		class := models.PriorityFromContext(r.Context())
+		done, oks := svc.Adaptive.Acquire(class)
+		if !oks {
+			svc.ReplyShed(w, r, "adaptive", class)
+			return
+		}
+
+		//panics and timeouts count as failed
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		failed := true
+		defer func() {
+			done(failed || ww.Status() >= http.StatusInternalServerError || r.Context().Err() == context.DeadlineExceeded)
+		}()
+		next.ServeHTTP(ww, r)
+		failed = false
+	})
+}
@@ -11,14 +11,25 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/bayugyug/rest-api-throttleip/config"
+	"github.com/bayugyug/rest-api-throttleip/models"
 	"github.com/bayugyug/rest-api-throttleip/utils"
 )
 
 var thandler *ApiHandler
 var tAuthToken string
 
+//tService the service under test
+var tService *ApiService
+
+//tJwtSecret the user and admin end-points are off on the built-in secret
+const tJwtSecret = "throttleip-test-secret"
+
+//tClock only moves when the test says so
+var tClock = models.NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))
+
 //TestHandler default initializer
 func TestHandler(t *testing.T) {
 	var err error
@@ -27,7 +38,7 @@ func TestHandler(t *testing.T) {
 	if os.Getenv("REST_API_THROTTLEIP_DEV") != "" {
 		tcfg = os.Getenv("REST_API_THROTTLEIP_DEV")
 	} else {
-		tcfg = `{"http_port":"8989","redis_host":"127.0.0.1:6379","showlog":true}`
+		tcfg = `{"http_port":"8989","redis_host":"memory","showlog":true}`
 	}
 	//init
 	thandler = &ApiHandler{}
@@ -41,9 +52,10 @@ func TestHandler(t *testing.T) {
 	}
 
 	//init service
-	if ApiInstance, err = NewApiService(
+	if tService, err = NewApiService(
 		WithSvcOptAddress(":"+appcfg.Config.HttpPort),
 		WithSvcOptRedisHost(appcfg.Config.RedisHost),
+		WithSvcOptClock(tClock),
 	); err != nil {
 		t.Fatal("Oops! config might be missing", err)
 	}
@@ -80,7 +92,7 @@ func testRequest(t *testing.T, ts *httptest.Server, method, path string, body io
 func TestHandlers(t *testing.T) {
 
 	//setup
-	ts := httptest.NewServer(ApiInstance.Router)
+	ts := httptest.NewServer(tService.Router)
 	defer ts.Close()
 
 	mockLists := []struct {
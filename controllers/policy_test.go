@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/config"
+	"github.com/bayugyug/rest-api-throttleip/models"
+)
+
+//TestMultiWindow all windows are checked at once, the headers show the tightest
+func TestMultiWindow(t *testing.T) {
+
+	//2 per minute and 3 per hour
+	saved := tService.Policies
+	defer func() { tService.Policies = saved }()
+	tService.Policies = models.PolicyList{{
+		Name:    "multi-test",
+		Route:   "/v1/api/request",
+		Windows: []*models.Window{{Limit: 2, Per: "minute"}, {Limit: 3, Per: "hour"}},
+	}}
+
+	ts := httptest.NewServer(tService.Router)
+	defer ts.Close()
+
+	//start of an hour
+	tClock.Set(tClock.Now().Truncate(time.Hour).Add(time.Hour))
+
+	mockLists := []struct {
+		Advance   time.Duration
+		Code      int
+		Limit     string
+		Remaining string
+		Reset     string
+		Policy    string
+	}{
+		{0, http.StatusOK, "2", "1", "60", "2;w=60"},
+		{0, http.StatusOK, "2", "0", "60", "2;w=60"},
+		//minute is used up, the hour is not charged
+		{0, http.StatusConflict, "2", "0", "60", "2;w=60"},
+		//hour is the tightest now
+		{time.Minute, http.StatusOK, "3", "0", "3540", "3;w=3600"},
+		{0, http.StatusConflict, "3", "0", "3540", "3;w=3600"},
+		//next hour
+		{59 * time.Minute, http.StatusOK, "2", "1", "60", "2;w=60"},
+	}
+
+	for i, rec := range mockLists {
+		tClock.Advance(rec.Advance)
+		ret, body := testRequest(t, ts, "GET", "/v1/api/request/multi-test", nil, "")
+		var reply APIResponse
+		if err := json.Unmarshal([]byte(body), &reply); err != nil {
+			t.Fatalf("%d Response failed", i+1)
+		}
+		if reply.Code != rec.Code {
+			t.Fatalf("%d Throttle failed: %d %s", i+1, reply.Code, body)
+		}
+		got := []string{
+			ret.Header.Get("RateLimit-Limit"),
+			ret.Header.Get("RateLimit-Remaining"),
+			ret.Header.Get("RateLimit-Reset"),
+			ret.Header.Get("RateLimit-Policy"),
+		}
+		if got[0] != rec.Limit || got[1] != rec.Remaining || got[2] != rec.Reset || got[3] != rec.Policy {
+			t.Fatalf("%d Headers failed: %v", i+1, got)
+		}
+		if retry := ret.Header.Get("Retry-After"); (rec.Code == http.StatusConflict) != (retry == rec.Reset) {
+			t.Fatalf("%d Retry-After failed: %s", i+1, retry)
+		}
+		t.Log(i+1, "OKAY", reply.Code, got)
+	}
+
+	t.Log("OK")
+}
+
+//TestPolicyConfig empty entries are rejected, not dereferenced
+func TestPolicyConfig(t *testing.T) {
+	settings := &config.ApiSettings{}
+	mockLists := []struct {
+		Config string
+		Valid  bool
+	}{
+		{`{"policies":[{"name":"a","windows":[{"limit":5,"per":"second"},{"limit":100,"per":"hour"}]}]}`, true},
+		{`{"policies":[null]}`, false},
+		{`{"policies":[{"name":"a","windows":[null]}]}`, false},
+		{`{"policies":[{"name":"a","windows":[]}]}`, false},
+		{`{"quotas":[null]}`, false},
+		{`{"upstreams":[null]}`, false},
+		{`{"priorities":[null]}`, false},
+		{`{"quota_store":"redsi"}`, false},
+		{`{"quota_store":"mysql"}`, false},
+	}
+	for i, rec := range mockLists {
+		if cfg := settings.FormatParameterConfig(rec.Config); (cfg != nil) != rec.Valid {
+			t.Fatalf("%d Config failed: %s", i+1, rec.Config)
+		}
+		t.Log(i+1, "OKAY", rec.Config)
+	}
+	t.Log("OK")
+}
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/go-chi/chi"
+)
+
+//TestPriorityIP cidr rules and the throttle key are on the peer, the forwarded ip only from a trusted proxy
+func TestPriorityIP(t *testing.T) {
+
+	svc, err := NewApiService(
+		WithSvcOptRedisHost(StoreMemory),
+		WithSvcOptPriorities([]*models.PriorityRule{{Class: "critical", CIDRs: []string{"192.168.0.0/16"}}}),
+		WithSvcOptTrustedProxies([]string{"10.0.0.5"}),
+		WithSvcOptJwtSecret(tJwtSecret),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	//class and tracker ip as seen by the handler
+	var class, ip string
+	handler := svc.RealIP(svc.Classify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class = models.PriorityFromContext(r.Context())
+		ip = models.NewTrackerIP().GetIPInfo(svc.Context, r).IP
+	})))
+
+	mockLists := []struct {
+		Remote string
+		XFF    string
+		Class  string
+		IP     string
+	}{
+		{"192.168.1.7:5000", "", models.PriorityCritical, "192.168.1.7"},
+		//spoofed internal ip
+		{"203.0.113.9:5000", "192.168.1.7", models.PriorityNormal, "203.0.113.9"},
+		{"203.0.113.9:5000", "192.168.1.7, 10.0.0.5", models.PriorityNormal, "203.0.113.9"},
+		//sent by the trusted proxy
+		{"10.0.0.5:5000", "192.168.1.7", models.PriorityCritical, "192.168.1.7"},
+		{"10.0.0.5:5000", "192.168.1.7, 203.0.113.9", models.PriorityNormal, "203.0.113.9"},
+	}
+	for i, rec := range mockLists {
+		r := httptest.NewRequest("GET", "/v1/api/request/x", nil)
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, chi.NewRouteContext()))
+		r.RemoteAddr = rec.Remote
+		if rec.XFF != "" {
+			r.Header.Set("X-Forwarded-For", rec.XFF)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if class != rec.Class || ip != rec.IP {
+			t.Fatalf("%d Classify failed: %s %s", i+1, class, ip)
+		}
+		t.Log(i+1, "OKAY", rec.Remote, rec.XFF, class, ip)
+	}
+
+	//counters only, no token no counters
+	ts := httptest.NewServer(svc.Router)
+	defer ts.Close()
+	if _, body := testRequest(t, ts, "GET", "/debug/vars", nil, ""); !strings.Contains(body, `"Code":401`) {
+		t.Fatalf("Metrics failed: %s", body)
+	}
+	w := httptest.NewRecorder()
+	svc.Api.MetricsInfo(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	if body := w.Body.String(); !strings.HasPrefix(body, "{\n\"throttle\": {") || strings.Contains(body, "cmdline") {
+		t.Fatalf("Metrics failed: %s", body)
+	}
+	t.Log("OK")
+}
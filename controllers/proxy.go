@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/go-chi/render"
+)
+
+//NewUpstreamProxy reverse proxy of 1 upstream, hop-by-hop headers are dropped by httputil
+func NewUpstreamProxy(u *models.Upstream) (*httputil.ReverseProxy, error) {
+	if err := u.Validate(); err != nil {
+		return nil, err
+	}
+	target, _ := url.Parse(u.URL)
+	prefix := strings.TrimSuffix(u.Prefix, "/")
+
+	director := func(req *http.Request) {
+		//original details
+		req.Header.Set("X-Forwarded-Host", req.Host)
+		if req.Header.Get("X-Forwarded-Proto") == "" {
+			proto := "http"
+			if req.TLS != nil {
+				proto = "https"
+			}
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if u.StripPrefix {
+			req.Header.Set("X-Forwarded-Prefix", prefix)
+			req.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
+		}
+		//httputil appends the client ip only if the remote addr has the port,
+		//the real-ip middleware drops it
+		if _, _, err := net.SplitHostPort(req.RemoteAddr); err != nil && req.Header.Get("X-Forwarded-For") == "" {
+			req.Header.Set("X-Forwarded-For", req.RemoteAddr)
+		}
+
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = joinURLPath(target.Path, req.URL.Path)
+		req.URL.RawPath = ""
+		if target.RawQuery != "" && req.URL.RawQuery != "" {
+			req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+		} else if target.RawQuery != "" {
+			req.URL.RawQuery = target.RawQuery
+		}
+		req.Host = target.Host
+	}
+
+	return &httputil.ReverseProxy{
+		Director: director,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Println("UPSTREAM", u.Prefix, u.URL, err)
+			render.Status(r, http.StatusBadGateway)
+			render.JSON(w, r, APIResponse{
+				Code:   http.StatusBadGateway,
+				Status: http.StatusText(http.StatusBadGateway),
+			})
+		},
+	}, nil
+}
+
+func joinURLPath(a, b string) string {
+	if b == "" {
+		b = "/"
+	}
+	switch {
+	case strings.HasSuffix(a, "/") && strings.HasPrefix(b, "/"):
+		return a + b[1:]
+	case !strings.HasSuffix(a, "/") && !strings.HasPrefix(b, "/"):
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/bayugyug/rest-api-throttleip/utils"
+	"github.com/go-chi/chi"
+)
+
+//TestProxy gateway mode against a local upstream
+func TestProxy(t *testing.T) {
+
+	//upstream echo of what it got
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		json.NewEncoder(w).Encode(map[string]string{
+			"Path":   r.URL.Path,
+			"Query":  r.URL.RawQuery,
+			"Host":   r.Header.Get("X-Forwarded-Host"),
+			"Proto":  r.Header.Get("X-Forwarded-Proto"),
+			"Prefix": r.Header.Get("X-Forwarded-Prefix"),
+			"For":    r.Header.Get("X-Forwarded-For"),
+			"Hop":    r.Header.Get("X-Hop"),
+		})
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewUpstreamProxy(&models.Upstream{
+		Prefix:      "/gw/orders",
+		URL:         upstream.URL + "/base",
+		StripPrefix: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//own policy, 3 per minute
+	saved := tService.Policies
+	defer func() { tService.Policies = saved }()
+	tService.Policies = models.PolicyList{models.NewPolicy("gw-test", "/gw/orders", 3, "minute")}
+
+	//mounted like on MapRoute
+	router := chi.NewRouter()
+	router.Mount("/gw/orders", tService.Api.ThrottleIP(proxy))
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	for i := 1; i <= 3; i++ {
+		req, _ := http.NewRequest("GET", ts.URL+"/gw/orders/items/"+utils.UHelper.UUID()+"?page=2", nil)
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "drop-me")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatal("Response failed", err)
+		}
+		resp.Body.Close()
+
+		if got["Query"] != "page=2" || got["Prefix"] != "/gw/orders" || got["Proto"] != "http" {
+			t.Fatalf("Forward failed: %v", got)
+		}
+		if len(got["Path"]) < len("/base/items/") || got["Path"][:len("/base/items/")] != "/base/items/" {
+			t.Fatalf("Path failed: %v", got["Path"])
+		}
+		if got["Host"] == "" || got["For"] == "" {
+			t.Fatalf("X-Forwarded-* missing: %v", got)
+		}
+		if got["Hop"] != "" {
+			t.Fatalf("Hop-by-hop header forwarded: %v", got["Hop"])
+		}
+		if resp.Header.Get("RateLimit-Limit") != "3" {
+			t.Fatalf("RateLimit headers missing")
+		}
+		t.Log(i, "OKAY", got["Path"])
+	}
+
+	//4th is throttled before forwarding
+	ret, body := testRequest(t, ts, "GET", "/gw/orders/items/4", nil, "")
+	var reply APIResponse
+	if err := json.Unmarshal([]byte(body), &reply); err != nil {
+		t.Fatalf("Response failed")
+	}
+	if reply.Code != http.StatusConflict || atomic.LoadInt32(&hits) != 3 {
+		t.Fatalf("Throttle failed: %d %d %s", ret.StatusCode, hits, body)
+	}
+
+	t.Log("OK")
+}
@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"context"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+//RateLimitServer envoy.service.ratelimit.v3.RateLimitService on the same counters as the http path
+type RateLimitServer struct {
+	rls.UnimplementedRateLimitServiceServer
+	svc *ApiService
+}
+
+//NewRateLimitServer new instance
+func NewRateLimitServer(svc *ApiService) *RateLimitServer {
+	return &RateLimitServer{svc: svc}
+}
+
+//NewGrpcServer grpc server with the rate limit service registered
+func (svc *ApiService) NewGrpcServer() *grpc.Server {
+	srv := grpc.NewServer()
+	rls.RegisterRateLimitServiceServer(srv, NewRateLimitServer(svc))
+	return srv
+}
+
+//ShouldRateLimit check every descriptor against its policy, over limit if any of them is
+func (s *RateLimitServer) ShouldRateLimit(ctx context.Context, req *rls.RateLimitRequest) (*rls.RateLimitResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "rate limit domain must not be empty")
+	}
+	if len(req.GetDescriptors()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "rate limit descriptor list must not be empty")
+	}
+	if s.svc.RlsDomain != "" && req.GetDomain() != s.svc.RlsDomain {
+		return nil, status.Errorf(codes.InvalidArgument, "rate limit domain %q is not served", req.GetDomain())
+	}
+
+	resp := &rls.RateLimitResponse{
+		OverallCode: rls.RateLimitResponse_OK,
+	}
+	var tight *models.Decision
+	for _, desc := range req.GetDescriptors() {
+		dec := s.decide(req, desc)
+		if dec == nil {
+			//no policy, no limit
+			resp.Statuses = append(resp.Statuses, &rls.RateLimitResponse_DescriptorStatus{
+				Code: rls.RateLimitResponse_OK,
+			})
+			continue
+		}
+		st := &rls.RateLimitResponse_DescriptorStatus{
+			Code: rls.RateLimitResponse_OK,
+			CurrentLimit: &rls.RateLimitResponse_RateLimit{
+				Name:            dec.Policy,
+				RequestsPerUnit: uint32(dec.Limit),
+				Unit:            rateLimitUnit(dec.Window),
+			},
+			LimitRemaining:     uint32(dec.Remaining),
+			DurationUntilReset: durationpb.New(dec.Reset),
+		}
+		if !dec.Allowed {
+			st.Code = rls.RateLimitResponse_OVER_LIMIT
+			resp.OverallCode = rls.RateLimitResponse_OVER_LIMIT
+		}
+		if tight == nil || (!dec.Allowed && tight.Allowed) ||
+			(dec.Allowed == tight.Allowed && dec.Remaining < tight.Remaining) {
+			tight = dec
+		}
+		resp.Statuses = append(resp.Statuses, st)
+	}
+	for k, v := range RateLimitHeaders(tight) {
+		resp.ResponseHeadersToAdd = append(resp.ResponseHeadersToAdd, &corev3.HeaderValue{Key: k, Value: v})
+	}
+	return resp, nil
+}
+
+//decide take the hits from the policy of the descriptor, nil if there is none
+func (s *RateLimitServer) decide(req *rls.RateLimitRequest, desc *ratelimitv3.RateLimitDescriptor) *models.Decision {
+	entries := make(map[string]string, len(desc.GetEntries()))
+	pairs := make([]string, 0, len(desc.GetEntries()))
+	for _, e := range desc.GetEntries() {
+		entries[e.GetKey()] = e.GetValue()
+		pairs = append(pairs, e.GetKey()+"="+e.GetValue())
+	}
+	policy := s.svc.Policies.MatchDescriptor(entries)
+	if policy == nil {
+		return nil
+	}
+
+	hits := 1
+	if req.GetHitsAddend() > 0 {
+		hits = int(req.GetHitsAddend())
+	}
+	if desc.GetHitsAddend() != nil {
+		hits = int(desc.GetHitsAddend().GetValue())
+	}
+	key := req.GetDomain() + "::" + strings.Join(pairs, "|")
+	dec := s.svc.Limiter.Allow(key, policy, hits)
+	s.svc.Metrics.Policy(policy, dec)
+
+	//history, if envoy sent the client ip
+	if ip := entries["remote_address"]; ip != "" {
+		trk := &models.TrackerIP{
+			IP:       ip,
+			URL:      "grpc://" + req.GetDomain(),
+			Extra:    strings.Join(pairs, "|"),
+			Status:   "Allowed",
+			Priority: models.PriorityNormal,
+			Policy:   policy.Name,
+			DateTime: time.Now().Format(time.RFC3339Nano),
+		}
+		if !dec.Allowed {
+			trk.Status = "Denied"
+			if policy.Shadows() {
+				trk.Status = models.StatusWouldDeny
+			}
+		}
+		s.svc.IPHistory.HistoryChannel <- trk
+	}
+	//dry-run, recorded only
+	if policy.Shadows() && !dec.Allowed {
+		shadow := *dec
+		shadow.Allowed = true
+		return &shadow
+	}
+	return dec
+}
+
+func rateLimitUnit(d time.Duration) rls.RateLimitResponse_RateLimit_Unit {
+	switch d {
+	case time.Second:
+		return rls.RateLimitResponse_RateLimit_SECOND
+	case time.Minute:
+		return rls.RateLimitResponse_RateLimit_MINUTE
+	case time.Hour:
+		return rls.RateLimitResponse_RateLimit_HOUR
+	case 24 * time.Hour:
+		return rls.RateLimitResponse_RateLimit_DAY
+	case 7 * 24 * time.Hour:
+		return rls.RateLimitResponse_RateLimit_WEEK
+	}
+	return rls.RateLimitResponse_RateLimit_UNKNOWN
+}
+
+//RateLimitHeaders the rate-limit headers of the decision
+func RateLimitHeaders(dec *models.Decision) map[string]string {
+	headers := make(map[string]string)
+	if dec == nil || dec.Limit <= 0 {
+		return headers
+	}
+	reset := strconv.Itoa(int(math.Ceil(dec.Reset.Seconds())))
+	headers["RateLimit-Limit"] = strconv.Itoa(dec.Limit)
+	headers["RateLimit-Remaining"] = strconv.Itoa(dec.Remaining)
+	headers["RateLimit-Reset"] = reset
+	headers["RateLimit-Policy"] = strconv.Itoa(dec.Limit) + ";w=" + strconv.Itoa(int(dec.Window.Seconds()))
+	if !dec.Allowed {
+		headers["Retry-After"] = reset
+	}
+	return headers
+}
+
+//listenGrpc serve the rate limit service till stopped
+func (svc *ApiService) listenGrpc(srv *grpc.Server) error {
+	lis, err := net.Listen("tcp", svc.GrpcAddress)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(lis)
+}
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+//TestRateLimitService envoy ShouldRateLimit via an in-process grpc client
+func TestRateLimitService(t *testing.T) {
+
+	//own policy, 2 per minute per remote_address
+	saved := tService.Policies
+	defer func() { tService.Policies = saved }()
+	policy := models.NewPolicy("rls-test", "", 2, "minute")
+	policy.Descriptor = map[string]string{"remote_address": "*"}
+	tService.Policies = models.PolicyList{policy}
+
+	//in-process server
+	lis := bufconn.Listen(1024 * 1024)
+	srv := tService.NewGrpcServer()
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := rls.NewRateLimitServiceClient(conn)
+
+	desc := func(k, v string) *ratelimitv3.RateLimitDescriptor {
+		return &ratelimitv3.RateLimitDescriptor{
+			Entries: []*ratelimitv3.RateLimitDescriptor_Entry{{Key: k, Value: v}},
+		}
+	}
+
+	mockLists := []struct {
+		Descriptor *ratelimitv3.RateLimitDescriptor
+		Code       rls.RateLimitResponse_Code
+	}{
+		{desc("remote_address", "10.9.8.7"), rls.RateLimitResponse_OK},
+		{desc("remote_address", "10.9.8.7"), rls.RateLimitResponse_OK},
+		{desc("remote_address", "10.9.8.7"), rls.RateLimitResponse_OVER_LIMIT},
+		{desc("remote_address", "10.9.8.6"), rls.RateLimitResponse_OK},
+		{desc("generic_key", "no-policy"), rls.RateLimitResponse_OK},
+	}
+
+	for i, rec := range mockLists {
+		resp, err := client.ShouldRateLimit(context.Background(), &rls.RateLimitRequest{
+			Domain:      "edge",
+			Descriptors: []*ratelimitv3.RateLimitDescriptor{rec.Descriptor},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetOverallCode() != rec.Code || len(resp.GetStatuses()) != 1 {
+			t.Fatalf("%d Response failed: %v", i+1, resp)
+		}
+		if rec.Descriptor.Entries[0].Key == "remote_address" {
+			st := resp.GetStatuses()[0]
+			if st.GetCurrentLimit().GetRequestsPerUnit() != 2 || st.GetCurrentLimit().GetUnit() != rls.RateLimitResponse_RateLimit_MINUTE {
+				t.Fatalf("%d Limit failed: %v", i+1, st)
+			}
+			if len(resp.GetResponseHeadersToAdd()) == 0 {
+				t.Fatalf("%d Headers missing", i+1)
+			}
+		}
+		t.Log(i+1, "OKAY", resp.GetOverallCode())
+	}
+
+	//empty domain is rejected
+	if _, err := client.ShouldRateLimit(context.Background(), &rls.RateLimitRequest{}); err == nil {
+		t.Fatal("Empty domain accepted")
+	}
+
+	t.Log("OK")
+}
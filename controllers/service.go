@@ -2,7 +2,10 @@ package controllers
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,7 +14,8 @@ import (
 	"github.com/bayugyug/rest-api-throttleip/config"
 	"github.com/bayugyug/rest-api-throttleip/driver"
 	"github.com/bayugyug/rest-api-throttleip/models"
-	redis "gopkg.in/redis.v3"
+	"github.com/bayugyug/rest-api-throttleip/utils"
+	"google.golang.org/grpc"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -24,18 +28,95 @@ const (
 	svcOptionWithHandler   = "svc-opts-handler"
 	svcOptionWithAddress   = "svc-opts-address"
 	svcOptionWithRedisHost = "svc-opts-redis-host"
+	svcOptionWithRedis     = "svc-opts-redis"
+	svcOptionWithPolicies  = "svc-opts-policies"
+	svcOptionWithQuotas    = "svc-opts-quotas"
+	svcOptionWithQuotaDb   = "svc-opts-quota-db"
+	svcOptionWithInflight  = "svc-opts-max-inflight"
+	svcOptionWithSemStore  = "svc-opts-inflight-store"
+	svcOptionWithAdaptive  = "svc-opts-adaptive"
+	svcOptionWithPriority  = "svc-opts-priorities"
+	svcOptionWithApiKeys   = "svc-opts-api-keys"
+	svcOptionWithShedding  = "svc-opts-shedding"
+	svcOptionWithUpstreams = "svc-opts-upstreams"
+	svcOptionWithGrpc      = "svc-opts-grpc-address"
+	svcOptionWithRlsDomain = "svc-opts-rls-domain"
+	svcOptionWithClock     = "svc-opts-clock"
+	svcOptionWithTracker   = "svc-opts-tracker"
+	svcOptionWithLimiter   = "svc-opts-limiter"
+	svcOptionWithHistory   = "svc-opts-history-store"
+	svcOptionWithCounters  = "svc-opts-counters"
+	svcOptionWithHybrid    = "svc-opts-hybrid"
+	svcOptionWithShards    = "svc-opts-redis-shards"
+	svcOptionWithCounter   = "svc-opts-counter-store"
+	svcOptionWithKeys      = "svc-opts-keys"
+	svcOptionWithHistoryDb = "svc-opts-history-mysql"
+	svcOptionWithUserDb    = "svc-opts-user-db"
+	svcOptionWithUsers     = "svc-opts-user-store"
+	svcOptionWithOtpSender = "svc-opts-otp-sender"
+	svcOptionWithProxies   = "svc-opts-trusted-proxies"
+	svcOptionWithJwtSecret = "svc-opts-jwt-secret"
+
+	//StoreMemory redis host to keep everything in-process (tests, single instance)
+	StoreMemory = "memory"
 )
 
-var ApiInstance *ApiService
-
 type ApiService struct {
 	Api        *ApiHandler
 	Router     *chi.Mux
 	Address    string
 	RedisHost  string
-	RedisCache *redis.Client
+	Redis      *driver.RedisConfig
+	RedisCache driver.RedisClient
 	Context    context.Context
 	IPHistory  *models.TrackerIPHistory
+	Limiter    models.Limiter
+	Policies   models.PolicyList
+	Default    *models.Policy
+	Quotas     *models.QuotaTracker
+	DbConfig   *driver.DbConnectorConfig
+	Db         *sql.DB
+	//dbs 1 handle per mysql config (quota, history, accounts)
+	dbs        map[driver.DbConnectorConfig]*sql.DB
+	Shaper     *models.Shaper
+	Inflight   *models.InflightLimiter
+	SemStore   string
+	Adaptive   *models.AdaptiveLimiter
+	Classifier *models.PriorityClassifier
+	Shedder    *models.LoadShedder
+	Upstreams  []*models.Upstream
+
+	//TrustedProxies peers whose x-forwarded-for / x-real-ip is the client ip
+	TrustedProxies []*net.IPNet
+
+	GrpcAddress string
+	RlsDomain   string
+
+	Clock   models.Clock
+	History models.HistoryStore
+	//HistoryMysql history on mysql instead of (or with) redis
+	HistoryMysql *models.MysqlHistoryConfig
+
+	//Users accounts of the login and otp end-points, mysql if UserDbConfig is set
+	Users        models.UserStore
+	UserDbConfig *driver.DbConnectorConfig
+	OtpSender    models.OtpSender
+
+	//Lockouts brute-force lockouts, on the shared counters if any
+	Lockouts *models.LockoutTracker
+
+	//Jwt signs and checks the tokens, the user and admin end-points are off on the built-in secret
+	Jwt *utils.AppJwtConfig
+
+	//CounterStore shared counters (hybrid windows, quotas), redis or the redis shards
+	CounterStore models.CounterStore
+	shardClients []driver.RedisClient
+
+	//Keys redis key namespace
+	Keys *models.KeySpace
+
+	//Metrics throttle counters of this service, /debug/vars
+	Metrics *models.Metrics
 }
 
 //WithSvcOptHandler opts for handler
@@ -53,17 +134,169 @@ func WithSvcOptRedisHost(r string) *config.Option {
 	return config.NewOption(svcOptionWithRedisHost, r)
 }
 
+//WithSvcOptRedis opts for the full redis connection, redis host is the addr if not set
+func WithSvcOptRedis(r *driver.RedisConfig) *config.Option {
+	return config.NewOption(svcOptionWithRedis, r)
+}
+
+//WithSvcOptPolicies opts for the throttle policies
+func WithSvcOptPolicies(r models.PolicyList) *config.Option {
+	return config.NewOption(svcOptionWithPolicies, r)
+}
+
+//WithSvcOptQuotas opts for the long-term quotas
+func WithSvcOptQuotas(r models.QuotaList) *config.Option {
+	return config.NewOption(svcOptionWithQuotas, r)
+}
+
+//WithSvcOptQuotaDb opts for keeping the quota counters on mysql instead of redis
+func WithSvcOptQuotaDb(r *driver.DbConnectorConfig) *config.Option {
+	return config.NewOption(svcOptionWithQuotaDb, r)
+}
+
+//WithSvcOptMaxInflight opts for the global cap of in-flight requests
+func WithSvcOptMaxInflight(r int) *config.Option {
+	return config.NewOption(svcOptionWithInflight, r)
+}
+
+//WithSvcOptInflightStore opts for the in-flight slots, local or redis
+func WithSvcOptInflightStore(r string) *config.Option {
+	return config.NewOption(svcOptionWithSemStore, r)
+}
+
+//WithSvcOptAdaptive opts for the latency based global limit
+func WithSvcOptAdaptive(r *models.AdaptiveConfig) *config.Option {
+	return config.NewOption(svcOptionWithAdaptive, r)
+}
+
+//WithSvcOptPriorities opts for the priority class rules
+func WithSvcOptPriorities(r []*models.PriorityRule) *config.Option {
+	return config.NewOption(svcOptionWithPriority, r)
+}
+
+//WithSvcOptApiKeys opts for the api key to tier mapping
+func WithSvcOptApiKeys(r map[string]string) *config.Option {
+	return config.NewOption(svcOptionWithApiKeys, r)
+}
+
+//WithSvcOptShedding opts for the load shedding thresholds
+func WithSvcOptShedding(r *models.ShedConfig) *config.Option {
+	return config.NewOption(svcOptionWithShedding, r)
+}
+
+//WithSvcOptTrustedProxies opts for the proxies (cidrs or ips) allowed to set the client ip
+func WithSvcOptTrustedProxies(r []string) *config.Option {
+	return config.NewOption(svcOptionWithProxies, r)
+}
+
+//WithSvcOptJwtSecret opts for the secret of the tokens
+func WithSvcOptJwtSecret(r string) *config.Option {
+	return config.NewOption(svcOptionWithJwtSecret, r)
+}
+
+//WithSvcOptUpstreams opts for the gateway mode upstreams
+func WithSvcOptUpstreams(r []*models.Upstream) *config.Option {
+	return config.NewOption(svcOptionWithUpstreams, r)
+}
+
+//WithSvcOptGrpcAddress opts for the envoy rate limit grpc port#
+func WithSvcOptGrpcAddress(r string) *config.Option {
+	return config.NewOption(svcOptionWithGrpc, r)
+}
+
+//WithSvcOptRlsDomain opts for the only envoy rate limit domain served
+func WithSvcOptRlsDomain(r string) *config.Option {
+	return config.NewOption(svcOptionWithRlsDomain, r)
+}
+
+//WithSvcOptClock opts for the time source of the windows, quotas and history
+func WithSvcOptClock(r models.Clock) *config.Option {
+	return config.NewOption(svcOptionWithClock, r)
+}
+
+//WithSvcOptTracker opts for the window counters and the history channel
+func WithSvcOptTracker(r *models.TrackerIPHistory) *config.Option {
+	return config.NewOption(svcOptionWithTracker, r)
+}
+
+//WithSvcOptLimiter opts for the limiter used by the middleware and the limits api, the tracker if not set
+func WithSvcOptLimiter(r models.Limiter) *config.Option {
+	return config.NewOption(svcOptionWithLimiter, r)
+}
+
+//WithSvcOptHistoryStore opts for where the history records are kept
+func WithSvcOptHistoryStore(r models.HistoryStore) *config.Option {
+	return config.NewOption(svcOptionWithHistory, r)
+}
+
+//WithSvcOptCounters opts for the size of the in-process window counters
+func WithSvcOptCounters(r *models.CounterConfig) *config.Option {
+	return config.NewOption(svcOptionWithCounters, r)
+}
+
+//WithSvcOptHybrid opts for local counters synced to redis
+func WithSvcOptHybrid(r *models.HybridConfig) *config.Option {
+	return config.NewOption(svcOptionWithHybrid, r)
+}
+
+//WithSvcOptShards opts for the counters spread over several redis nodes
+func WithSvcOptShards(r *models.ShardConfig) *config.Option {
+	return config.NewOption(svcOptionWithShards, r)
+}
+
+//WithSvcOptCounterStore opts for the shared counters, i.e. in-memory stand-ins on tests
+func WithSvcOptCounterStore(r models.CounterStore) *config.Option {
+	return config.NewOption(svcOptionWithCounter, r)
+}
+
+//WithSvcOptKeys opts for the redis key namespace
+func WithSvcOptKeys(r *models.KeyConfig) *config.Option {
+	return config.NewOption(svcOptionWithKeys, r)
+}
+
+//WithSvcOptHistoryMysql opts for the history on mysql
+func WithSvcOptHistoryMysql(r *models.MysqlHistoryConfig) *config.Option {
+	return config.NewOption(svcOptionWithHistoryDb, r)
+}
+
+//WithSvcOptUserDb opts for the accounts on mysql
+func WithSvcOptUserDb(r *driver.DbConnectorConfig) *config.Option {
+	return config.NewOption(svcOptionWithUserDb, r)
+}
+
+//WithSvcOptUserStore opts for the accounts store
+func WithSvcOptUserStore(r models.UserStore) *config.Option {
+	return config.NewOption(svcOptionWithUsers, r)
+}
+
+//WithSvcOptOtpSender opts for the delivery of the one-time codes
+func WithSvcOptOtpSender(r models.OtpSender) *config.Option {
+	return config.NewOption(svcOptionWithOtpSender, r)
+}
+
 //NewApiService service new instance
 func NewApiService(opts ...*config.Option) (*ApiService, error) {
 
 	//default
 	svc := &ApiService{
-		Address: ":8989",
-		Api:     &ApiHandler{},
-		Context: context.Background(),
+		Address:  ":8989",
+		Api:      &ApiHandler{},
+		Context:  context.Background(),
+		Default:  models.NewPolicy("default", "", config.RequestsPerMinute, "minute"),
+		Shaper:   models.NewShaper(),
+		Inflight: models.NewInflightLimiter(nil, 0),
+		Clock:    models.SystemClock{},
+		Keys:     models.DefaultKeys,
+		Metrics:  models.NewMetrics(),
 	}
 
 	//add options if any
+	var rules []*models.PriorityRule
+	var apiKeys map[string]string
+	var counters *models.CounterConfig
+	var hybrid *models.HybridConfig
+	var shards *models.ShardConfig
+	var jwtSecret string
 	for _, o := range opts {
 		//chk opt-name
 		switch o.Name() {
@@ -79,35 +312,369 @@ func NewApiService(opts ...*config.Option) (*ApiService, error) {
 			if s, oks := o.Value().(string); oks && s != "" {
 				svc.RedisHost = s
 			}
+		case svcOptionWithRedis:
+			if s, oks := o.Value().(*driver.RedisConfig); oks && s != nil {
+				svc.Redis = s
+			}
+		case svcOptionWithPolicies:
+			if s, oks := o.Value().(models.PolicyList); oks && s != nil {
+				svc.Policies = s
+			}
+		case svcOptionWithQuotas:
+			if s, oks := o.Value().(models.QuotaList); oks && s != nil {
+				svc.Quotas = models.NewQuotaTracker(s, nil)
+			}
+		case svcOptionWithQuotaDb:
+			if s, oks := o.Value().(*driver.DbConnectorConfig); oks && s != nil {
+				svc.DbConfig = s
+			}
+		case svcOptionWithInflight:
+			if s, oks := o.Value().(int); oks && s > 0 {
+				svc.Inflight.Global = s
+			}
+		case svcOptionWithSemStore:
+			if s, oks := o.Value().(string); oks && s != "" {
+				svc.SemStore = s
+			}
+		case svcOptionWithAdaptive:
+			if s, oks := o.Value().(*models.AdaptiveConfig); oks && s != nil {
+				limiter, err := models.NewAdaptiveLimiter(s)
+				if err != nil {
+					return svc, err
+				}
+				svc.Adaptive = limiter
+			}
+		case svcOptionWithPriority:
+			if s, oks := o.Value().([]*models.PriorityRule); oks {
+				rules = s
+			}
+		case svcOptionWithApiKeys:
+			if s, oks := o.Value().(map[string]string); oks {
+				apiKeys = s
+			}
+		case svcOptionWithShedding:
+			if s, oks := o.Value().(*models.ShedConfig); oks && s != nil {
+				svc.Shedder = models.NewLoadShedder(s.MaxInflight, s.MaxQueue)
+			}
+		case svcOptionWithProxies:
+			if s, oks := o.Value().([]string); oks {
+				nets, err := models.ParseCIDRs(s)
+				if err != nil {
+					return svc, err
+				}
+				svc.TrustedProxies = nets
+			}
+		case svcOptionWithJwtSecret:
+			if s, oks := o.Value().(string); oks {
+				jwtSecret = s
+			}
+		case svcOptionWithUpstreams:
+			if s, oks := o.Value().([]*models.Upstream); oks {
+				for _, u := range s {
+					if err := u.Validate(); err != nil {
+						return svc, err
+					}
+				}
+				svc.Upstreams = s
+			}
+		case svcOptionWithGrpc:
+			if s, oks := o.Value().(string); oks && s != "" {
+				svc.GrpcAddress = s
+			}
+		case svcOptionWithRlsDomain:
+			if s, oks := o.Value().(string); oks && s != "" {
+				svc.RlsDomain = s
+			}
+		case svcOptionWithClock:
+			if s, oks := o.Value().(models.Clock); oks && s != nil {
+				svc.Clock = s
+			}
+		case svcOptionWithTracker:
+			if s, oks := o.Value().(*models.TrackerIPHistory); oks && s != nil {
+				svc.IPHistory = s
+			}
+		case svcOptionWithLimiter:
+			if s, oks := o.Value().(models.Limiter); oks && s != nil {
+				svc.Limiter = s
+			}
+		case svcOptionWithHistory:
+			if s, oks := o.Value().(models.HistoryStore); oks && s != nil {
+				svc.History = s
+			}
+		case svcOptionWithHistoryDb:
+			if s, oks := o.Value().(*models.MysqlHistoryConfig); oks && s != nil {
+				svc.HistoryMysql = s
+			}
+		case svcOptionWithUserDb:
+			if s, oks := o.Value().(*driver.DbConnectorConfig); oks && s != nil {
+				svc.UserDbConfig = s
+			}
+		case svcOptionWithUsers:
+			if s, oks := o.Value().(models.UserStore); oks && s != nil {
+				svc.Users = s
+			}
+		case svcOptionWithOtpSender:
+			if s, oks := o.Value().(models.OtpSender); oks && s != nil {
+				svc.OtpSender = s
+			}
+		case svcOptionWithCounters:
+			if s, oks := o.Value().(*models.CounterConfig); oks {
+				counters = s
+			}
+		case svcOptionWithHybrid:
+			if s, oks := o.Value().(*models.HybridConfig); oks && s != nil {
+				if err := s.Validate(); err != nil {
+					return svc, err
+				}
+				hybrid = s
+			}
+		case svcOptionWithShards:
+			if s, oks := o.Value().(*models.ShardConfig); oks && s != nil {
+				if err := s.Validate(); err != nil {
+					return svc, err
+				}
+				shards = s
+			}
+		case svcOptionWithCounter:
+			if s, oks := o.Value().(models.CounterStore); oks && s != nil {
+				svc.CounterStore = s
+			}
+		case svcOptionWithKeys:
+			if s, oks := o.Value().(*models.KeyConfig); oks && s != nil {
+				keys, err := models.NewKeySpace(s)
+				if err != nil {
+					return svc, err
+				}
+				svc.Keys = keys
+			}
 		}
 	} //iterate all opts
 
-	//set the actual router
-	svc.Router = svc.MapRoute()
+	//the handlers work on this service only
+	svc.Api.svc = svc
+	svc.Jwt = utils.NewAppJwtConfig(jwtSecret)
 
-	//get db
-	client, err := driver.NewRedisConnector(svc.RedisHost)
+	//priority classes
+	classifier, err := models.NewPriorityClassifier(rules, apiKeys)
 	if err != nil {
 		return svc, err
 	}
+	classifier.Jwt = svc.Jwt
+	svc.Classifier = classifier
+
+	//set the actual router
+	svc.Router = svc.MapRoute()
+
+	//get db, nothing to connect if all in-process
+	if svc.Redis == nil {
+		svc.Redis = &driver.RedisConfig{Addr: svc.RedisHost}
+	} else if svc.Redis.Addr == "" && len(svc.Redis.Addrs) == 0 {
+		svc.Redis.Addr = svc.RedisHost
+	}
+	if svc.Redis.Addr != StoreMemory {
+		client, err := driver.NewRedisConnector(svc.Redis)
+		if err != nil {
+			return svc, err
+		}
+
+		//save
+		svc.RedisCache = client
+	}
+
+	//shared counters, spread over the shards if any
+	if svc.CounterStore == nil && shards != nil {
+		store := models.NewShardedCounterStore(shards.VirtualNodes)
+		store.Clock = svc.Clock
+		store.Metrics = svc.Metrics
+		//the failure counters are hybrid windows
+		store.Prefixes = []string{svc.Keys.Hybrid, svc.Keys.Quota, svc.Keys.Lockout}
+		nodes := make(map[string]models.CounterStore)
+		for _, name := range shards.Names() {
+			//no retries here, the nodes that are down are healed by the manager
+			client, err := driver.NewRedisClient(shards.Nodes[name])
+			if err != nil {
+				return svc, err
+			}
+			svc.shardClients = append(svc.shardClients, client)
+			nodes[name] = models.NewRedisCounterStore(client)
+			if shards.Draining(name) {
+				continue
+			}
+			if err := nodes[name].Ping(); err != nil {
+				store.AddDownNode(name, nodes[name], err)
+				continue
+			}
+			store.AddNode(name, nodes[name])
+		}
+		//removed nodes last, their keys go to the final owners
+		for _, name := range shards.Drain {
+			store.DrainNode(name, nodes[name])
+		}
+		isreadyNodes := make(chan bool, 1)
+		go store.ManageNodes(isreadyNodes)
+		<-isreadyNodes
+		svc.CounterStore = store
+	}
+	if svc.CounterStore == nil && svc.RedisCache != nil {
+		svc.CounterStore = models.NewRedisCounterStore(svc.RedisCache)
+	}
+	if svc.CounterStore != nil {
+		svc.Lockouts = models.NewLockoutTracker(svc.CounterStore)
+	} else {
+		store := models.NewMemoryCounterStore()
+		store.Clock = svc.Clock
+		svc.Lockouts = models.NewLockoutTracker(store)
+	}
+	svc.Lockouts.Keys = svc.Keys
+	svc.Lockouts.Clock = svc.Clock
+
+	//quota counters
+	if svc.Quotas != nil {
+		if svc.DbConfig != nil {
+			dbh, err := svc.database(svc.DbConfig)
+			if err != nil {
+				return svc, err
+			}
+			svc.Quotas.Store = models.NewMysqlQuotaStore(dbh)
+		} else if svc.RedisCache != nil {
+			store := models.NewRedisQuotaStore(svc.RedisCache)
+			store.Counters = svc.CounterStore
+			store.Keys = svc.Keys
+			svc.Quotas.Store = store
+		} else {
+			store := models.NewMemoryQuotaStore()
+			store.Clock = svc.Clock
+			svc.Quotas.Store = store
+		}
+		svc.Quotas.Clock = svc.Clock
+		svc.Quotas.Keys = svc.Keys
+	}
+
+	//accounts
+	if svc.Users == nil {
+		if svc.UserDbConfig != nil {
+			dbh, err := svc.database(svc.UserDbConfig)
+			if err != nil {
+				return svc, err
+			}
+			svc.Users = models.NewMysqlUserStore(dbh)
+		} else {
+			store := models.NewMemoryUserStore()
+			store.Clock = svc.Clock
+			svc.Users = store
+		}
+	}
+	if svc.OtpSender == nil {
+		svc.OtpSender = &models.LogOtpSender{}
+	}
+	//strict login and otp policies, unless configured; only with their end-points
+	if svc.authRoutes() {
+		for _, p := range models.AuthPolicies() {
+			if svc.Policies.ByName(p.Name, nil) == nil {
+				svc.Policies = append(models.PolicyList{p}, svc.Policies...)
+			}
+		}
+	}
 
-	//save
-	svc.RedisCache = client
+	//in-flight slots
+	svc.Inflight.Sem = models.NewLocalSemaphore()
+	if svc.SemStore == "redis" && svc.RedisCache != nil {
+		sem := models.NewRedisSemaphore(svc.RedisCache)
+		sem.Keys = svc.Keys
+		svc.Inflight.Sem = sem
+	}
+	isreadyInflight := make(chan bool, 1)
+	go svc.Inflight.ManageRefresh(isreadyInflight)
+	<-isreadyInflight
 
 	//q manager
 	isready := make(chan bool, 1)
-	svc.IPHistory = models.NewTrackerIPHistory()
+	if svc.IPHistory == nil {
+		svc.IPHistory = models.NewTrackerIPHistory()
+		svc.IPHistory.Clock = svc.Clock
+		svc.IPHistory.Counters = models.NewShardedCounters(counters)
+	}
+	if svc.IPHistory.Counters.Metrics == nil {
+		svc.IPHistory.Counters.Metrics = svc.Metrics
+	}
 	go svc.IPHistory.ManageQ(isready)
 	<-isready
+	if svc.Limiter == nil && hybrid != nil && svc.CounterStore == nil {
+		return svc, errors.New("hybrid: needs redis_host or redis_shards")
+	}
+	if svc.Limiter == nil && hybrid != nil {
+		//local counters, batched to redis
+		limiter := models.NewHybridLimiter(svc.IPHistory, svc.CounterStore, hybrid)
+		limiter.Keys = svc.Keys
+		limiter.Metrics = svc.Metrics
+		isreadySync := make(chan bool, 1)
+		go limiter.ManageSync(isreadySync)
+		<-isreadySync
+		svc.Limiter = limiter
+	}
+	if svc.Limiter == nil {
+		svc.Limiter = svc.IPHistory
+	}
 
 	isreadySave := make(chan bool, 1)
-	go svc.IPHistory.ManageHistory(isreadySave, svc.RedisCache)
+	if svc.History == nil && svc.HistoryMysql != nil {
+		cfg := svc.HistoryMysql.Db
+		if cfg == nil {
+			cfg = svc.DbConfig
+		}
+		if cfg == nil {
+			return svc, errors.New("history: mysql config is missing")
+		}
+		dbh, err := svc.database(cfg)
+		if err != nil {
+			return svc, err
+		}
+		svc.History = models.NewMysqlHistoryStore(dbh, svc.HistoryMysql)
+		if svc.HistoryMysql.KeepRedis && svc.RedisCache != nil {
+			store := models.NewRedisHistoryStore(svc.RedisCache)
+			store.Keys = svc.Keys
+			svc.History = models.MultiHistoryStore{svc.History, store}
+		}
+	}
+	if svc.History == nil {
+		svc.History = models.NewMemoryHistoryStore()
+		if svc.RedisCache != nil {
+			store := models.NewRedisHistoryStore(svc.RedisCache)
+			store.Keys = svc.Keys
+			svc.History = store
+		}
+	}
+	go svc.IPHistory.ManageHistory(isreadySave, svc.History)
 	<-isreadySave
 
 	//good :-)
 	return svc, nil
 }
 
+//database connect once per mysql config and apply the pending migrations,
+//the quotas, history and accounts share the handle of the same config only
+func (svc *ApiService) database(cfg *driver.DbConnectorConfig) (*sql.DB, error) {
+	if dbh, oks := svc.dbs[*cfg]; oks {
+		return dbh, nil
+	}
+	dbh, err := driver.NewDbConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = driver.Migrate(dbh, models.Migrations); err != nil {
+		dbh.Close()
+		return nil, err
+	}
+	if svc.dbs == nil {
+		svc.dbs = make(map[driver.DbConnectorConfig]*sql.DB)
+	}
+	svc.dbs[*cfg] = dbh
+	if svc.Db == nil {
+		svc.Db = dbh
+	}
+	return dbh, nil
+}
+
 //Run run the http server based on settings
 func (svc *ApiService) Run() {
 
@@ -130,18 +697,65 @@ func (svc *ApiService) Run() {
 
 	}()
 
+	//envoy rate limit service
+	var grpcSrv *grpc.Server
+	if svc.GrpcAddress != "" {
+		grpcSrv = svc.NewGrpcServer()
+		go func() {
+			log.Println("Grpc listening on port", svc.GrpcAddress)
+			if err := svc.listenGrpc(grpcSrv); err != nil {
+				log.Printf("grpc listen: %s\n", err)
+				os.Exit(0)
+			}
+		}()
+	}
+
 	//watcher
-	stopChan := make(chan os.Signal)
+	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, os.Interrupt)
 
 	<-stopChan
 	log.Println("Shutting down service...")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	srv.Shutdown(ctx)
+	if grpcSrv != nil {
+		grpcSrv.GracefulStop()
+	}
+	svc.Close()
 	defer cancel()
 	log.Println("Server gracefully stopped!")
 }
 
+//Close stop the background managers and drop the connections
+func (svc *ApiService) Close() {
+	svc.Inflight.Close()
+	if svc.IPHistory != nil {
+		svc.IPHistory.Close()
+		//last batch of the history, before the db is closed
+		if _, oks := svc.History.(models.BatchHistoryStore); oks {
+			svc.IPHistory.WaitHistory(5 * time.Second)
+		}
+	}
+	//last push of the local deltas
+	if l, oks := svc.Limiter.(*models.HybridLimiter); oks {
+		if err := l.Sync(); err != nil {
+			log.Println("HYBRID_SYNC", err)
+		}
+	}
+	if s, oks := svc.CounterStore.(*models.ShardedCounterStore); oks {
+		s.Close()
+	}
+	for _, client := range svc.shardClients {
+		client.Close()
+	}
+	if svc.RedisCache != nil {
+		svc.RedisCache.Close()
+	}
+	for _, dbh := range svc.dbs {
+		dbh.Close()
+	}
+}
+
 //MapRoute route map all endpoints
 func (svc *ApiService) MapRoute() *chi.Mux {
 
@@ -156,12 +770,19 @@ func (svc *ApiService) MapRoute() *chi.Mux {
 		middleware.StripSlashes,
 		middleware.Recoverer,
 		middleware.RequestID,
-		middleware.RealIP,
+		svc.RealIP,
 	)
 
 	// Basic gracious timing
 	router.Use(middleware.Timeout(60 * time.Second))
 
+	// Priority classes, shedding and latency based global limit
+	router.Use(
+		svc.Classify,
+		svc.ShedLoad,
+		svc.AdaptiveLimit,
+	)
+
 	// Basic CORS
 	cors := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
@@ -172,7 +793,21 @@ func (svc *ApiService) MapRoute() *chi.Mux {
 
 	router.Use(cors.Handler)
 
-	router.Get("/", svc.Api.IndexPage)
+	//anyone can sign a token with the built-in secret
+	if !svc.authRoutes() {
+		log.Println("JWT: jwt_secret is not set, the user and admin end-points are off")
+	}
+
+	router.With(svc.Api.ThrottleIP).Get("/", svc.Api.IndexPage)
+	if svc.authRoutes() {
+		router.Group(func(r chi.Router) {
+			r.Use(jwtauth.Verifier(svc.Jwt.TokenAuth))
+			r.Use(svc.BearerChecker)
+			r.Use(svc.AdminChecker)
+			r.Get("/debug/vars", svc.Api.MetricsInfo)
+		})
+	}
+	router.HandleFunc("/check", svc.Api.CheckRequest)
 
 	/*
 		@end-points
@@ -182,6 +817,31 @@ func (svc *ApiService) MapRoute() *chi.Mux {
 		PUT 	/v1/api/request/{dummy}
 		DELETE  /v1/api/request/{dummy}
 
+		GET     /v1/api/quota
+
+		POST    /v1/api/user
+		PUT     /v1/api/user
+		GET     /v1/api/user/{id}
+		DELETE  /v1/api/user/{id}
+		POST    /v1/api/otp
+		POST    /v1/api/login
+
+		POST    /v1/api/limits/check
+		POST    /v1/api/limits/reserve
+		POST    /v1/api/limits/peek
+		POST    /v1/api/limits/refund
+
+		GET     /v1/api/admin/policies
+		GET     /v1/api/admin/history?from=&to=&top=
+		GET     /v1/api/admin/lockouts
+		DELETE  /v1/api/admin/lockouts?policy=&ip=&username=
+
+		GET     /debug/vars
+
+		*       /check   (nginx auth_request / traefik forwardauth)
+
+		*       {upstream.prefix}/*   (gateway mode)
+
 
 
 
@@ -192,17 +852,82 @@ func (svc *ApiService) MapRoute() *chi.Mux {
 		r.Mount("/api/request",
 			func(api *ApiHandler) *chi.Mux {
 				sr := chi.NewRouter()
+				sr.Use(api.ThrottleIP)
 				sr.Post("/{dummy}", api.DummyReqPost)
 				sr.Put("/{dummy}", api.DummyReqPut)
 				sr.Get("/{dummy}", api.DummyReqGet)
 				sr.Delete("/{dummy}", api.DummyReqDelete)
 				return sr
 			}(svc.Api))
+		r.Get("/api/quota", svc.Api.QuotaInfo)
+		if !svc.authRoutes() {
+			return
+		}
+		r.Mount("/api/user",
+			func(api *ApiHandler) *chi.Mux {
+				sr := chi.NewRouter()
+				sr.With(api.ThrottleIP).Post("/", api.UserCreate)
+				sr.Group(func(gr chi.Router) {
+					gr.Use(jwtauth.Verifier(svc.Jwt.TokenAuth))
+					gr.Use(svc.BearerChecker)
+					gr.Put("/", api.UserUpdate)
+					gr.Get("/{id}", api.UserGet)
+					gr.Delete("/{id}", api.UserDelete)
+				})
+				return sr
+			}(svc.Api))
+		r.With(svc.Api.ThrottleIP).Post("/api/otp", svc.Api.OtpSend)
+		r.With(svc.Api.ThrottleIP).Post("/api/login", svc.Api.Login)
+		r.Mount("/api/limits",
+			func(api *ApiHandler) *chi.Mux {
+				sr := chi.NewRouter()
+				sr.Use(jwtauth.Verifier(svc.Jwt.TokenAuth))
+				sr.Use(svc.BearerChecker)
+				sr.Use(svc.AdminChecker)
+				sr.Post("/check", api.LimitsCheck)
+				sr.Post("/reserve", api.LimitsReserve)
+				sr.Post("/peek", api.LimitsPeek)
+				sr.Post("/refund", api.LimitsRefund)
+				return sr
+			}(svc.Api))
+		r.Mount("/api/admin",
+			func(api *ApiHandler) *chi.Mux {
+				sr := chi.NewRouter()
+				sr.Use(jwtauth.Verifier(svc.Jwt.TokenAuth))
+				sr.Use(svc.BearerChecker)
+				sr.Use(svc.AdminChecker)
+				sr.Get("/policies", api.PolicyInfo)
+				sr.Get("/history", api.HistoryInfo)
+				sr.Get("/lockouts", api.LockoutInfo)
+				sr.Delete("/lockouts", api.LockoutUnlock)
+				return sr
+			}(svc.Api))
 	})
 
+	//gateway mode, policies are applied before forwarding
+	for _, u := range svc.Upstreams {
+		proxy, err := NewUpstreamProxy(u)
+		if err != nil {
+			log.Println("UPSTREAM", u.Prefix, err)
+			continue
+		}
+		router.Mount(u.Prefix, svc.Api.ThrottleIP(proxy))
+	}
+
 	return router
 }
 
+//RealIP the client ip sent by a trusted proxy is the remote addr, the forwarded headers
+//of the other peers are ignored
+func (svc *ApiService) RealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := models.ForwardedIP(r, svc.TrustedProxies); ip != "" {
+			r.RemoteAddr = ip
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 //SetContextKeyVal version context
 func (svc *ApiService) SetContextKeyVal(k, v string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -246,3 +971,21 @@ func (svc *ApiService) BearerChecker(next http.Handler) http.Handler {
 	})
 
 }
+
+//authRoutes the user and admin end-points are on, only with a configured jwt secret
+func (svc *ApiService) authRoutes() bool {
+	return !svc.Jwt.IsDefault()
+}
+
+//AdminChecker only the tokens with the admin role, after the BearerChecker
+func (svc *ApiService) AdminChecker(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := jwtauth.FromContext(r.Context())
+		if role, _ := claims["role"].(string); role != models.RoleAdmin {
+			render.Status(r, http.StatusForbidden)
+			svc.Api.ReplyErrContent(w, r, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+)
+
+//TestTwoServices 2 differently configured throttlers in 1 process
+func TestTwoServices(t *testing.T) {
+
+	newService := func(limit int) *ApiService {
+		svc, err := NewApiService(
+			WithSvcOptRedisHost(StoreMemory),
+			WithSvcOptPolicies(models.PolicyList{models.NewPolicy("twin", "/v1/api/request", limit, "minute")}),
+			WithSvcOptClock(models.NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return svc
+	}
+	strict, loose := newService(1), newService(3)
+	defer strict.Close()
+	defer loose.Close()
+
+	tsStrict := httptest.NewServer(strict.Router)
+	defer tsStrict.Close()
+	tsLoose := httptest.NewServer(loose.Router)
+	defer tsLoose.Close()
+
+	mockLists := []struct {
+		Server *httptest.Server
+		Code   int
+	}{
+		{tsStrict, http.StatusOK},
+		{tsLoose, http.StatusOK},
+		{tsStrict, http.StatusConflict},
+		{tsLoose, http.StatusOK},
+		{tsLoose, http.StatusOK},
+		{tsLoose, http.StatusConflict},
+		{tsStrict, http.StatusConflict},
+	}
+
+	for i, rec := range mockLists {
+		ret, body := testRequest(t, rec.Server, "GET", "/v1/api/request/twin", nil, "")
+		var reply APIResponse
+		if err := json.Unmarshal([]byte(body), &reply); err != nil {
+			t.Fatalf("%d Response failed", i+1)
+		}
+		if reply.Code != rec.Code {
+			t.Fatalf("%d Throttle failed: %d %s", i+1, reply.Code, body)
+		}
+		t.Log(i+1, "OKAY", reply.Code, ret.Header.Get("RateLimit-Limit"))
+	}
+
+	t.Log("OK")
+}
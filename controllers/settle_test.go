@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/go-chi/chi"
+)
+
+//TestCostSettle upfront cost, settled on the response size and refunded on handler failure
+func TestCostSettle(t *testing.T) {
+
+	//10 tokens per minute, the handler fails or writes what is asked
+	saved := tService.Policies
+	defer func() { tService.Policies = saved }()
+	policy := models.NewPolicy("cost-test", "/cost", 10, "minute")
+	policy.Cost = &models.Cost{Header: "X-Request-Cost", ResponseBytes: 100}
+	tService.Policies = models.PolicyList{policy}
+
+	router := chi.NewRouter()
+	router.Mount("/cost", tService.Api.ThrottleIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(strings.Repeat("x", len(r.URL.Query().Get("size"))*100)))
+	})))
+
+	mockLists := []struct {
+		URL       string
+		Cost      string
+		Remaining int
+	}{
+		//charged 3, settled on 2 x 100 bytes
+		{"/cost?size=22", "3", 8},
+		//refunded
+		{"/cost?fail=1", "5", 8},
+		//free upfront, settled on 4 x 100 bytes
+		{"/cost?size=4444", "0", 4},
+		{"/cost?size=", "0", 4},
+	}
+	for i, rec := range mockLists {
+		r := httptest.NewRequest("GET", rec.URL, nil)
+		r.RemoteAddr = "10.28.0.1:5000"
+		r.Header.Set("X-Request-Cost", rec.Cost)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		dec := tService.Limiter.Peek("10.28.0.1", policy)
+		if dec.Remaining != rec.Remaining {
+			t.Fatalf("%d Cost failed: %d %+v", i+1, w.Code, dec)
+		}
+		t.Log(i+1, "OKAY", w.Code, dec.Remaining)
+	}
+
+	t.Log("OK")
+}
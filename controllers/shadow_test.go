@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+)
+
+//TestShadowPolicy shadow policies record what they would deny and let the request through
+func TestShadowPolicy(t *testing.T) {
+
+	shadow := models.NewPolicy("shadow-test", "/v1/api/request", 2, "minute")
+	shadow.Mode = models.PolicyModeShadow
+	store := models.NewMemoryHistoryStore()
+	newService := func() *ApiService {
+		svc, err := NewApiService(
+			WithSvcOptRedisHost(StoreMemory),
+			WithSvcOptPolicies(models.PolicyList{shadow}),
+			WithSvcOptHistoryStore(store),
+			WithSvcOptClock(models.NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return svc
+	}
+	svc := newService()
+	defer svc.Close()
+
+	ts := httptest.NewServer(svc.Router)
+	defer ts.Close()
+	for i := 0; i < 4; i++ {
+		_, body := testRequest(t, ts, "GET", "/v1/api/request/shadow-test", nil, "")
+		var reply APIResponse
+		if err := json.Unmarshal([]byte(body), &reply); err != nil || reply.Code != 200 {
+			t.Fatalf("%d Shadow failed: %s", i+1, body)
+		}
+		t.Log(i+1, "OKAY", reply.Code)
+	}
+	//queued records are saved on close
+	svc.IPHistory.Close()
+	if !svc.IPHistory.WaitHistory(time.Second) {
+		t.Fatal("History failed: not saved")
+	}
+	would := store.Records(models.DefaultKeys.IPShadow)
+	if len(would) != 2 || len(store.Records(models.DefaultKeys.IPAllowed)) != 4 || len(store.Records(models.DefaultKeys.IPDenied)) != 0 {
+		t.Fatalf("History failed: %d would deny", len(would))
+	}
+	for _, rec := range would {
+		if rec.Status != models.StatusWouldDeny || rec.Policy != "shadow-test" {
+			t.Fatalf("History failed: %+v", rec)
+		}
+	}
+
+	//counted on this service only
+	other := newService()
+	defer other.Close()
+	mockLists := []struct {
+		Svc       *ApiService
+		Policy    string
+		Mode      string
+		Allowed   int64
+		Denied    int64
+		WouldDeny int64
+	}{
+		{svc, "shadow-test", models.PolicyModeShadow, 2, 0, 2},
+		{svc, "default", "enforce", 4, 0, 0},
+		{other, "shadow-test", models.PolicyModeShadow, 0, 0, 0},
+		{other, "default", "enforce", 0, 0, 0},
+	}
+	for i, rec := range mockLists {
+		w := httptest.NewRecorder()
+		rec.Svc.Api.PolicyInfo(w, httptest.NewRequest("GET", "/v1/api/admin/policies", nil))
+		var reply PolicyResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("%d Response failed", i+1)
+		}
+		var got *models.PolicyReport
+		for _, p := range reply.Policies {
+			if p.Name == rec.Policy {
+				got = p
+			}
+		}
+		if got == nil || got.Mode != rec.Mode || got.Allowed != rec.Allowed || got.Denied != rec.Denied || got.WouldDeny != rec.WouldDeny {
+			t.Fatalf("%d Report failed: %s", i+1, w.Body.String())
+		}
+		t.Log(i+1, "OKAY", got.Name, got.Allowed, got.WouldDeny)
+	}
+	t.Log("OK")
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/go-chi/chi"
+)
+
+//TestShape held requests drain 1 per window/limit, capped by the max wait and the queue
+func TestShape(t *testing.T) {
+
+	//2 per minute, 1 slot every 30s
+	clock := models.NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))
+	policy := models.NewPolicy("shape-test", "/shape", 2, "minute")
+	policy.Mode, policy.MaxWait, policy.MaxQueue = models.PolicyModeShape, "75s", 2
+	svc, err := NewApiService(
+		WithSvcOptRedisHost(StoreMemory),
+		WithSvcOptPolicies(models.PolicyList{policy}),
+		WithSvcOptClock(clock),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	router := chi.NewRouter()
+	router.Mount("/shape", svc.Api.ThrottleIP(http.HandlerFunc(svc.Api.IndexPage)))
+
+	serve := func(ctx context.Context) chan int {
+		done := make(chan int, 1)
+		go func() {
+			r := httptest.NewRequest("GET", "/shape", nil).WithContext(ctx)
+			r.RemoteAddr = "10.29.0.1:5000"
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			done <- w.Code
+		}()
+		return done
+	}
+	//all the held requests are on the clock
+	base := clock.Pending()
+	holding := func(n int) {
+		for i := 0; i < 200 && (svc.Shaper.Waiting("10.29.0.1::shape-test") != n || clock.Pending() != base+n); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := svc.Shaper.Waiting("10.29.0.1::shape-test"); got != n {
+			t.Fatalf("Waiting failed: %d", got)
+		}
+	}
+	code := func(i int, done chan int, want int) {
+		select {
+		case got := <-done:
+			if got != want {
+				t.Fatalf("%d Shape failed: %d", i, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d Shape failed: still held", i)
+		}
+		t.Log(i, "OKAY", want)
+	}
+	held := func(i int, done chan int) {
+		select {
+		case got := <-done:
+			t.Fatalf("%d Shape failed: not held %d", i, got)
+		case <-time.After(50 * time.Millisecond):
+		}
+		t.Log(i, "OKAY", "held")
+	}
+
+	code(1, serve(context.Background()), http.StatusOK)
+	code(2, serve(context.Background()), http.StatusOK)
+
+	//30s to the reset, then 30s apart
+	clock.Advance(30 * time.Second)
+	first := serve(context.Background())
+	holding(1)
+	second := serve(context.Background())
+	holding(2)
+	//queue is full
+	code(3, serve(context.Background()), http.StatusTooManyRequests)
+
+	//not all at the reset
+	clock.Advance(30 * time.Second)
+	code(4, first, http.StatusOK)
+	held(5, second)
+	clock.Advance(30 * time.Second)
+	code(6, second, http.StatusOK)
+	holding(0)
+
+	//used up till the next minute, over the max wait
+	policy.MaxWait = "20s"
+	code(7, serve(context.Background()), http.StatusTooManyRequests)
+	policy.MaxWait = "75s"
+
+	//client is gone
+	ctx, cancel := context.WithCancel(context.Background())
+	gone := serve(ctx)
+	holding(1)
+	cancel()
+	code(8, gone, http.StatusTooManyRequests)
+	//its timer is left on the clock
+	base++
+	holding(0)
+
+	//nothing was taken by the gone one
+	clock.Advance(30 * time.Second)
+	if dec := svc.Limiter.Peek("10.29.0.1", policy); dec.Remaining != 2 {
+		t.Fatalf("Shape failed: %+v", dec)
+	}
+
+	t.Log("OK")
+}
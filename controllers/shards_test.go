@@ -0,0 +1,317 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+)
+
+//flakyStore in-memory redis stand-in that can be taken down
+type flakyStore struct {
+	*models.MemoryCounterStore
+	down bool
+}
+
+var errFlaky = errors.New("flaky: connection refused")
+
+func (s *flakyStore) Add(all []*models.CounterDelta) error {
+	if s.down {
+		return errFlaky
+	}
+	return s.MemoryCounterStore.Add(all)
+}
+
+func (s *flakyStore) Get(key string) (int64, error) {
+	if s.down {
+		return 0, errFlaky
+	}
+	return s.MemoryCounterStore.Get(key)
+}
+
+func (s *flakyStore) Ping() error {
+	if s.down {
+		return errFlaky
+	}
+	return nil
+}
+
+func newShards(clock models.Clock, names ...string) (*models.ShardedCounterStore, map[string]*flakyStore) {
+	store := models.NewShardedCounterStore(0)
+	store.Clock = clock
+	nodes := make(map[string]*flakyStore)
+	for _, name := range names {
+		nodes[name] = &flakyStore{MemoryCounterStore: models.NewMemoryCounterStore()}
+		nodes[name].Clock = clock
+		store.AddNode(name, nodes[name])
+	}
+	return store, nodes
+}
+
+func shardKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s::10.0.%d.%d", models.DefaultKeys.Hybrid, i/256, i%256)
+	}
+	return keys
+}
+
+//checkShards every key has its total on its owner only
+func checkShards(t *testing.T, store *models.ShardedCounterStore, nodes map[string]*flakyStore, keys []string, want int64) {
+	for _, key := range keys {
+		owner := store.Owner(key)
+		for name, node := range nodes {
+			n, _ := node.MemoryCounterStore.Get(key)
+			if name == owner && n != want {
+				t.Fatalf("%s: %d on owner %s, want %d", key, n, name, want)
+			}
+			if name != owner && n != 0 {
+				t.Fatalf("%s: %d left on %s, owner is %s", key, n, name, owner)
+			}
+		}
+	}
+}
+
+//TestShardRebalance keys spread by consistent hashing, only the share of the added/removed node moves
+func TestShardRebalance(t *testing.T) {
+
+	store, nodes := newShards(models.SystemClock{}, "a", "b", "c")
+	keys := shardKeys(3000)
+	expires := time.Now().Add(time.Hour)
+	for _, key := range keys {
+		if err := store.Add([]*models.CounterDelta{{Key: key, N: 5, Expires: expires}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkShards(t, store, nodes, keys, 5)
+
+	//lockouts move with the counters
+	lockouts := models.NewLockoutTracker(store)
+	var locks []string
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("fail::ip::10.9.0.%d", i)
+		if err := lockouts.Lock("login", key, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		locks = append(locks, models.DefaultKeys.Join(models.DefaultKeys.Lockout, "login", key))
+	}
+	checkLocks := func(step string) {
+		checkShards(t, store, nodes, locks, 1)
+		all, err := lockouts.List()
+		if err != nil || len(all) != len(locks) {
+			t.Fatalf("%s Lockout failed: %d locked %v", step, len(all), err)
+		}
+		t.Log("OKAY", step, "locked", len(all))
+	}
+
+	//fair share with the virtual nodes
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for _, key := range keys {
+		owners[key] = store.Owner(key)
+		counts[owners[key]]++
+	}
+	for name, n := range counts {
+		if n < 600 || n > 1400 {
+			t.Fatalf("Share failed: %s has %d of %d", name, n, len(keys))
+		}
+		t.Log("OKAY", name, n)
+	}
+
+	//added node only takes keys
+	nodes["d"] = &flakyStore{MemoryCounterStore: models.NewMemoryCounterStore()}
+	store.AddNode("d", nodes["d"])
+	moved := 0
+	for _, key := range keys {
+		if owner := store.Owner(key); owner != owners[key] {
+			if owner != "d" {
+				t.Fatalf("%s moved from %s to %s", key, owners[key], owner)
+			}
+			moved++
+		}
+	}
+	if moved < 400 || moved > 1200 {
+		t.Fatalf("Rebalance failed: %d of %d moved", moved, len(keys))
+	}
+	checkShards(t, store, nodes, keys, 5)
+	checkLocks("added d")
+	t.Log("OKAY", "added d", moved)
+
+	//removed node gives its keys away
+	store.RemoveNode("b")
+	checkShards(t, store, nodes, keys, 5)
+	checkLocks("removed b")
+	if left, _ := nodes["b"].Keys(models.DefaultKeys.Hybrid); len(left) != 0 {
+		t.Fatalf("Remove failed: %d keys left on b", len(left))
+	}
+	t.Log("OKAY", "removed b", store.Nodes())
+
+	t.Log("OK")
+}
+
+//TestShardFailover a down node is skipped, pinged on the retry interval and rebalanced once back
+func TestShardFailover(t *testing.T) {
+
+	store, nodes := newShards(models.SystemClock{}, "a", "b", "c")
+	keys := shardKeys(300)
+	expires := time.Now().Add(time.Hour)
+	add := func() {
+		for _, key := range keys {
+			if err := store.Add([]*models.CounterDelta{{Key: key, N: 1, Expires: expires}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	add()
+
+	//b fails, its keys count on the next node
+	nodes["b"].down = true
+	add()
+	if nodes := store.Nodes(); len(nodes) != 2 {
+		t.Fatalf("Failover failed: %v", nodes)
+	}
+	for _, key := range keys {
+		n, err := store.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if store.Owner(key) == "b" || n < 1 {
+			t.Fatalf("Failover failed: %s %d on %s", key, n, store.Owner(key))
+		}
+	}
+	t.Log("OKAY", "b down", store.Nodes())
+
+	//still down, stays off
+	store.Heal()
+	if len(store.Nodes()) != 2 {
+		t.Fatal("Heal failed: b is back while down")
+	}
+
+	//b is back, the counts of the outage are moved back to it
+	nodes["b"].down = false
+	store.Heal()
+	if len(store.Nodes()) != 3 {
+		t.Fatal("Heal failed: b is not back")
+	}
+	checkShards(t, store, nodes, keys, 2)
+	t.Log("OKAY", "b up", store.Nodes())
+
+	//given up after the connector retries
+	nodes["c"].down = true
+	for _, key := range keys {
+		store.Get(key)
+	}
+	for _, key := range keys {
+		if store.Owner(key) == "c" {
+			t.Fatal("Failover failed: c still owns keys")
+		}
+	}
+	for i := 0; i < 100; i++ {
+		store.Heal()
+	}
+	nodes["c"].down = false
+	store.Heal()
+	if nodes := store.Nodes(); len(nodes) != 2 {
+		t.Fatalf("Give up failed: %v", nodes)
+	}
+	t.Log("OKAY", "c given up", store.Nodes())
+
+	//down on start, healed like the rest
+	nodes["e"] = &flakyStore{MemoryCounterStore: models.NewMemoryCounterStore(), down: true}
+	store.AddDownNode("e", nodes["e"], errFlaky)
+	add()
+	if nodes := store.Nodes(); len(nodes) != 2 {
+		t.Fatalf("Start failed: %v", nodes)
+	}
+	store.Heal()
+	if len(store.Nodes()) != 2 {
+		t.Fatal("Heal failed: e is up while down")
+	}
+	nodes["e"].down = false
+	store.Heal()
+	if nodes := store.Nodes(); len(nodes) != 3 {
+		t.Fatalf("Heal failed: e is not up %v", nodes)
+	}
+	for _, key := range keys {
+		if _, err := store.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Log("OKAY", "e up", store.Nodes())
+
+	t.Log("OK")
+}
+
+//TestShardedHybrid 2 instances with local counters share 1 limit over the shards
+func TestShardedHybrid(t *testing.T) {
+
+	//nothing to sync with
+	if _, err := NewApiService(WithSvcOptRedisHost(StoreMemory), WithSvcOptHybrid(&models.HybridConfig{})); err == nil {
+		t.Fatal("Hybrid failed: no counter store is accepted")
+	}
+
+	clock := models.NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))
+	shards, _ := newShards(clock, "a", "b", "c")
+	//always settle with the shards, exact
+	share := 0.0
+	policy := models.NewPolicy("shared", "/v1/api/request", 10, "minute")
+	newService := func() *ApiService {
+		svc, err := NewApiService(
+			WithSvcOptRedisHost(StoreMemory),
+			WithSvcOptClock(clock),
+			WithSvcOptCounterStore(shards),
+			WithSvcOptHybrid(&models.HybridConfig{LocalShare: &share}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return svc
+	}
+	one, two := newService(), newService()
+	defer one.Close()
+	defer two.Close()
+	if _, oks := one.Limiter.(*models.HybridLimiter); !oks {
+		t.Fatal("Hybrid failed: not on the counter store")
+	}
+
+	mockLists := []struct {
+		Svc     *ApiService
+		Allowed bool
+	}{
+		{one, true}, {one, true}, {one, true}, {one, true},
+		{two, true}, {two, true}, {two, true}, {two, true},
+		{one, true}, {two, true},
+		{one, false}, {two, false}, {one, false},
+	}
+
+	for i, rec := range mockLists {
+		dec := rec.Svc.Limiter.Allow("10.0.0.1", policy, 1)
+		if dec.Allowed != rec.Allowed {
+			t.Fatalf("%d Hybrid failed: allowed %v remaining %d", i+1, dec.Allowed, dec.Remaining)
+		}
+		//sync interval is up
+		if err := rec.Svc.Limiter.(*models.HybridLimiter).Sync(); err != nil {
+			t.Fatal(err)
+		}
+		t.Log(i+1, "OKAY", dec.Allowed, dec.Remaining)
+	}
+
+	//denied ones are not counted
+	all, err := shards.Keys(models.DefaultKeys.Hybrid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, key := range all {
+		n, _ := shards.Get(key)
+		total += n
+	}
+	if total != 10 {
+		t.Fatalf("Hybrid failed: %d counted on the shards %v", total, all)
+	}
+	t.Log("OKAY", "total", total, all)
+
+	t.Log("OK")
+}
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/go-chi/chi"
+)
+
+//TestInflightSlots 1 in-flight request per ip, freed once the handler returns or the client is gone
+func TestInflightSlots(t *testing.T) {
+
+	policy := models.NewPolicy("slots-test", "/slots", 100, "minute")
+	policy.Concurrency = 1
+	svc, err := NewApiService(
+		WithSvcOptRedisHost(StoreMemory),
+		WithSvcOptPolicies(models.PolicyList{policy}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	//holds till told
+	hold := make(chan struct{})
+	router := chi.NewRouter()
+	router.Mount("/slots", svc.Api.ThrottleIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("hold") != "" {
+			<-hold
+		}
+		svc.Api.IndexPage(w, r)
+	})))
+	serve := func(ctx context.Context, url string) chan int {
+		done := make(chan int, 1)
+		go func() {
+			r := httptest.NewRequest("GET", url, nil).WithContext(ctx)
+			r.RemoteAddr = "10.30.0.1:5000"
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			done <- w.Code
+		}()
+		return done
+	}
+	sem := svc.Inflight.Sem
+	inflight := func(want bool) {
+		for i := 0; i < 200; i++ {
+			token, oks, _ := sem.Acquire("10.30.0.1::slots-test", 1)
+			if oks {
+				sem.Release("10.30.0.1::slots-test", token)
+			}
+			if oks != want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Inflight failed: %v", want)
+	}
+	code := func(i int, done chan int, want int) {
+		if got := <-done; got != want {
+			t.Fatalf("%d Inflight failed: %d", i, got)
+		}
+		t.Log(i, "OKAY", want)
+	}
+
+	//handler is done
+	code(1, serve(context.Background(), "/slots"), http.StatusOK)
+	code(2, serve(context.Background(), "/slots"), http.StatusOK)
+
+	//1 is held
+	held := serve(context.Background(), "/slots?hold=1")
+	inflight(true)
+	code(3, serve(context.Background(), "/slots"), http.StatusTooManyRequests)
+	hold <- struct{}{}
+	code(4, held, http.StatusOK)
+	code(5, serve(context.Background(), "/slots"), http.StatusOK)
+
+	//client is gone, the handler is still running
+	ctx, cancel := context.WithCancel(context.Background())
+	gone := serve(ctx, "/slots?hold=1")
+	inflight(true)
+	cancel()
+	inflight(false)
+	code(6, serve(context.Background(), "/slots"), http.StatusOK)
+	hold <- struct{}{}
+	code(7, gone, http.StatusOK)
+
+	t.Log("OK")
+}
@@ -0,0 +1,286 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/jwtauth"
+	"github.com/go-chi/render"
+)
+
+const (
+	//LoginTokenTTL life of the login token
+	LoginTokenTTL = 24 * time.Hour
+)
+
+//UserRequest body of the user end-points, id on update only
+type UserRequest struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email"`
+	Phone    string `json:"phone"`
+}
+
+//UserResponse the account, otp url on create only
+type UserResponse struct {
+	Code   int
+	Status string
+	User   *models.User
+	OtpURL string `json:",omitempty"`
+}
+
+//OtpRequest body of the otp end-point
+type OtpRequest struct {
+	Username string `json:"username"`
+}
+
+//LoginRequest body of the login end-point, otp is the sent code or the authenticator app code
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Otp      string `json:"otp"`
+}
+
+//LoginResponse bearer token of the user
+type LoginResponse struct {
+	Code    int
+	Status  string
+	Token   string
+	Expires string
+}
+
+//UserCreate new account, the otp secret is given once as an otpauth url
+func (api *ApiHandler) UserCreate(w http.ResponseWriter, r *http.Request) {
+	var req UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		api.ReplyErrContent(w, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	//never admin, that is only granted on the users table
+	u := &models.User{Username: req.Username, Email: req.Email, Phone: req.Phone, Role: models.RoleUser}
+	err := models.ValidateUsername(req.Username)
+	if err == nil {
+		err = u.SetPassword(req.Password)
+	}
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		api.ReplyErrContent(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if u.OtpSecret, err = models.NewOtpSecret(); err != nil {
+		api.replyUserErr(w, r, err)
+		return
+	}
+	if err = api.svc.Users.Create(u); err != nil {
+		api.replyUserErr(w, r, err)
+		return
+	}
+	//good
+	render.JSON(w, r, UserResponse{
+		Code:   200,
+		Status: "UserCreate::Welcome",
+		User:   u,
+		OtpURL: models.OtpURL(u.Username, u.OtpSecret),
+	})
+}
+
+//UserUpdate email, phone and password (if given) of the token user
+func (api *ApiHandler) UserUpdate(w http.ResponseWriter, r *http.Request) {
+	var req UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID <= 0 {
+		render.Status(r, http.StatusBadRequest)
+		api.ReplyErrContent(w, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	if !api.ownsUser(w, r, req.ID) {
+		return
+	}
+	u, err := api.svc.Users.Get(req.ID)
+	if err != nil {
+		api.replyUserErr(w, r, err)
+		return
+	}
+	u.Email, u.Phone = req.Email, req.Phone
+	if req.Password != "" {
+		if err = u.SetPassword(req.Password); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			api.ReplyErrContent(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err = api.svc.Users.Update(u); err != nil {
+		api.replyUserErr(w, r, err)
+		return
+	}
+	if u, err = api.svc.Users.Get(req.ID); err != nil {
+		api.replyUserErr(w, r, err)
+		return
+	}
+	//good
+	render.JSON(w, r, UserResponse{
+		Code:   200,
+		Status: "UserUpdate::Welcome",
+		User:   u,
+	})
+}
+
+//UserGet account of the token user
+func (api *ApiHandler) UserGet(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if !api.ownsUser(w, r, id) {
+		return
+	}
+	u, err := api.svc.Users.Get(id)
+	if err != nil {
+		api.replyUserErr(w, r, err)
+		return
+	}
+	//good
+	render.JSON(w, r, UserResponse{
+		Code:   200,
+		Status: "UserGet::Welcome",
+		User:   u,
+	})
+}
+
+//UserDelete remove the token user
+func (api *ApiHandler) UserDelete(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if !api.ownsUser(w, r, id) {
+		return
+	}
+	if err := api.svc.Users.Delete(id); err != nil {
+		api.replyUserErr(w, r, err)
+		return
+	}
+	//good
+	render.JSON(w, r, APIResponse{
+		Code:   200,
+		Status: "UserDelete::Welcome",
+	})
+}
+
+//OtpSend send the current code of the user, same reply if the user is missing
+func (api *ApiHandler) OtpSend(w http.ResponseWriter, r *http.Request) {
+	var req OtpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		render.Status(r, http.StatusBadRequest)
+		api.ReplyErrContent(w, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	u, err := api.svc.Users.GetByName(req.Username)
+	switch {
+	case err == models.ErrUserNotFound:
+	case err != nil:
+		log.Println("OTP_SEND", err)
+	default:
+		code, err := models.OtpCode(u.OtpSecret, models.OtpStepAt(api.svc.Clock.Now()))
+		if err == nil {
+			err = api.svc.OtpSender.Send(u, code)
+		}
+		if err != nil {
+			log.Println("OTP_SEND", u.Username, err)
+		}
+	}
+	//good
+	render.JSON(w, r, APIResponse{
+		Code:   200,
+		Status: "OtpSend::Welcome",
+	})
+}
+
+//Login check the password and the otp, each code is used once; the token is signed by the service jwt secret
+func (api *ApiHandler) Login(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		render.Status(r, http.StatusBadRequest)
+		api.ReplyErrContent(w, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	u, err := api.svc.Users.GetByName(req.Username)
+	if err != nil && err != models.ErrUserNotFound {
+		api.replyUserErr(w, r, err)
+		return
+	}
+	//same time with or without the user
+	oks := u.CheckPassword(req.Password)
+	if oks {
+		step := models.OtpVerify(u.OtpSecret, req.Otp, api.svc.Clock.Now())
+		if oks = step > 0; oks {
+			if oks, err = api.svc.Users.UseOtp(u.ID, step); err != nil {
+				api.replyUserErr(w, r, err)
+				return
+			}
+		}
+	}
+	if !oks {
+		render.Status(r, http.StatusUnauthorized)
+		api.ReplyErrContent(w, r, http.StatusUnauthorized, "Invalid username, password or OTP.")
+		return
+	}
+
+	//tokens are checked on wall time
+	now := time.Now()
+	expires := now.Add(LoginTokenTTL)
+	token, err := api.svc.Jwt.GenToken(jwt.MapClaims{
+		"user_id":  u.ID,
+		"username": u.Username,
+		"role":     u.Role,
+		"iat":      now.Unix(),
+		"exp":      expires.Unix(),
+	})
+	if err != nil {
+		api.replyUserErr(w, r, err)
+		return
+	}
+	//good
+	render.JSON(w, r, LoginResponse{
+		Code:    200,
+		Status:  "Login::Welcome",
+		Token:   token,
+		Expires: expires.Format(time.RFC3339),
+	})
+}
+
+//ownsUser check the token is of the user, replies if not
+func (api *ApiHandler) ownsUser(w http.ResponseWriter, r *http.Request, id int64) bool {
+	_, claims, _ := jwtauth.FromContext(r.Context())
+	var owner int64
+	switch v := claims["user_id"].(type) {
+	case float64:
+		owner = int64(v)
+	case json.Number:
+		owner, _ = v.Int64()
+	case int64:
+		owner = v
+	}
+	if id <= 0 || owner != id {
+		render.Status(r, http.StatusForbidden)
+		api.ReplyErrContent(w, r, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return false
+	}
+	return true
+}
+
+//replyUserErr send the status of the store error
+func (api *ApiHandler) replyUserErr(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	switch err {
+	case models.ErrUserNotFound:
+		code = http.StatusNotFound
+	case models.ErrUserExists:
+		code = http.StatusConflict
+	default:
+		log.Println("USER", err)
+	}
+	render.Status(r, code)
+	api.ReplyErrContent(w, r, code, http.StatusText(code))
+}
@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/bayugyug/rest-api-throttleip/utils"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/jwtauth"
+)
+
+//TestUserLogin signup, otp, login with a single use code and the failure-only login policy
+func TestUserLogin(t *testing.T) {
+
+	clock := models.NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))
+	sender := &models.LogOtpSender{}
+	svc, err := NewApiService(
+		WithSvcOptRedisHost(StoreMemory),
+		WithSvcOptClock(clock),
+		WithSvcOptOtpSender(sender),
+		WithSvcOptJwtSecret(tJwtSecret),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	ts := httptest.NewServer(svc.Router)
+	defer ts.Close()
+
+	var created UserResponse
+	_, body := testRequest(t, ts, "POST", "/v1/api/user", strings.NewReader(`{"username":"jerry","password":"ice-cream-1","email":"jerry@example.com"}`), "")
+	if err := json.Unmarshal([]byte(body), &created); err != nil || created.Code != 200 || created.User.ID == 0 || created.OtpURL == "" {
+		t.Fatalf("Create failed: %s", body)
+	}
+	if strings.Contains(body, "PasswordHash") || strings.Contains(body, "$2a$") {
+		t.Fatalf("Create failed: hash is sent %s", body)
+	}
+	t.Log("OKAY", "created", created.User.ID)
+
+	//code of the otp end-point, then the authenticator app code of the next step
+	testRequest(t, ts, "POST", "/v1/api/otp", strings.NewReader(`{"username":"jerry"}`), "")
+	sent := sender.Last("jerry")
+	otpURL, err := url.Parse(created.OtpURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, _ := models.OtpCode(otpURL.Query().Get("secret"), models.OtpStepAt(clock.Now())+1)
+
+	mockLists := []struct {
+		Path string
+		Body string
+		Code int
+	}{
+		{"/v1/api/user", `{"username":"jerry","password":"ice-cream-2"}`, http.StatusConflict},
+		{"/v1/api/user", `{"username":"ben","password":"short"}`, http.StatusBadRequest},
+		{"/v1/api/login", `{"username":"jerry","password":"wrong-password","otp":"` + sent + `"}`, http.StatusUnauthorized},
+		{"/v1/api/login", `{"username":"jerry","password":"ice-cream-1","otp":"000000"}`, http.StatusUnauthorized},
+		{"/v1/api/login", `{"username":"nobody","password":"ice-cream-1","otp":"` + sent + `"}`, http.StatusUnauthorized},
+		{"/v1/api/login", `{"username":"jerry","password":"ice-cream-1","otp":"` + sent + `"}`, http.StatusOK},
+		//used once, older steps too
+		{"/v1/api/login", `{"username":"jerry","password":"ice-cream-1","otp":"` + sent + `"}`, http.StatusUnauthorized},
+		//only the failures are counted, 4 so far on the ip
+		{"/v1/api/login", `{"username":"jerry","password":"ice-cream-1","otp":"` + next + `"}`, http.StatusOK},
+		//5th, the ip is locked
+		{"/v1/api/login", `{"username":"tom","password":"wrong-password","otp":"000000"}`, http.StatusUnauthorized},
+		{"/v1/api/login", `{"username":"jerry","password":"ice-cream-1","otp":"` + next + `"}`, http.StatusConflict},
+	}
+
+	var token string
+	for i, rec := range mockLists {
+		_, body := testRequest(t, ts, "POST", rec.Path, strings.NewReader(rec.Body), "")
+		var reply LoginResponse
+		if err := json.Unmarshal([]byte(body), &reply); err != nil {
+			t.Fatalf("%d Response failed", i+1)
+		}
+		if reply.Code != rec.Code {
+			t.Fatalf("%d Login failed: %d %s", i+1, reply.Code, body)
+		}
+		if reply.Token != "" {
+			token = reply.Token
+		}
+		t.Log(i+1, "OKAY", reply.Code, reply.Status)
+	}
+	if token == "" {
+		t.Fatal("Login failed: no token")
+	}
+
+	//token user only
+	jwtToken, err := svc.Jwt.TokenAuth.Decode(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(id string) int {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", id)
+		ctx := context.WithValue(context.Background(), chi.RouteCtxKey, rctx)
+		ctx = context.WithValue(ctx, jwtauth.TokenCtxKey, jwtToken)
+		w := httptest.NewRecorder()
+		svc.Api.UserGet(w, httptest.NewRequest("GET", "/v1/api/user/"+id, nil).WithContext(ctx))
+		var reply UserResponse
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return reply.Code
+	}
+	if code := get("1"); code != http.StatusOK {
+		t.Fatalf("Get failed: %d", code)
+	}
+	if code := get("2"); code != http.StatusForbidden {
+		t.Fatalf("Get failed: other user %d", code)
+	}
+	t.Log("OKAY", "owner only")
+
+	//signed up accounts are not admin, the role is on the token
+	admin, err := svc.Jwt.GenToken(jwt.MapClaims{"user_id": 9, "role": models.RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminToken, _ := svc.Jwt.TokenAuth.Decode(admin)
+	for i, rec := range []struct {
+		Token *jwt.Token
+		Code  int
+	}{
+		{jwtToken, http.StatusForbidden},
+		{adminToken, http.StatusOK},
+	} {
+		ctx := context.WithValue(context.Background(), jwtauth.TokenCtxKey, rec.Token)
+		w := httptest.NewRecorder()
+		svc.AdminChecker(http.HandlerFunc(svc.Api.PolicyInfo)).ServeHTTP(w, httptest.NewRequest("GET", "/v1/api/admin/policies", nil).WithContext(ctx))
+		if w.Code != rec.Code {
+			t.Fatalf("%d Admin failed: %d %s", i+1, w.Code, w.Body.String())
+		}
+		t.Log(i+1, "OKAY", "admin", w.Code)
+	}
+
+	//still locked after the minute window, till the admin unlock
+	clock.Advance(time.Minute)
+	later, _ := models.OtpCode(otpURL.Query().Get("secret"), models.OtpStepAt(clock.Now()))
+	login := `{"username":"jerry","password":"ice-cream-1","otp":"` + later + `"}`
+	if _, body := testRequest(t, ts, "POST", "/v1/api/login", strings.NewReader(login), ""); !strings.Contains(body, `"Code":409`) {
+		t.Fatalf("Lockout failed: %s", body)
+	}
+	locked, err := svc.Lockouts.List()
+	if err != nil || len(locked) != 1 || locked[0].Policy != "login" || locked[0].Key != "fail::ip::127.0.0.1" {
+		t.Fatalf("Lockout failed: %v %v", locked, err)
+	}
+	w := httptest.NewRecorder()
+	svc.Api.LockoutUnlock(w, httptest.NewRequest("DELETE", "/v1/api/admin/lockouts?ip=127.0.0.1", nil))
+	if !strings.Contains(w.Body.String(), `"Unlocked":1`) {
+		t.Fatalf("Unlock failed: %s", w.Body.String())
+	}
+	if _, body := testRequest(t, ts, "POST", "/v1/api/login", strings.NewReader(login), ""); !strings.Contains(body, `"Code":200`) {
+		t.Fatalf("Unlock failed: %s", body)
+	}
+	t.Log("OKAY", "unlocked")
+
+	t.Log("OK")
+}
+
+//TestJwtSecret no user and admin end-points on the built-in secret, its tokens are refused once set
+func TestJwtSecret(t *testing.T) {
+
+	builtin, err := NewApiService(WithSvcOptRedisHost(StoreMemory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builtin.Close()
+	svc, err := NewApiService(WithSvcOptRedisHost(StoreMemory), WithSvcOptJwtSecret(tJwtSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	mockLists := []struct {
+		Svc    *ApiService
+		Method string
+		Path   string
+		Status int
+	}{
+		{builtin, "POST", "/v1/api/user", http.StatusNotFound},
+		{builtin, "POST", "/v1/api/login", http.StatusNotFound},
+		{builtin, "POST", "/v1/api/otp", http.StatusNotFound},
+		{builtin, "GET", "/v1/api/admin/policies", http.StatusNotFound},
+		{builtin, "POST", "/v1/api/limits/check", http.StatusNotFound},
+		{builtin, "GET", "/debug/vars", http.StatusNotFound},
+		{builtin, "GET", "/v1/api/request/x", http.StatusOK},
+		{svc, "POST", "/v1/api/login", http.StatusBadRequest},
+		//mounted, the reply has the 401 of the missing token
+		{svc, "GET", "/v1/api/admin/policies", http.StatusOK},
+	}
+	for i, rec := range mockLists {
+		ts := httptest.NewServer(rec.Svc.Router)
+		resp, body := testRequest(t, ts, rec.Method, rec.Path, strings.NewReader(`{}`), "")
+		ts.Close()
+		if resp.StatusCode != rec.Status {
+			t.Fatalf("%d Routes failed: %d %s", i+1, resp.StatusCode, body)
+		}
+		t.Log(i+1, "OKAY", rec.Path, resp.StatusCode)
+	}
+
+	//login policies only with the login end-point
+	if builtin.Policies.ByName("login", nil) != nil || svc.Policies.ByName("login", nil) == nil {
+		t.Fatal("Policies failed: login policy")
+	}
+
+	//signed with the old built-in secret
+	forged, err := utils.NewAppJwtConfig(utils.TokenAuthSecret).GenToken(jwt.MapClaims{"user_id": 1, "role": models.RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Jwt.TokenAuth.Decode(forged); err == nil {
+		t.Fatal("Secret failed: built-in secret token is accepted")
+	}
+	signed, _ := svc.Jwt.GenToken(jwt.MapClaims{"user_id": 1})
+	if _, err := svc.Jwt.TokenAuth.Decode(signed); err != nil {
+		t.Fatal(err)
+	}
+	t.Log("OKAY", "built-in secret refused")
+
+	t.Log("OK")
+}
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/models"
+)
+
+//TestWindowReset window boundaries on the manual clock, no redis and no sleeps
+func TestWindowReset(t *testing.T) {
+
+	//own policy, 2 per minute
+	saved := tService.Policies
+	defer func() { tService.Policies = saved }()
+	policy := models.NewPolicy("reset-test", "/v1/api/request", 2, "minute")
+	tService.Policies = models.PolicyList{policy}
+
+	ts := httptest.NewServer(tService.Router)
+	defer ts.Close()
+
+	//start of a window
+	tClock.Set(tClock.Now().Truncate(time.Minute).Add(time.Minute))
+
+	mockLists := []struct {
+		Advance time.Duration
+		Code    int
+		Reset   string
+	}{
+		{0, http.StatusOK, "60"},
+		{30 * time.Second, http.StatusOK, "30"},
+		{0, http.StatusConflict, "30"},
+		{29 * time.Second, http.StatusConflict, "1"},
+		//next window
+		{1 * time.Second, http.StatusOK, "60"},
+		{59 * time.Second, http.StatusOK, "1"},
+		{0, http.StatusConflict, "1"},
+		//skipped a whole window
+		{2*time.Minute + time.Second, http.StatusOK, "60"},
+	}
+
+	for i, rec := range mockLists {
+		tClock.Advance(rec.Advance)
+		ret, body := testRequest(t, ts, "GET", "/v1/api/request/reset-test", nil, "")
+		var reply APIResponse
+		if err := json.Unmarshal([]byte(body), &reply); err != nil {
+			t.Fatalf("%d Response failed", i+1)
+		}
+		if reply.Code != rec.Code {
+			t.Fatalf("%d Throttle failed: %d %s", i+1, reply.Code, body)
+		}
+		if got := ret.Header.Get("RateLimit-Reset"); got != rec.Reset {
+			t.Fatalf("%d Reset failed: %s", i+1, got)
+		}
+		t.Log(i+1, "OKAY", reply.Code, ret.Header.Get("RateLimit-Remaining"))
+	}
+
+	//nothing spent on peek, refund gives back
+	dec := tService.Limiter.Peek("127.0.0.1", policy)
+	if dec.Remaining != 1 {
+		t.Fatalf("Peek failed: %+v", dec)
+	}
+	tService.Limiter.Refund("127.0.0.1", policy, 1)
+	if dec = tService.Limiter.Peek("127.0.0.1", policy); dec.Remaining != 2 {
+		t.Fatalf("Refund failed: %+v", dec)
+	}
+
+	//booked on the next window
+	dec = tService.Limiter.Reserve("127.0.0.1", policy, 2, time.Minute)
+	dec = tService.Limiter.Reserve("127.0.0.1", policy, 1, time.Minute)
+	if !dec.Allowed || dec.Wait != time.Minute {
+		t.Fatalf("Reserve failed: %+v", dec)
+	}
+
+	t.Log("OK")
+}
@@ -0,0 +1,369 @@
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//MigrationLock mysql named lock held while migrating
+	MigrationLock = "schema_migrations"
+	//MigrationLockTimeout wait for another instance that is migrating
+	MigrationLockTimeout = 60 * time.Second
+)
+
+//Migration 1 versioned schema change
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+//MigrationStatus 1 migration against the database
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt string `json:",omitempty"`
+	//Modified the applied migration was changed after
+	Modified bool
+	//Missing applied but no longer on the migrations
+	Missing bool
+}
+
+//ErrMigrationLock another instance kept the lock
+var ErrMigrationLock = errors.New("migration: lock timeout, another instance is migrating")
+
+//{version}_{name}.up.sql or .down.sql
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+//LoadMigrations read the {version}_{name}.up.sql and .down.sql files of the dir
+func LoadMigrations(fsys fs.FS, dir string) ([]*Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		m := migrationFile.FindStringSubmatch(e.Name())
+		if e.IsDir() || m == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig, oks := byVersion[version]
+		if !oks {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d: names %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(data)
+		} else {
+			mig.Down = string(data)
+		}
+	}
+	all := make([]*Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if strings.TrimSpace(mig.Up) == "" {
+			return nil, fmt.Errorf("migration %d %s: up step is missing", mig.Version, mig.Name)
+		}
+		sum := sha256.Sum256([]byte(mig.Up))
+		mig.Checksum = hex.EncodeToString(sum[:])
+		all = append(all, mig)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	return all, nil
+}
+
+//MustLoadMigrations same as LoadMigrations, panics on error (embedded files)
+func MustLoadMigrations(fsys fs.FS, dir string) []*Migration {
+	all, err := LoadMigrations(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return all
+}
+
+//Migrator apply and revert the migrations, 1 instance at a time
+type Migrator struct {
+	dbh         *sql.DB
+	all         []*Migration
+	LockTimeout time.Duration
+}
+
+//NewMigrator new instance
+func NewMigrator(dbh *sql.DB, all []*Migration) *Migrator {
+	return &Migrator{
+		dbh:         dbh,
+		all:         all,
+		LockTimeout: MigrationLockTimeout,
+	}
+}
+
+//Migrate apply the pending migrations, same as NewMigrator(dbh, all).Up()
+func Migrate(dbh *sql.DB, all []*Migration) ([]*Migration, error) {
+	return NewMigrator(dbh, all).Up()
+}
+
+//applied row of schema_migrations
+type applied struct {
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+//Up apply the pending migrations in version order; stops if an applied one was modified
+func (m *Migrator) Up() ([]*Migration, error) {
+	done := make([]*Migration, 0)
+	err := m.locked(func(ctx context.Context, conn *sql.Conn, rows map[int]*applied) error {
+		for _, mig := range m.all {
+			if row, oks := rows[mig.Version]; oks {
+				if row.checksum != mig.Checksum {
+					return fmt.Errorf("migration %d %s: checksum mismatch, it was modified after it was applied", mig.Version, mig.Name)
+				}
+				continue
+			}
+			//mysql ddl is not transactional, the version is saved right after
+			if err := execScript(ctx, conn, mig.Up); err != nil {
+				return fmt.Errorf("migration %d %s: %v", mig.Version, mig.Name, err)
+			}
+			if _, err := conn.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, checksum) VALUES (?, ?, ?)`,
+				mig.Version, mig.Name, mig.Checksum); err != nil {
+				return err
+			}
+			log.Println("Db migrated:", mig.Version, mig.Name)
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+//Down revert the last n applied migrations, newest 1st
+func (m *Migrator) Down(n int) ([]*Migration, error) {
+	done := make([]*Migration, 0)
+	err := m.locked(func(ctx context.Context, conn *sql.Conn, rows map[int]*applied) error {
+		versions := make([]int, 0, len(rows))
+		for v := range rows {
+			versions = append(versions, v)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+		byVersion := make(map[int]*Migration, len(m.all))
+		for _, mig := range m.all {
+			byVersion[mig.Version] = mig
+		}
+		for i := 0; i < n && i < len(versions); i++ {
+			mig, oks := byVersion[versions[i]]
+			if !oks {
+				return fmt.Errorf("migration %d %s: not on the migrations", versions[i], rows[versions[i]].name)
+			}
+			if strings.TrimSpace(mig.Down) == "" {
+				return fmt.Errorf("migration %d %s: down step is missing", mig.Version, mig.Name)
+			}
+			if err := execScript(ctx, conn, mig.Down); err != nil {
+				return fmt.Errorf("migration %d %s: %v", mig.Version, mig.Name, err)
+			}
+			if _, err := conn.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = ?`, mig.Version); err != nil {
+				return err
+			}
+			log.Println("Db reverted:", mig.Version, mig.Name)
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+//Status of all the migrations and the applied ones no longer on the migrations;
+//read only, no lock is taken and schema_migrations is not made or upgraded
+func (m *Migrator) Status() ([]*MigrationStatus, error) {
+	ctx := context.Background()
+	conn, err := m.dbh.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rows, err := readApplied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []*MigrationStatus
+	seen := make(map[int]bool)
+	for _, mig := range m.all {
+		st := &MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if row, oks := rows[mig.Version]; oks {
+			st.Applied = true
+			st.AppliedAt = row.appliedAt.Format(time.RFC3339)
+			//no checksum yet, it is set on the next up
+			st.Modified = row.checksum != "" && row.checksum != mig.Checksum
+		}
+		seen[mig.Version] = true
+		all = append(all, st)
+	}
+	for v, row := range rows {
+		if !seen[v] {
+			all = append(all, &MigrationStatus{Version: v, Name: row.name, Applied: true,
+				AppliedAt: row.appliedAt.Format(time.RFC3339), Missing: true})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	return all, nil
+}
+
+//locked run fn with the named lock on 1 connection, with the applied migrations
+func (m *Migrator) locked(fn func(ctx context.Context, conn *sql.Conn, rows map[int]*applied) error) error {
+	ctx := context.Background()
+	//the lock belongs to the session, everything runs on the same connection
+	conn, err := m.dbh.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var got sql.NullInt64
+	if err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, MigrationLock, int(m.LockTimeout/time.Second)).Scan(&got); err != nil {
+		return err
+	}
+	if !got.Valid || got.Int64 != 1 {
+		return ErrMigrationLock
+	}
+	defer conn.ExecContext(ctx, `SELECT RELEASE_LOCK(?)`, MigrationLock)
+
+	if err = prepareTable(ctx, conn); err != nil {
+		return err
+	}
+	rows, err := loadApplied(ctx, conn, m.all)
+	if err != nil {
+		return err
+	}
+	return fn(ctx, conn, rows)
+}
+
+//prepareTable create schema_migrations, checksum is added on the tables made before it
+func prepareTable(ctx context.Context, conn *sql.Conn) error {
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INT NOT NULL PRIMARY KEY,
+		name       VARCHAR(255) NOT NULL,
+		checksum   CHAR(64) NOT NULL DEFAULT '',
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return err
+	}
+	var n int
+	if err := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = 'schema_migrations' AND column_name = 'checksum'`).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := conn.ExecContext(ctx, `ALTER TABLE schema_migrations ADD COLUMN checksum CHAR(64) NOT NULL DEFAULT '' AFTER name`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//loadApplied rows of schema_migrations, the ones without a checksum get the current one
+func loadApplied(ctx context.Context, conn *sql.Conn, all []*Migration) (map[int]*applied, error) {
+	byVersion, err := readApplied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	for _, mig := range all {
+		if row, oks := byVersion[mig.Version]; oks && row.checksum == "" {
+			if _, err := conn.ExecContext(ctx, `UPDATE schema_migrations SET checksum = ? WHERE version = ?`, mig.Checksum, mig.Version); err != nil {
+				return nil, err
+			}
+			row.checksum = mig.Checksum
+		}
+	}
+	return byVersion, nil
+}
+
+//readApplied rows of schema_migrations as they are, none if the table is not there yet
+//and no checksum on the tables made before it
+func readApplied(ctx context.Context, conn *sql.Conn) (map[int]*applied, error) {
+	var columns, checksums int
+	if err := conn.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(column_name = 'checksum'), 0) FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = 'schema_migrations'`).Scan(&columns, &checksums); err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*applied)
+	if columns == 0 {
+		return byVersion, nil
+	}
+	query := `SELECT version, name, checksum, applied_at FROM schema_migrations`
+	if checksums == 0 {
+		query = `SELECT version, name, '', applied_at FROM schema_migrations`
+	}
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var v int
+		var row applied
+		if err := rows.Scan(&v, &row.name, &row.checksum, &row.appliedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		byVersion[v] = &row
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return byVersion, nil
+}
+
+//execScript run the statements of the script, 1 per ; at the end of a line
+func execScript(ctx context.Context, conn *sql.Conn, script string) error {
+	for _, stmt := range splitScript(script) {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//splitScript statements of the script without the -- comment lines
+func splitScript(script string) []string {
+	var all []string
+	var stmt []string
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		stmt = append(stmt, line)
+		if strings.HasSuffix(trimmed, ";") {
+			s := strings.TrimSuffix(strings.TrimSpace(strings.Join(stmt, "\n")), ";")
+			all = append(all, s)
+			stmt = nil
+		}
+	}
+	if s := strings.TrimSpace(strings.Join(stmt, "\n")); s != "" {
+		all = append(all, s)
+	}
+	return all
+}
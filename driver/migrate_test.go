@@ -0,0 +1,47 @@
+package driver
+
+import (
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+//TestMigrations embedded migrations in version order with both steps, bad sets are refused
+func TestMigrations(t *testing.T) {
+
+	//the set embedded by the models
+	all, err := LoadMigrations(os.DirFS("../models"), "migrations")
+	if err != nil || len(all) == 0 {
+		t.Fatalf("Migration failed: %d %v", len(all), err)
+	}
+	for i, mig := range all {
+		if mig.Version != i+1 || mig.Up == "" || mig.Down == "" || len(mig.Checksum) != 64 {
+			t.Fatalf("Migration failed: %d %s", mig.Version, mig.Name)
+		}
+		t.Log("OKAY", mig.Version, mig.Name, mig.Checksum[:8])
+	}
+
+	file := func(s string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(s)} }
+	mockLists := []struct {
+		Files fstest.MapFS
+		Count int
+		Fail  bool
+	}{
+		{fstest.MapFS{"m/0002_b.up.sql": file("B;"), "m/0001_a.up.sql": file("A;"), "m/0001_a.down.sql": file("-A;"), "m/README": file("x")}, 2, false},
+		{fstest.MapFS{"m/0001_a.down.sql": file("-A;")}, 0, true},
+		{fstest.MapFS{"m/0001_a.up.sql": file("A;"), "m/0001_b.down.sql": file("-B;")}, 0, true},
+	}
+
+	for i, rec := range mockLists {
+		all, err := LoadMigrations(rec.Files, "m")
+		if (err != nil) != rec.Fail || len(all) != rec.Count {
+			t.Fatalf("%d Load failed: %d %v", i+1, len(all), err)
+		}
+		if len(all) > 1 && (all[0].Version != 1 || all[0].Down != "-A;" || all[0].Checksum == all[1].Checksum) {
+			t.Fatalf("%d Load failed: %+v", i+1, all[0])
+		}
+		t.Log(i+1, "OKAY", len(all), err)
+	}
+
+	t.Log("OK")
+}
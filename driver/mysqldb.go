@@ -9,6 +9,13 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
+const (
+	//DbRetries pings before giving up
+	DbRetries = 5
+	//DbRetryInterval wait between the pings
+	DbRetryInterval = time.Second
+)
+
 //DbConnectorConfig sql credentials
 type DbConnectorConfig struct {
 	User string `json:"user"`
@@ -23,34 +30,32 @@ func NewDbConnector(cfg *DbConnectorConfig) (*sql.DB, error) {
 	//get handle
 	var err error
 	var dbh *sql.DB
-	var connstr = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s",
+	var connstr = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&loc=UTC",
 		cfg.User,
 		cfg.Pass,
 		cfg.Host,
 		cfg.Port,
 		cfg.Name,
 	)
-	//try to limit the try
-	for i := 0; i < 5; i++ {
-		dbh, err = sql.Open("mysql", connstr)
-		if err != nil {
-			log.Println("SQL:", err)
-			time.Sleep(1000 * time.Millisecond)
-		} else {
-			log.Println("Db driver connected.")
-			break
-		}
+	//open only checks the dsn
+	if dbh, err = sql.Open("mysql", connstr); err != nil {
+		return nil, err
 	}
 	//important tweak is here :-)
-	if dbh != nil {
-		dbh.SetConnMaxLifetime(time.Minute * 5)
-		dbh.SetMaxIdleConns(0)
-		dbh.SetMaxOpenConns(5)
-	}
+	dbh.SetConnMaxLifetime(time.Minute * 5)
+	dbh.SetMaxIdleConns(0)
+	dbh.SetMaxOpenConns(5)
 
-	if err != nil {
-		return nil, err
+	//try to limit the try
+	for i := 0; i < DbRetries; i++ {
+		if err = dbh.Ping(); err == nil {
+			log.Println("Db driver connected.")
+			return dbh, nil
+		}
+		log.Println("SQL:", err)
+		time.Sleep(DbRetryInterval)
 	}
-	return dbh, nil
+	dbh.Close()
+	return nil, err
 
 }
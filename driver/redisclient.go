@@ -1,35 +1,354 @@
 package driver
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	redis "gopkg.in/redis.v3"
 )
 
-//NewRedisConnector get 1 new redis client
-func NewRedisConnector(rhost string) (*redis.Client, error) {
+const (
+	//RedisPoolSize default connections per node
+	RedisPoolSize = 4000
+	//RedisRetries, RedisRetryInterval how long to wait for a node to be reachable
+	RedisRetries       = 100
+	RedisRetryInterval = 3 * time.Second
+)
+
+//RedisConfig redis connection
+//
+//  addr            = host:port of a single node
+//  addrs           = seed nodes of the cluster (cluster mode)
+//  password        = auth, or password_file to read it from (docker/k8s secrets)
+//  db              = db index, single node and sentinel only
+//  tls             = connect over tls, tls_ca/tls_cert/tls_key are optional pem files
+//  sentinel_master = master name, the master is looked up from sentinel_addrs
+//  cluster         = redis cluster, the keys are spread over the addrs
+//  *_timeout       = durations, i.e. "5s"
+type RedisConfig struct {
+	Addr         string `json:"addr"`
+	Password     string `json:"password"`
+	PasswordFile string `json:"password_file"`
+	DB           int64  `json:"db"`
+
+	TLS           bool   `json:"tls"`
+	TLSCA         string `json:"tls_ca"`
+	TLSCert       string `json:"tls_cert"`
+	TLSKey        string `json:"tls_key"`
+	TLSServerName string `json:"tls_server_name"`
+	TLSSkipVerify bool   `json:"tls_skip_verify"`
+
+	PoolSize     int    `json:"pool_size"`
+	PoolTimeout  string `json:"pool_timeout"`
+	IdleTimeout  string `json:"idle_timeout"`
+	DialTimeout  string `json:"dial_timeout"`
+	ReadTimeout  string `json:"read_timeout"`
+	WriteTimeout string `json:"write_timeout"`
+	MaxRetries   int    `json:"max_retries"`
+
+	SentinelMaster string   `json:"sentinel_master"`
+	SentinelAddrs  []string `json:"sentinel_addrs"`
+
+	Cluster bool     `json:"cluster"`
+	Addrs   []string `json:"addrs"`
+}
+
+//Validate sanity check
+func (c *RedisConfig) Validate() error {
+	for _, d := range []string{c.PoolTimeout, c.IdleTimeout, c.DialTimeout, c.ReadTimeout, c.WriteTimeout} {
+		if _, err := parseTimeout(d); err != nil {
+			return err
+		}
+	}
+	if c.Password != "" && c.PasswordFile != "" {
+		return errors.New("redis: only one of password or password_file")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("redis: tls_cert and tls_key go together")
+	}
+	switch {
+	case c.Cluster && c.SentinelMaster != "":
+		return errors.New("redis: cluster and sentinel_master are exclusive")
+	case c.Cluster:
+		if len(c.Addrs) == 0 && c.Addr == "" {
+			return errors.New("redis: cluster needs the addrs")
+		}
+		if c.DB != 0 {
+			return errors.New("redis: cluster only has db 0")
+		}
+		//redis.v3 cluster client has no custom dialer
+		if c.tlsOn() {
+			return errors.New("redis: tls is not supported on cluster mode")
+		}
+	case c.SentinelMaster != "":
+		if len(c.SentinelAddrs) == 0 {
+			return errors.New("redis: sentinel_master needs the sentinel_addrs")
+		}
+	case c.Addr == "":
+		return errors.New("redis: addr is needed")
+	}
+	return nil
+}
+
+//password from the config or the password file, the trailing newline of the file is trimmed
+func (c *RedisConfig) password() (string, error) {
+	if c.PasswordFile == "" {
+		return c.Password, nil
+	}
+	raw, err := ioutil.ReadFile(c.PasswordFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+func (c *RedisConfig) tlsOn() bool {
+	return c.TLS || c.TLSCA != "" || c.TLSCert != ""
+}
+
+func parseTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("redis: invalid timeout %q", s)
+	}
+	return d, nil
+}
+
+//RedisCmdable commands in use, same on a single node, sentinel and cluster
+type RedisCmdable interface {
+	Ping() *redis.StatusCmd
+	Get(key string) *redis.StringCmd
+	IncrBy(key string, value int64) *redis.IntCmd
+	ExpireAt(key string, tm time.Time) *redis.BoolCmd
+	Scan(cursor int64, match string, count int64) *redis.ScanCmd
+	Exists(key string) *redis.BoolCmd
+	RenameNX(key, newkey string) *redis.BoolCmd
+	HSet(key, field, value string) *redis.BoolCmd
+	HIncrBy(key, field string, incr int64) *redis.IntCmd
+	HScan(key string, cursor int64, match string, count int64) *redis.ScanCmd
+	ZRem(key string, members ...string) *redis.IntCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args []string) *redis.Cmd
+	ScriptExists(scripts ...string) *redis.BoolSliceCmd
+	ScriptLoad(script string) *redis.StringCmd
+}
+
+//RedisPipeline batched commands
+type RedisPipeline interface {
+	RedisCmdable
+	Exec() ([]redis.Cmder, error)
+	Close() error
+}
+
+//RedisClient single node, sentinel or cluster client
+type RedisClient interface {
+	RedisCmdable
+	Pipeline() RedisPipeline
+	Close() error
+}
+
+type redisNode struct{ *redis.Client }
+
+func (c redisNode) Pipeline() RedisPipeline { return c.Client.Pipeline() }
+
+type redisCluster struct{ *redis.ClusterClient }
+
+func (c redisCluster) Pipeline() RedisPipeline { return c.ClusterClient.Pipeline() }
+
+//NewRedisClient client of the config, not yet checked if reachable
+func NewRedisClient(cfg *RedisConfig) (RedisClient, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	password, err := cfg.password()
+	if err != nil {
+		return nil, err
+	}
+	poolSize := cfg.PoolSize
+	if poolSize <= 0 {
+		poolSize = RedisPoolSize
+	}
+	//validated already
+	poolTimeout, _ := parseTimeout(cfg.PoolTimeout)
+	idleTimeout, _ := parseTimeout(cfg.IdleTimeout)
+	dialTimeout, _ := parseTimeout(cfg.DialTimeout)
+	readTimeout, _ := parseTimeout(cfg.ReadTimeout)
+	writeTimeout, _ := parseTimeout(cfg.WriteTimeout)
+
+	if cfg.Cluster {
+		addrs := cfg.Addrs
+		if len(addrs) == 0 {
+			addrs = []string{cfg.Addr}
+		}
+		return redisCluster{redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        addrs,
+			Password:     password,
+			DialTimeout:  dialTimeout,
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			PoolSize:     poolSize,
+			PoolTimeout:  poolTimeout,
+			IdleTimeout:  idleTimeout,
+		})}, nil
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.tlsOn() {
+		if tlsConfig, err = cfg.tlsConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.SentinelMaster != "" && tlsConfig == nil {
+		return redisNode{redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    cfg.SentinelMaster,
+			SentinelAddrs: cfg.SentinelAddrs,
+			Password:      password,
+			DB:            cfg.DB,
+			MaxRetries:    cfg.MaxRetries,
+			DialTimeout:   dialTimeout,
+			ReadTimeout:   readTimeout,
+			WriteTimeout:  writeTimeout,
+			PoolSize:      poolSize,
+			PoolTimeout:   poolTimeout,
+			IdleTimeout:   idleTimeout,
+		})}, nil
+	}
+
+	opts := &redis.Options{
+		Addr:         cfg.Addr,
+		Password:     password,
+		DB:           cfg.DB,
+		MaxRetries:   cfg.MaxRetries,
+		DialTimeout:  dialTimeout,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		PoolSize:     poolSize,
+		PoolTimeout:  poolTimeout,
+		IdleTimeout:  idleTimeout,
+	}
+	if tlsConfig != nil {
+		dialer := &net.Dialer{Timeout: dialTimeout}
+		addr := func() (string, error) { return cfg.Addr, nil }
+		if cfg.SentinelMaster != "" {
+			//redis.v3 failover client has no custom dialer, every new conn asks the sentinels
+			//for the current master, conns to an old master are dropped on the idle timeout
+			addr = func() (string, error) { return sentinelMaster(cfg, dialer, tlsConfig) }
+		}
+		opts.Dialer = func() (net.Conn, error) {
+			host, err := addr()
+			if err != nil {
+				return nil, err
+			}
+			return tls.DialWithDialer(dialer, "tcp", host, tlsWithServerName(tlsConfig, host))
+		}
+	}
+	return redisNode{redis.NewClient(opts)}, nil
+}
+
+//tlsConfig from the pem files, system roots if no ca
+func (c *RedisConfig) tlsConfig() (*tls.Config, error) {
+	t := &tls.Config{
+		ServerName:         c.TLSServerName,
+		InsecureSkipVerify: c.TLSSkipVerify,
+	}
+	if c.TLSCA != "" {
+		pem, err := ioutil.ReadFile(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("redis: no certificate in %s", c.TLSCA)
+		}
+		t.RootCAs = pool
+	}
+	if c.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+//tlsWithServerName verify against the host dialed unless set
+func tlsWithServerName(t *tls.Config, addr string) *tls.Config {
+	if t.ServerName != "" {
+		return t
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return t
+	}
+	c := t.Clone()
+	c.ServerName = host
+	return c
+}
+
+//sentinelMaster ask the sentinels in order for the address of the master
+func sentinelMaster(cfg *RedisConfig, dialer *net.Dialer, t *tls.Config) (string, error) {
+	err := errors.New("redis: no sentinel reachable")
+	for _, sentinel := range cfg.SentinelAddrs {
+		sentinel := sentinel
+		client := redis.NewClient(&redis.Options{
+			Addr:        sentinel,
+			MaxRetries:  0,
+			PoolSize:    1,
+			DialTimeout: dialer.Timeout,
+			Dialer: func() (net.Conn, error) {
+				return tls.DialWithDialer(dialer, "tcp", sentinel, tlsWithServerName(t, sentinel))
+			},
+		})
+		cmd := redis.NewStringSliceCmd("SENTINEL", "get-master-addr-by-name", cfg.SentinelMaster)
+		client.Process(cmd)
+		client.Close()
+		addr, cerr := cmd.Result()
+		if cerr != nil {
+			err = cerr
+			continue
+		}
+		if len(addr) != 2 {
+			err = fmt.Errorf("redis: master %s is unknown to %s", cfg.SentinelMaster, sentinel)
+			continue
+		}
+		return net.JoinHostPort(addr[0], addr[1]), nil
+	}
+	return "", err
+}
+
+//NewRedisConnector get 1 new redis client, waits till it is reachable
+func NewRedisConnector(cfg *RedisConfig) (RedisClient, error) {
 	//get handle
-	var err error
-	redisCache := redis.NewClient(&redis.Options{
-		Addr:     rhost,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-		PoolSize: 4000,
-	})
+	redisCache, err := NewRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
 	//wait till have a good conn
-	for i := 0; i <= 100; i++ {
-		_, err := redisCache.Ping().Result()
+	for i := 0; i <= RedisRetries; i++ {
+		_, err = redisCache.Ping().Result()
 		if err != nil {
 			log.Println("Redis:", err)
 		} else {
 			log.Println("Redis: Connected.")
 			break
 		}
-		time.Sleep(time.Second * 3)
+		time.Sleep(RedisRetryInterval)
 	}
 	if err != nil {
+		redisCache.Close()
 		return nil, err
 	}
 	return redisCache, nil
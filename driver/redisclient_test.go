@@ -0,0 +1,188 @@
+package driver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//TestRedisConfigValidate single node, sentinel, cluster and tls combinations
+func TestRedisConfigValidate(t *testing.T) {
+	mockLists := []struct {
+		Config *RedisConfig
+		Valid  bool
+	}{
+		{&RedisConfig{Addr: "127.0.0.1:6379"}, true},
+		{&RedisConfig{}, false},
+		{&RedisConfig{Addr: "127.0.0.1:6379", DialTimeout: "5s", ReadTimeout: "1s"}, true},
+		{&RedisConfig{Addr: "127.0.0.1:6379", DialTimeout: "5"}, false},
+		{&RedisConfig{Addr: "127.0.0.1:6379", IdleTimeout: "-1s"}, false},
+		{&RedisConfig{Addr: "127.0.0.1:6379", Password: "x", PasswordFile: "/run/secrets/redis"}, false},
+		{&RedisConfig{Addr: "127.0.0.1:6379", PasswordFile: "/run/secrets/redis"}, true},
+		//tls
+		{&RedisConfig{Addr: "127.0.0.1:6379", TLS: true}, true},
+		{&RedisConfig{Addr: "127.0.0.1:6379", TLSCert: "cert.pem"}, false},
+		{&RedisConfig{Addr: "127.0.0.1:6379", TLSKey: "key.pem"}, false},
+		{&RedisConfig{Addr: "127.0.0.1:6379", TLSCert: "cert.pem", TLSKey: "key.pem"}, true},
+		//sentinel
+		{&RedisConfig{SentinelMaster: "mymaster", SentinelAddrs: []string{"10.0.0.1:26379"}}, true},
+		{&RedisConfig{SentinelMaster: "mymaster", SentinelAddrs: []string{"10.0.0.1:26379"}, DB: 2, TLS: true}, true},
+		{&RedisConfig{SentinelMaster: "mymaster"}, false},
+		{&RedisConfig{SentinelMaster: "mymaster", Addr: "127.0.0.1:6379"}, false},
+		//cluster
+		{&RedisConfig{Cluster: true, Addrs: []string{"10.0.0.1:7000", "10.0.0.2:7000"}}, true},
+		{&RedisConfig{Cluster: true, Addr: "10.0.0.1:7000"}, true},
+		{&RedisConfig{Cluster: true}, false},
+		{&RedisConfig{Cluster: true, Addrs: []string{"10.0.0.1:7000"}, DB: 1}, false},
+		{&RedisConfig{Cluster: true, Addrs: []string{"10.0.0.1:7000"}, TLS: true}, false},
+		{&RedisConfig{Cluster: true, Addrs: []string{"10.0.0.1:7000"}, TLSCA: "ca.pem"}, false},
+		{&RedisConfig{Cluster: true, Addrs: []string{"10.0.0.1:7000"}, TLSCert: "cert.pem", TLSKey: "key.pem"}, false},
+		{&RedisConfig{Cluster: true, Addrs: []string{"10.0.0.1:7000"}, SentinelMaster: "mymaster", SentinelAddrs: []string{"10.0.0.1:26379"}}, false},
+	}
+	for i, rec := range mockLists {
+		if err := rec.Config.Validate(); (err == nil) != rec.Valid {
+			t.Fatalf("%d Validate failed: %v", i+1, err)
+		}
+		t.Log(i+1, "OKAY", rec.Valid)
+	}
+	t.Log("OK")
+}
+
+//TestRedisPassword the password file is trimmed, the inline one is kept as is
+func TestRedisPassword(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "redis")
+	if err := ioutil.WriteFile(file, []byte("  s3cret \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mockLists := []struct {
+		Config   *RedisConfig
+		Password string
+		Valid    bool
+	}{
+		{&RedisConfig{}, "", true},
+		{&RedisConfig{Password: " s3cret "}, " s3cret ", true},
+		{&RedisConfig{PasswordFile: file}, "s3cret", true},
+		{&RedisConfig{PasswordFile: filepath.Join(dir, "missing")}, "", false},
+	}
+	for i, rec := range mockLists {
+		got, err := rec.Config.password()
+		if (err == nil) != rec.Valid || got != rec.Password {
+			t.Fatalf("%d Password failed: %q %v", i+1, got, err)
+		}
+		t.Log(i+1, "OKAY", rec.Valid)
+	}
+	if _, err := NewRedisClient(&RedisConfig{Addr: "127.0.0.1:6379", PasswordFile: filepath.Join(dir, "missing")}); err == nil {
+		t.Fatal("Client failed: missing password file is accepted")
+	}
+	t.Log("OK")
+}
+
+//writePEM self-signed cert and its key
+func writePEM(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, priv := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(priv, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, priv
+}
+
+//TestRedisTLS pem files to the tls config, the server name of the dialed host unless set
+func TestRedisTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writePEM(t, dir)
+	junk := filepath.Join(dir, "junk.pem")
+	if err := ioutil.WriteFile(junk, []byte("not a pem"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mockLists := []struct {
+		Config     *RedisConfig
+		Valid      bool
+		RootCAs    bool
+		Certs      int
+		ServerName string
+		SkipVerify bool
+	}{
+		{&RedisConfig{TLS: true}, true, false, 0, "", false},
+		{&RedisConfig{TLSCA: cert}, true, true, 0, "", false},
+		{&RedisConfig{TLSCA: cert, TLSCert: cert, TLSKey: key, TLSServerName: "redis.test"}, true, true, 1, "redis.test", false},
+		{&RedisConfig{TLS: true, TLSSkipVerify: true}, true, false, 0, "", true},
+		{&RedisConfig{TLSCA: junk}, false, false, 0, "", false},
+		{&RedisConfig{TLSCA: filepath.Join(dir, "missing.pem")}, false, false, 0, "", false},
+		{&RedisConfig{TLSCert: cert, TLSKey: cert}, false, false, 0, "", false},
+	}
+	for i, rec := range mockLists {
+		got, err := rec.Config.tlsConfig()
+		if (err == nil) != rec.Valid {
+			t.Fatalf("%d TLS failed: %v", i+1, err)
+		}
+		if err != nil {
+			t.Log(i+1, "OKAY", err)
+			continue
+		}
+		if (got.RootCAs != nil) != rec.RootCAs || len(got.Certificates) != rec.Certs ||
+			got.ServerName != rec.ServerName || got.InsecureSkipVerify != rec.SkipVerify {
+			t.Fatalf("%d TLS failed: %+v", i+1, got)
+		}
+		t.Log(i+1, "OKAY", rec.RootCAs, rec.Certs, rec.ServerName)
+	}
+
+	//the host of the node or the master the sentinels gave
+	named := &tls.Config{ServerName: "redis.test"}
+	plain := &tls.Config{}
+	servers := []struct {
+		Config *tls.Config
+		Addr   string
+		Want   string
+	}{
+		{named, "10.0.0.1:6379", "redis.test"},
+		{plain, "10.0.0.1:6379", "10.0.0.1"},
+		{plain, "redis-0.redis:6380", "redis-0.redis"},
+		{plain, "[::1]:6379", "::1"},
+		{plain, "no-port", ""},
+	}
+	for i, rec := range servers {
+		if got := tlsWithServerName(rec.Config, rec.Addr); got.ServerName != rec.Want {
+			t.Fatalf("%d Server name failed: %q", i+1, got.ServerName)
+		}
+		t.Log(i+1, "OKAY", rec.Addr, rec.Want)
+	}
+	//shared config is not changed
+	if plain.ServerName != "" {
+		t.Fatalf("Server name failed: shared config is set to %q", plain.ServerName)
+	}
+	t.Log("OK")
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"log"
 	"math/rand"
+	"os"
 	"time"
 
 	"github.com/bayugyug/rest-api-throttleip/config"
 	"github.com/bayugyug/rest-api-throttleip/controllers"
+	"github.com/bayugyug/rest-api-throttleip/driver"
+	"github.com/bayugyug/rest-api-throttleip/models"
 )
 
 const (
@@ -38,6 +41,26 @@ func main() {
 
 	var err error
 
+	//sub-commands
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		if err = simulate(os.Args[2:]); err != nil {
+			log.Fatal("Oops! ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err = migrate(os.Args[2:]); err != nil {
+			log.Fatal("Oops! ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-keys" {
+		if err = migrateKeys(os.Args[2:]); err != nil {
+			log.Fatal("Oops! ", err)
+		}
+		return
+	}
+
 	//init
 	appcfg := config.NewAppSettings()
 
@@ -46,16 +69,67 @@ func main() {
 		log.Fatal("Oops! Config missing")
 	}
 
+	//quota counters on mysql, otherwise redis
+	var quotaDb *driver.DbConnectorConfig
+	if appcfg.Config.QuotaStore == "mysql" {
+		quotaDb = appcfg.Config.Mysql
+	}
+
+	//accounts on mysql, otherwise in-process
+	var userDb *driver.DbConnectorConfig
+	if appcfg.Config.UserStore == "mysql" {
+		userDb = appcfg.Config.Mysql
+	}
+
+	//decision history on mysql, redis is kept too on both
+	var historyDb *models.MysqlHistoryConfig
+	if s := appcfg.Config.HistoryStore; s == "mysql" || s == "both" {
+		historyDb = &models.MysqlHistoryConfig{}
+		if appcfg.Config.HistoryMysql != nil {
+			*historyDb = *appcfg.Config.HistoryMysql
+		}
+		historyDb.Db = appcfg.Config.Mysql
+		historyDb.KeepRedis = s == "both"
+	}
+
+	//envoy rate limit service
+	var grpcAddress string
+	if appcfg.Config.GrpcPort != "" {
+		grpcAddress = ":" + appcfg.Config.GrpcPort
+	}
+
 	//init service
-	if controllers.ApiInstance, err = controllers.NewApiService(
+	svc, err := controllers.NewApiService(
 		controllers.WithSvcOptAddress(":"+appcfg.Config.HttpPort),
 		controllers.WithSvcOptRedisHost(appcfg.Config.RedisHost),
-	); err != nil {
+		controllers.WithSvcOptRedis(appcfg.Config.Redis),
+		controllers.WithSvcOptPolicies(appcfg.Config.Policies),
+		controllers.WithSvcOptQuotas(appcfg.Config.Quotas),
+		controllers.WithSvcOptQuotaDb(quotaDb),
+		controllers.WithSvcOptMaxInflight(appcfg.Config.MaxInflight),
+		controllers.WithSvcOptInflightStore(appcfg.Config.InflightStore),
+		controllers.WithSvcOptAdaptive(appcfg.Config.Adaptive),
+		controllers.WithSvcOptPriorities(appcfg.Config.Priorities),
+		controllers.WithSvcOptApiKeys(appcfg.Config.ApiKeys),
+		controllers.WithSvcOptShedding(appcfg.Config.Shedding),
+		controllers.WithSvcOptTrustedProxies(appcfg.Config.TrustedProxies),
+		controllers.WithSvcOptUpstreams(appcfg.Config.Upstreams),
+		controllers.WithSvcOptGrpcAddress(grpcAddress),
+		controllers.WithSvcOptRlsDomain(appcfg.Config.RlsDomain),
+		controllers.WithSvcOptCounters(appcfg.Config.Counters),
+		controllers.WithSvcOptHybrid(appcfg.Config.Hybrid),
+		controllers.WithSvcOptShards(appcfg.Config.Shards),
+		controllers.WithSvcOptKeys(appcfg.Config.Keys),
+		controllers.WithSvcOptHistoryMysql(historyDb),
+		controllers.WithSvcOptUserDb(userDb),
+		controllers.WithSvcOptJwtSecret(appcfg.Config.JwtSecret),
+	)
+	if err != nil {
 		log.Fatal("Oops! config might be missing", err)
 	}
 
 	//run service
-	controllers.ApiInstance.Run()
+	svc.Run()
 	log.Println("Since", time.Since(start))
 	log.Println("Done")
 }
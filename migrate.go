@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/bayugyug/rest-api-throttleip/driver"
+	"github.com/bayugyug/rest-api-throttleip/models"
+)
+
+//migrate apply, revert or list the mysql migrations (quota counters, decision history),
+//up is also run on startup; the report is printed as json
+//
+//  rest-api-throttleip migrate up     -mysql '{"user":"throttle","pass":"secret","host":"127.0.0.1","port":"3306","name":"throttle"}'
+//  rest-api-throttleip migrate down   -mysql '{...}' -steps 1
+//  rest-api-throttleip migrate status -mysql '{...}'
+func migrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New("migrate: up, down or status is needed")
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet("migrate "+cmd, flag.ExitOnError)
+	mysql := fs.String("mysql", "", "json of the mysql config")
+	steps := fs.Int("steps", 1, "migrations to revert (down)")
+	fs.Parse(args[1:])
+
+	if *mysql == "" {
+		return errors.New("migrate: -mysql is needed")
+	}
+	var cfg driver.DbConnectorConfig
+	if err := json.Unmarshal([]byte(*mysql), &cfg); err != nil {
+		return fmt.Errorf("migrate: invalid -mysql: %v", err)
+	}
+
+	var run func(m *driver.Migrator) (interface{}, error)
+	switch cmd {
+	case "up":
+		run = func(m *driver.Migrator) (interface{}, error) { return m.Up() }
+	case "down":
+		if *steps < 1 {
+			return errors.New("migrate: -steps must be at least 1")
+		}
+		run = func(m *driver.Migrator) (interface{}, error) { return m.Down(*steps) }
+	case "status":
+		run = func(m *driver.Migrator) (interface{}, error) { return m.Status() }
+	default:
+		return fmt.Errorf("migrate: unknown %q, up, down or status is needed", cmd)
+	}
+
+	dbh, err := driver.NewDbConnector(&cfg)
+	if err != nil {
+		return err
+	}
+	defer dbh.Close()
+
+	report, err := run(driver.NewMigrator(dbh, models.Migrations))
+	out, jerr := json.MarshalIndent(report, "", "\t")
+	if jerr != nil {
+		return jerr
+	}
+	fmt.Println(string(out))
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/bayugyug/rest-api-throttleip/driver"
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/bayugyug/rest-api-throttleip/utils"
+)
+
+//keysReport migration of the main redis and of each shard node
+type keysReport struct {
+	Redis  *models.KeyMigration            `json:",omitempty"`
+	Shards map[string]*models.KeyMigration `json:",omitempty"`
+}
+
+//migrateKeys move the history, counters and quotas of the old key namespace to a new one,
+//the report is printed as json; the shard counters are renamed on their node and moved
+//to their new owners (rebalance) when the service starts
+//
+//  rest-api-throttleip migrate-keys -redis 127.0.0.1:6379 -to '{"template":"{app}:{env}:throttle:{name}","app":"shop","env":"prod"}' -dry-run
+//  rest-api-throttleip migrate-keys -redis 127.0.0.1:6379 -from '{"prefix":"old:"}' -to '{"prefix":"new:"}'
+//  rest-api-throttleip migrate-keys -shards '{"nodes":{"shard-a":{"addr":"10.0.0.11:6379"}}}' -to '{"prefix":"new:"}'
+func migrateKeys(args []string) error {
+	fs := flag.NewFlagSet("migrate-keys", flag.ExitOnError)
+	redisHost := fs.String("redis", "", "redis host (or the json of the redis config)")
+	shardsFlag := fs.String("shards", "", "json of the redis_shards config, each node is migrated too")
+	from := fs.String("from", "", "json of the current key namespace (default: the old fixed keys)")
+	to := fs.String("to", "", "json of the new key namespace")
+	dryRun := fs.Bool("dry-run", false, "only list the keys to move")
+	fs.Parse(args)
+
+	//report only
+	utils.ShowMeLog = false
+
+	if (*redisHost == "" && *shardsFlag == "") || *to == "" {
+		return errors.New("migrate-keys: -redis or -shards and -to are needed")
+	}
+	fromKeys, err := parseKeysFlag(*from)
+	if err != nil {
+		return err
+	}
+	toKeys, err := parseKeysFlag(*to)
+	if err != nil {
+		return err
+	}
+	var shards *models.ShardConfig
+	if *shardsFlag != "" {
+		shards = &models.ShardConfig{}
+		if err := json.Unmarshal([]byte(*shardsFlag), shards); err != nil {
+			return err
+		}
+		if err := shards.Validate(); err != nil {
+			return err
+		}
+	}
+
+	report := &keysReport{}
+	err = func() error {
+		if *redisHost != "" {
+			client, err := connectRedisFlag(*redisHost)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			if report.Redis, err = models.MigrateKeys(client, fromKeys, toKeys, *dryRun); err != nil {
+				return err
+			}
+		}
+		if shards == nil {
+			return nil
+		}
+		//drained nodes too, their counters are moved on start
+		report.Shards = make(map[string]*models.KeyMigration)
+		for _, name := range shards.Names() {
+			client, err := driver.NewRedisConnector(shards.Nodes[name])
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			report.Shards[name], err = models.MigrateKeys(client, fromKeys, toKeys, *dryRun)
+			client.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		return nil
+	}()
+	out, jerr := json.MarshalIndent(report, "", "\t")
+	if jerr != nil {
+		return jerr
+	}
+	fmt.Println(string(out))
+	return err
+}
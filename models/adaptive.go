@@ -0,0 +1,248 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/utils"
+)
+
+const (
+	//priorities, critical is shed last
+	PriorityCritical = "critical"
+	PriorityHigh     = "high"
+	PriorityNormal   = "normal"
+	PriorityLow      = "low"
+
+	//adaptiveProbe samples before the min latency is re-measured
+	adaptiveProbe = 1000
+)
+
+//priorityShares share of the adaptive limit each priority can fill,
+//so the lower ones are shed first once the limit shrinks
+var priorityShares = map[string]float64{
+	PriorityCritical: 1.0,
+	PriorityHigh:     0.9,
+	PriorityNormal:   0.75,
+	PriorityLow:      0.5,
+}
+
+//PriorityName known priority name, unknown ones are normal
+func PriorityName(priority string) string {
+	priority = strings.ToLower(priority)
+	if _, oks := priorityShares[priority]; oks {
+		return priority
+	}
+	return PriorityNormal
+}
+
+//PriorityShare share of the limit
+func PriorityShare(priority string) float64 {
+	return priorityShares[PriorityName(priority)]
+}
+
+//LimitAlgorithm compute the next concurrency limit from the latest sample
+type LimitAlgorithm interface {
+	Update(limit float64, rtt, minRTT time.Duration, inflight int, dropped bool) float64
+}
+
+//AIMDLimit additive increase, multiplicative decrease on drops
+type AIMDLimit struct {
+	Backoff float64
+}
+
+//Update next limit
+func (a *AIMDLimit) Update(limit float64, rtt, minRTT time.Duration, inflight int, dropped bool) float64 {
+	if dropped {
+		return limit * a.Backoff
+	}
+	//only grow if the limit is actually used
+	if float64(inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+//VegasLimit estimate the queue from the latency over the min latency
+type VegasLimit struct {
+	Alpha float64
+	Beta  float64
+}
+
+//Update next limit
+func (v *VegasLimit) Update(limit float64, rtt, minRTT time.Duration, inflight int, dropped bool) float64 {
+	if dropped {
+		return limit * 0.9
+	}
+	if rtt <= 0 || minRTT <= 0 {
+		return limit
+	}
+	queue := limit * (1 - float64(minRTT)/float64(rtt))
+	step := math.Max(1, math.Log10(limit))
+	switch {
+	case queue < v.Alpha:
+		return limit + step
+	case queue > v.Beta:
+		return limit - step
+	}
+	return limit
+}
+
+//GradientLimit scale the limit by the min latency over the latency
+type GradientLimit struct {
+	Tolerance float64
+	Smoothing float64
+}
+
+//Update next limit
+func (g *GradientLimit) Update(limit float64, rtt, minRTT time.Duration, inflight int, dropped bool) float64 {
+	if rtt <= 0 || minRTT <= 0 {
+		return limit
+	}
+	gradient := math.Max(0.5, math.Min(1, g.Tolerance*float64(minRTT)/float64(rtt)))
+	if dropped {
+		gradient = 0.5
+	}
+	next := limit*gradient + math.Sqrt(limit)
+	return limit*(1-g.Smoothing) + next*g.Smoothing
+}
+
+//NewLimitAlgorithm by name: aimd, vegas or gradient
+func NewLimitAlgorithm(name string) (LimitAlgorithm, error) {
+	switch strings.ToLower(name) {
+	case "", "aimd":
+		return &AIMDLimit{Backoff: 0.9}, nil
+	case "vegas":
+		return &VegasLimit{Alpha: 3, Beta: 6}, nil
+	case "gradient":
+		return &GradientLimit{Tolerance: 2, Smoothing: 0.2}, nil
+	}
+	return nil, fmt.Errorf("adaptive: unknown algorithm %q", name)
+}
+
+//AdaptiveConfig adaptive limiter settings
+type AdaptiveConfig struct {
+	Algorithm string `json:"algorithm"`
+	Initial   int    `json:"initial"`
+	Min       int    `json:"min"`
+	Max       int    `json:"max"`
+	Timeout   string `json:"timeout"`
+}
+
+//AdaptiveLimiter global concurrency limit driven by the handler latency
+type AdaptiveLimiter struct {
+	lock     sync.Mutex
+	algo     LimitAlgorithm
+	limit    float64
+	min      float64
+	max      float64
+	timeout  time.Duration
+	inflight int
+	minRTT   time.Duration
+	samples  int
+	shed     map[string]int64
+
+	//Clock of the handler latency, manual on tests
+	Clock Clock
+}
+
+//NewAdaptiveLimiter new instance
+func NewAdaptiveLimiter(cfg *AdaptiveConfig) (*AdaptiveLimiter, error) {
+	algo, err := NewLimitAlgorithm(cfg.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	l := &AdaptiveLimiter{
+		algo:  algo,
+		limit: float64(cfg.Initial),
+		min:   float64(cfg.Min),
+		max:   float64(cfg.Max),
+		shed:  make(map[string]int64),
+		Clock: SystemClock{},
+	}
+	if cfg.Timeout != "" {
+		if l.timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, err
+		}
+	}
+	if l.min < 1 {
+		l.min = 1
+	}
+	if l.max < l.min {
+		l.max = 1000
+	}
+	if l.limit < l.min {
+		l.limit = 20
+	}
+	l.limit = math.Min(l.max, math.Max(l.min, l.limit))
+	return l, nil
+}
+
+//Acquire take a slot if the priority share of the limit is not yet full,
+//the done func records the handler latency and if it failed
+func (l *AdaptiveLimiter) Acquire(priority string) (func(failed bool), bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if float64(l.inflight) >= math.Max(1, l.limit*PriorityShare(priority)) {
+		l.shed[PriorityName(priority)]++
+		return nil, false
+	}
+	l.inflight++
+	start := l.Clock.Now()
+	var once sync.Once
+	return func(failed bool) {
+		once.Do(func() {
+			l.sample(l.Clock.Now().Sub(start), failed)
+		})
+	}, true
+}
+
+func (l *AdaptiveLimiter) sample(rtt time.Duration, failed bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	inflight := l.inflight
+	l.inflight--
+
+	//re-measure from time to time, the backend might be faster now
+	l.samples++
+	if l.samples >= adaptiveProbe {
+		l.samples = 0
+		l.minRTT = 0
+	}
+	if !failed && (l.minRTT == 0 || rtt < l.minRTT) {
+		l.minRTT = rtt
+	}
+	dropped := failed || (l.timeout > 0 && rtt > l.timeout)
+	next := l.algo.Update(l.limit, rtt, l.minRTT, inflight, dropped)
+	l.limit = math.Min(l.max, math.Max(l.min, next))
+	if dropped {
+		utils.Dumper("adaptive::limit", int(l.limit), rtt.String())
+	}
+}
+
+//AdaptiveStats snapshot of the limiter
+type AdaptiveStats struct {
+	Limit    int
+	Inflight int
+	MinRTT   string
+	Shed     map[string]int64
+}
+
+//Stats snapshot of the limiter
+func (l *AdaptiveLimiter) Stats() *AdaptiveStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	shed := make(map[string]int64, len(l.shed))
+	for k, v := range l.shed {
+		shed[k] = v
+	}
+	return &AdaptiveStats{
+		Limit:    int(l.limit),
+		Inflight: l.inflight,
+		MinRTT:   l.minRTT.String(),
+		Shed:     shed,
+	}
+}
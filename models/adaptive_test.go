@@ -0,0 +1,166 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+//TestLimitAlgorithms next limit of each algorithm on 1 sample
+func TestLimitAlgorithms(t *testing.T) {
+	ms := time.Millisecond
+	mockLists := []struct {
+		Algorithm string
+		Limit     float64
+		RTT       time.Duration
+		MinRTT    time.Duration
+		Inflight  int
+		Dropped   bool
+		Want      float64
+	}{
+		//grow by 1 if half used, cut by 10% on a drop
+		{"aimd", 10, 100 * ms, 100 * ms, 5, false, 11},
+		{"aimd", 10, 100 * ms, 100 * ms, 4, false, 10},
+		{"aimd", 10, 100 * ms, 100 * ms, 10, true, 9},
+		//no queue, small queue, big queue
+		{"vegas", 10, 100 * ms, 100 * ms, 10, false, 11},
+		{"vegas", 100, 100 * ms, 100 * ms, 10, false, 102},
+		{"vegas", 10, 200 * ms, 100 * ms, 10, false, 10},
+		{"vegas", 10, time.Second, 100 * ms, 10, false, 9},
+		{"vegas", 10, 100 * ms, 100 * ms, 10, true, 9},
+		{"vegas", 10, 0, 0, 10, false, 10},
+		//latency within the tolerance grows by sqrt, slower shrinks (smoothed)
+		{"gradient", 100, 100 * ms, 100 * ms, 10, false, 102},
+		{"gradient", 100, 400 * ms, 100 * ms, 10, false, 92},
+		{"gradient", 100, 100 * ms, 100 * ms, 10, true, 92},
+		{"gradient", 100, 0, 0, 10, false, 100},
+	}
+	for i, rec := range mockLists {
+		algo, err := NewLimitAlgorithm(rec.Algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := algo.Update(rec.Limit, rec.RTT, rec.MinRTT, rec.Inflight, rec.Dropped)
+		if math.Abs(got-rec.Want) > 1e-9 {
+			t.Fatalf("%d %s failed: %v", i+1, rec.Algorithm, got)
+		}
+		t.Log(i+1, "OKAY", rec.Algorithm, got)
+	}
+	if _, err := NewLimitAlgorithm("bbr"); err == nil {
+		t.Fatal("Algorithm failed: unknown is accepted")
+	}
+	t.Log("OK")
+}
+
+//TestAdaptiveShed the lower priorities are shed first, the limit follows the latency
+func TestAdaptiveShed(t *testing.T) {
+	clock := NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))
+	l, err := NewAdaptiveLimiter(&AdaptiveConfig{Algorithm: "aimd", Initial: 4, Min: 2, Max: 5, Timeout: "1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Clock = clock
+
+	//limit 4: low 2, normal 3, high 3.6, critical 4
+	var done []func(bool)
+	mockLists := []struct {
+		Priority string
+		Oks      bool
+	}{
+		{PriorityLow, true},
+		{PriorityLow, true},
+		{PriorityLow, false},
+		{PriorityNormal, true},
+		{PriorityNormal, false},
+		{PriorityHigh, true},
+		{PriorityHigh, false},
+		{PriorityCritical, false},
+	}
+	for i, rec := range mockLists {
+		fn, oks := l.Acquire(rec.Priority)
+		if oks != rec.Oks {
+			t.Fatalf("%d Shed failed: %s", i+1, rec.Priority)
+		}
+		if oks {
+			done = append(done, fn)
+		}
+		t.Log(i+1, "OKAY", rec.Priority, oks)
+	}
+	if st := l.Stats(); st.Inflight != 4 || st.Shed[PriorityLow] != 1 || st.Shed[PriorityNormal] != 1 ||
+		st.Shed[PriorityHigh] != 1 || st.Shed[PriorityCritical] != 1 {
+		t.Fatalf("Stats failed: %+v", st)
+	}
+
+	//fast and busy, grows to the max
+	clock.Advance(100 * time.Millisecond)
+	done[0](false)
+	done[0](false)
+	if st := l.Stats(); st.Limit != 5 || st.Inflight != 3 || st.MinRTT != "100ms" {
+		t.Fatalf("Grow failed: %+v", st)
+	}
+	done[1](false)
+	if st := l.Stats(); st.Limit != 5 {
+		t.Fatalf("Max failed: %+v", st)
+	}
+
+	//over the timeout and failed ones are drops, down to the min
+	clock.Advance(2 * time.Second)
+	done[2](false)
+	done[3](true)
+	if st := l.Stats(); st.Limit != 4 || st.Inflight != 0 {
+		t.Fatalf("Drop failed: %+v", st)
+	}
+	for i := 0; i < 10; i++ {
+		fn, _ := l.Acquire(PriorityCritical)
+		fn(true)
+	}
+	if st := l.Stats(); st.Limit != 2 {
+		t.Fatalf("Min failed: %+v", st)
+	}
+	//critical still gets the whole limit, low never less than 1
+	if _, oks := l.Acquire(PriorityLow); !oks {
+		t.Fatal("Min failed: low is shut out")
+	}
+	t.Log("OK")
+}
+
+//TestLoadShedder the lower classes are dropped first on the in-flight and queued thresholds
+func TestLoadShedder(t *testing.T) {
+	s := NewLoadShedder(4, 10)
+	mockLists := []struct {
+		Class  string
+		Queued int
+		Oks    bool
+	}{
+		{PriorityLow, 0, true},
+		{PriorityLow, 0, true},
+		{PriorityLow, 0, false},
+		{PriorityNormal, 0, true},
+		{PriorityNormal, 0, false},
+		{PriorityCritical, 0, true},
+		{PriorityCritical, 0, false},
+	}
+	var done []func()
+	for i, rec := range mockLists {
+		fn, oks := s.Enter(rec.Class, rec.Queued)
+		if oks != rec.Oks {
+			t.Fatalf("%d Shed failed: %s", i+1, rec.Class)
+		}
+		if oks {
+			done = append(done, fn)
+		}
+		t.Log(i+1, "OKAY", rec.Class, oks)
+	}
+	for _, fn := range done {
+		fn()
+		fn()
+	}
+	//queued ones: low at 5, critical at 10
+	if _, oks := s.Enter(PriorityLow, 5); oks {
+		t.Fatal("Queue failed: low")
+	}
+	if _, oks := s.Enter(PriorityCritical, 9); !oks {
+		t.Fatal("Queue failed: critical")
+	}
+	t.Log("OK")
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+//Clock time source of the windows, the quotas and the history
+type Clock interface {
+	Now() time.Time
+	//After fires once the clock is past d from now
+	After(d time.Duration) <-chan time.Time
+}
+
+//SystemClock the wall clock
+type SystemClock struct{}
+
+//Now current time
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+//After same as time.After
+func (SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+//ManualClock only moves when told, for tests and the simulator
+type ManualClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*clockWaiter
+}
+
+type clockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+//NewManualClock new instance starting at now
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+//Now current time
+func (c *ManualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+//After fires once the clock is moved past d from now
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, &clockWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+//Pending waiters not fired yet, tests wait on it before moving the clock
+func (c *ManualClock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.waiters)
+}
+
+//Advance move the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+//Set move the clock to t, the due waiters are fired
+func (c *ManualClock) Set(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = t
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(t) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- t
+	}
+	c.waiters = pending
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Cost how many tokens a request takes from the policy windows
+//
+//  upfront: header > body_bytes > methods > static (default 1)
+//  settled: response_bytes or latency, after the handler is done
+//
+//0 is free, only negative costs are raised to 0
+type Cost struct {
+	Static        *int           `json:"static"`
+	Methods       map[string]int `json:"methods"`
+	Header        string         `json:"header"`
+	BodyBytes     int64          `json:"body_bytes"`
+	ResponseBytes int64          `json:"response_bytes"`
+	Latency       string         `json:"latency"`
+	Max           int            `json:"max"`
+}
+
+//Upfront tokens to take before the handler runs
+func (c *Cost) Upfront(r *http.Request) int {
+	if c == nil {
+		return 1
+	}
+	n := 1
+	if c.Static != nil {
+		n = *c.Static
+	}
+	if m, oks := c.Methods[strings.ToUpper(r.Method)]; oks {
+		n = m
+	}
+	if c.BodyBytes > 0 && r.ContentLength > 0 {
+		n = int(math.Ceil(float64(r.ContentLength) / float64(c.BodyBytes)))
+	}
+	if c.Header != "" {
+		if v, err := strconv.Atoi(strings.TrimSpace(r.Header.Get(c.Header))); err == nil && v >= 0 {
+			n = v
+		}
+	}
+	return c.capped(n)
+}
+
+//Settles check if the cost is only known after the handler
+func (c *Cost) Settles() bool {
+	return c != nil && (c.ResponseBytes > 0 || c.latency() > 0)
+}
+
+//Settle final tokens based on what the handler did, upfront if not configured
+func (c *Cost) Settle(upfront int, written int64, took time.Duration) int {
+	if !c.Settles() {
+		return upfront
+	}
+	n := 0
+	if c.ResponseBytes > 0 {
+		n = int(math.Ceil(float64(written) / float64(c.ResponseBytes)))
+	}
+	if d := c.latency(); d > 0 {
+		if v := int(math.Ceil(float64(took) / float64(d))); v > n {
+			n = v
+		}
+	}
+	return c.capped(n)
+}
+
+func (c *Cost) latency() time.Duration {
+	if c.Latency == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(c.Latency)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (c *Cost) capped(n int) int {
+	if n < 0 {
+		n = 0
+	}
+	if c.Max > 0 && n > c.Max {
+		n = c.Max
+	}
+	return n
+}
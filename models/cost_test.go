@@ -0,0 +1,77 @@
+package models
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//TestCostUpfront header > body_bytes > methods > static, 0 is free
+func TestCostUpfront(t *testing.T) {
+	zero, three := 0, 3
+	mockLists := []struct {
+		Cost   *Cost
+		Method string
+		Body   string
+		Header string
+		Want   int
+	}{
+		{nil, "GET", "", "", 1},
+		{&Cost{}, "GET", "", "", 1},
+		{&Cost{Static: &three}, "GET", "", "", 3},
+		{&Cost{Static: &zero}, "GET", "", "", 0},
+		{&Cost{Static: &three, Methods: map[string]int{"POST": 10, "GET": 0}}, "post", "", "", 10},
+		{&Cost{Static: &three, Methods: map[string]int{"POST": 10, "GET": 0}}, "GET", "", "", 0},
+		//1 per 4 bytes, rounded up
+		{&Cost{BodyBytes: 4, Methods: map[string]int{"POST": 10}}, "POST", "123456789", "", 3},
+		{&Cost{BodyBytes: 4}, "POST", "", "", 1},
+		{&Cost{Header: "X-Request-Cost", BodyBytes: 4}, "POST", "123456789", "7", 7},
+		{&Cost{Header: "X-Request-Cost"}, "GET", "", "0", 0},
+		//bad or negative values are ignored
+		{&Cost{Header: "X-Request-Cost", Static: &three}, "GET", "", "-5", 3},
+		{&Cost{Header: "X-Request-Cost", Static: &three}, "GET", "", "lots", 3},
+		{&Cost{Header: "X-Request-Cost", Max: 50}, "GET", "", "500", 50},
+		{&Cost{Methods: map[string]int{"GET": -2}}, "GET", "", "", 0},
+	}
+	for i, rec := range mockLists {
+		r := httptest.NewRequest(rec.Method, "/v1/api/request/x", strings.NewReader(rec.Body))
+		if rec.Header != "" {
+			r.Header.Set("X-Request-Cost", rec.Header)
+		}
+		if got := rec.Cost.Upfront(r); got != rec.Want {
+			t.Fatalf("%d Upfront failed: %d", i+1, got)
+		}
+		t.Log(i+1, "OKAY", rec.Want)
+	}
+	t.Log("OK")
+}
+
+//TestCostSettle response size and latency, the bigger of the 2
+func TestCostSettle(t *testing.T) {
+	mockLists := []struct {
+		Cost    *Cost
+		Upfront int
+		Written int64
+		Took    time.Duration
+		Want    int
+	}{
+		{nil, 2, 5000, time.Second, 2},
+		{&Cost{}, 2, 5000, time.Second, 2},
+		{&Cost{ResponseBytes: 1024}, 1, 5000, time.Second, 5},
+		{&Cost{ResponseBytes: 1024}, 1, 0, time.Second, 0},
+		{&Cost{Latency: "250ms"}, 1, 5000, 600 * time.Millisecond, 3},
+		{&Cost{Latency: "250ms", ResponseBytes: 1024}, 1, 5000, 600 * time.Millisecond, 5},
+		{&Cost{Latency: "250ms", ResponseBytes: 1024}, 1, 100, 2 * time.Second, 8},
+		{&Cost{Latency: "250ms", Max: 4}, 1, 0, 2 * time.Second, 4},
+		//invalid latency is off
+		{&Cost{Latency: "slow"}, 2, 0, 2 * time.Second, 2},
+	}
+	for i, rec := range mockLists {
+		if got := rec.Cost.Settle(rec.Upfront, rec.Written, rec.Took); got != rec.Want {
+			t.Fatalf("%d Settle failed: %d", i+1, got)
+		}
+		t.Log(i+1, "OKAY", rec.Want)
+	}
+	t.Log("OK")
+}
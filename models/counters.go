@@ -0,0 +1,289 @@
+package models
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	//CounterShards default number of shards, each with its own lock
+	CounterShards = 64
+	//CounterMaxEntries default cap of window slots over all shards
+	CounterMaxEntries = 1 << 20
+	//SketchWidth, SketchDepth default count-min size per shard
+	SketchWidth = 2048
+	SketchDepth = 4
+)
+
+//CounterConfig in-process window counters
+//
+//  shards      = number of locks (default 64)
+//  max_entries = cap of window slots, least recently used are evicted (default 1048576)
+//  sketch      = evicted counts are kept in a count-min sketch per shard and window end,
+//                restored if the key comes back before the window ends, less the noise
+//                of the other keys so a scan of 1-hit keys does not deny the new ones;
+//                on by default
+type CounterConfig struct {
+	Shards      int   `json:"shards"`
+	MaxEntries  int   `json:"max_entries"`
+	Sketch      *bool `json:"sketch"`
+	SketchWidth int   `json:"sketch_width"`
+	SketchDepth int   `json:"sketch_depth"`
+}
+
+//ShardedCounters window slots split by counting key, bounded in memory
+type ShardedCounters struct {
+	shards []*counterShard
+
+	//Metrics evictions and restores
+	Metrics *Metrics
+}
+
+//NewShardedCounters new instance, defaults if nil
+func NewShardedCounters(cfg *CounterConfig) *ShardedCounters {
+	if cfg == nil {
+		cfg = &CounterConfig{}
+	}
+	n := cfg.Shards
+	if n <= 0 {
+		n = CounterShards
+	}
+	max := cfg.MaxEntries
+	if max <= 0 {
+		max = CounterMaxEntries
+	}
+	//room for all the windows of a policy
+	perShard := max / n
+	if perShard < 16 {
+		perShard = 16
+	}
+	width, depth := cfg.SketchWidth, cfg.SketchDepth
+	if width <= 0 {
+		width = SketchWidth
+	}
+	if depth <= 0 {
+		depth = SketchDepth
+	}
+	if cfg.Sketch != nil && !*cfg.Sketch {
+		width, depth = 0, 0
+	}
+	c := &ShardedCounters{shards: make([]*counterShard, n)}
+	for i := range c.shards {
+		c.shards[i] = &counterShard{
+			counters: c,
+			entries:  make(map[string]*list.Element),
+			sketches: make(map[int64]*countMin),
+			lru:      list.New(),
+			max:      perShard,
+			width:    width,
+			depth:    depth,
+		}
+	}
+	return c
+}
+
+//shard of the counting key, all the windows of a key are on the same shard
+func (c *ShardedCounters) shard(key string) *counterShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+//Sweep drop the slots and the sketches of the windows that already ended
+func (c *ShardedCounters) Sweep(now time.Time) {
+	for _, sh := range c.shards {
+		sh.lock.Lock()
+		for e := sh.lru.Front(); e != nil; {
+			next := e.Next()
+			if ent := e.Value.(*counterEntry); !now.Before(ent.slot.Expires) {
+				sh.remove(e)
+			}
+			e = next
+		}
+		for end := range sh.sketches {
+			if !now.Before(time.Unix(0, end)) {
+				delete(sh.sketches, end)
+			}
+		}
+		sh.lock.Unlock()
+	}
+}
+
+//Reset drop everything
+func (c *ShardedCounters) Reset() {
+	for _, sh := range c.shards {
+		sh.lock.Lock()
+		sh.entries = make(map[string]*list.Element)
+		sh.lru.Init()
+		sh.sketches = make(map[int64]*countMin)
+		if sh.dirty != nil {
+			sh.dirty = make(map[string]struct{})
+		}
+		sh.lock.Unlock()
+	}
+}
+
+//trackDirty keep the keys of the slots with pending hits from now on
+func (c *ShardedCounters) trackDirty() {
+	for _, sh := range c.shards {
+		sh.lock.Lock()
+		if sh.dirty == nil {
+			sh.dirty = make(map[string]struct{})
+		}
+		sh.lock.Unlock()
+	}
+}
+
+//Len window slots over all shards
+func (c *ShardedCounters) Len() int {
+	n := 0
+	for _, sh := range c.shards {
+		sh.lock.Lock()
+		n += len(sh.entries)
+		sh.lock.Unlock()
+	}
+	return n
+}
+
+type counterEntry struct {
+	key  string
+	slot *WindowCount
+	//restored from the sketch, not to be added again on eviction
+	restored int
+}
+
+type counterShard struct {
+	counters *ShardedCounters
+	lock     sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	max      int
+
+	//dirty slots with pending hits, only tracked for the hybrid sync
+	dirty map[string]struct{}
+
+	//sketches evicted counts by the end of their window, a slot key has
+	//only 1 window end so only its sketch is looked up
+	width, depth int
+	sketches     map[int64]*countMin
+}
+
+//get the slot, marked as recently used
+func (s *counterShard) get(key string) (*WindowCount, bool) {
+	e, oks := s.entries[key]
+	if !oks {
+		return nil, false
+	}
+	s.lru.MoveToFront(e)
+	return e.Value.(*counterEntry).slot, true
+}
+
+//fresh slot, starts from what was evicted before if any
+func (s *counterShard) fresh(key string, expires time.Time) *WindowCount {
+	return &WindowCount{Count: s.estimate(key, expires), Expires: expires}
+}
+
+//put add or replace the slot, the least recently used are evicted over the cap
+func (s *counterShard) put(key string, slot *WindowCount) {
+	if e, oks := s.entries[key]; oks {
+		s.remove(e)
+	}
+	s.entries[key] = s.lru.PushFront(&counterEntry{key: key, slot: slot, restored: slot.Count})
+	if slot.Count > 0 {
+		s.counters.Metrics.Add("counters::restores", 1)
+	}
+	for len(s.entries) > s.max {
+		e := s.lru.Back()
+		ent := e.Value.(*counterEntry)
+		if n := ent.slot.Count - ent.restored; n > 0 && s.width > 0 {
+			end := ent.slot.Expires.UnixNano()
+			if s.sketches[end] == nil {
+				s.sketches[end] = newCountMin(s.width, s.depth)
+			}
+			s.sketches[end].add(ent.key, n)
+		}
+		s.remove(e)
+		s.counters.Metrics.Add("counters::evictions", 1)
+	}
+}
+
+func (s *counterShard) remove(e *list.Element) {
+	key := e.Value.(*counterEntry).key
+	delete(s.entries, key)
+	delete(s.dirty, key)
+	s.lru.Remove(e)
+}
+
+//add n to the slot of the key, marked as dirty if tracked
+func (s *counterShard) add(key string, slot *WindowCount, n int) {
+	slot.add(n)
+	if s.dirty != nil {
+		s.dirty[key] = struct{}{}
+	}
+}
+
+func (s *counterShard) estimate(key string, expires time.Time) int {
+	if sketch, oks := s.sketches[expires.UnixNano()]; oks {
+		return sketch.estimate(key)
+	}
+	return 0
+}
+
+//countMin approximate counts of the long tail, conservative update
+type countMin struct {
+	width int
+	rows  [][]uint32
+	//total all the counts added, total/width is the noise floor of a cell
+	total int
+}
+
+func newCountMin(width, depth int) *countMin {
+	rows := make([][]uint32, depth)
+	for i := range rows {
+		rows[i] = make([]uint32, width)
+	}
+	return &countMin{width: width, rows: rows}
+}
+
+//index double hashing, 1 cell per row
+func (c *countMin) index(key string, row int) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	return int((h1 + uint32(row)*h2) % uint32(c.width))
+}
+
+//add raise only the cells below the new estimate of the key
+func (c *countMin) add(key string, n int) {
+	want := uint32(c.min(key) + n)
+	for i, row := range c.rows {
+		if j := c.index(key, i); row[j] < want {
+			row[j] = want
+		}
+	}
+	c.total += n
+}
+
+//estimate count of the key less the noise floor, 0 for the keys lost in the noise
+func (c *countMin) estimate(key string) int {
+	if n := c.min(key) - c.total/c.width; n > 0 {
+		return n
+	}
+	return 0
+}
+
+func (c *countMin) min(key string) int {
+	min := -1
+	for i, row := range c.rows {
+		if v := int(row[c.index(key, i)]); min < 0 || v < min {
+			min = v
+		}
+	}
+	if min < 0 {
+		return 0
+	}
+	return min
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+//TestShardedCounters entry cap, eviction to the sketch and restore till the window ends
+func TestShardedCounters(t *testing.T) {
+	off := false
+	mockLists := []struct {
+		Config   *CounterConfig
+		Restored int
+	}{
+		{&CounterConfig{Shards: 1, MaxEntries: 16}, 6},
+		//evicted counts are lost
+		{&CounterConfig{Shards: 1, MaxEntries: 16, Sketch: &off}, 1},
+	}
+	for i, rec := range mockLists {
+		clock := NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))
+		h := NewTrackerIPHistory()
+		h.Clock = clock
+		h.Counters = NewShardedCounters(rec.Config)
+		h.Counters.Metrics = NewMetrics()
+		p := NewPolicy("counters-test", "", 100, "hour")
+
+		for n := 0; n < 5; n++ {
+			h.Allow("a", p, 1)
+		}
+		//a is the least recently used
+		for n := 0; n < 20; n++ {
+			h.Allow(fmt.Sprintf("b%d", n), p, 1)
+		}
+		if got := h.Counters.Len(); got != 16 {
+			t.Fatalf("%d Len failed: %d", i+1, got)
+		}
+		if got := h.Counters.Metrics.Count("counters::evictions"); got != 5 {
+			t.Fatalf("%d Evictions failed: %d", i+1, got)
+		}
+
+		//sweeps before the hour ends keep the sketch
+		for n := 0; n < 5; n++ {
+			clock.Advance(time.Minute)
+			h.SweepQ(clock.Now())
+		}
+		if dec := h.Allow("a", p, 1); dec.Used != rec.Restored {
+			t.Fatalf("%d Restore failed: %d", i+1, dec.Used)
+		}
+		if got := h.Counters.Metrics.Count("counters::restores"); (got == 1) != (rec.Restored > 1) {
+			t.Fatalf("%d Restores failed: %d", i+1, got)
+		}
+
+		//next hour, slots and sketches are gone
+		clock.Advance(time.Hour)
+		h.SweepQ(clock.Now())
+		if got := h.Counters.Len(); got != 0 {
+			t.Fatalf("%d Sweep failed: %d", i+1, got)
+		}
+		if got := len(h.Counters.shards[0].sketches); got != 0 {
+			t.Fatalf("%d Sweep failed: %d sketches", i+1, got)
+		}
+		if dec := h.Allow("a", p, 1); dec.Used != 1 {
+			t.Fatalf("%d Window failed: %d", i+1, dec.Used)
+		}
+		h.ResetQ()
+		if got := h.Counters.Len(); got != 0 {
+			t.Fatalf("%d Reset failed: %d", i+1, got)
+		}
+		t.Log(i+1, "OKAY", rec.Restored)
+	}
+	t.Log("OK")
+}
+
+//TestCountersScan a scan of 1-hit keys fills the sketch, a new key still starts from 0
+func TestCountersScan(t *testing.T) {
+	h := NewTrackerIPHistory()
+	h.Clock = NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))
+	h.Counters = NewShardedCounters(&CounterConfig{Shards: 1, MaxEntries: 16, SketchWidth: 64})
+	p := NewPolicy("scan-test", "", 5, "hour")
+
+	//an evicted key over its limit is still restored
+	for n := 0; n < 5; n++ {
+		h.Allow("10.9.9.9", p, 1)
+	}
+	for n := 0; n < 16; n++ {
+		h.Allow(fmt.Sprintf("10.8.0.%d", n), p, 1)
+	}
+	if dec := h.Allow("10.9.9.9", p, 1); dec.Allowed {
+		t.Fatalf("Restore failed: %d", dec.Used)
+	}
+	t.Log("OKAY", "restored")
+
+	for n := 0; n < 50000; n++ {
+		h.Allow(fmt.Sprintf("10.%d.%d.%d", n>>16, (n>>8)&0xff, n&0xff), p, 1)
+	}
+	for i, ip := range []string{"192.0.2.1", "192.0.2.2", "198.51.100.7", "203.0.113.9"} {
+		if dec := h.Allow(ip, p, 1); !dec.Allowed || dec.Used > 2 {
+			t.Fatalf("%d Scan failed: %s %d", i+1, ip, dec.Used)
+		}
+		t.Log(i+1, "OKAY", ip)
+	}
+	t.Log("OK")
+}
@@ -0,0 +1,200 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	//FailureKeyIP failures per client ip
+	FailureKeyIP = "ip"
+	//FailureKeyUsername failures per username, from any ip
+	FailureKeyUsername = "username"
+	//FailureKeyIPUsername failures per ip and username
+	FailureKeyIPUsername = "ip_username"
+
+	//UsernameField default json field of the username on the request body
+	UsernameField = "username"
+
+	//StatusFailed history status of a request with a failure status
+	StatusFailed = "Failed"
+
+	failHeadIP         = "fail::ip::"
+	failHeadUsername   = "fail::user::"
+	failHeadIPUsername = "fail::ip_user::"
+)
+
+//CountsFailures check if only the failed responses are counted (failure_statuses)
+//
+//  failure_statuses = responses counted on the windows, ie: [401, 403, 422]
+//  failure_keys     = ip, username and/or ip_username (default all)
+//  username_field   = json field of the request body (default "username")
+//  username_header  = header of the username, before the body
+//  lockout          = denied for this long once a window is used up (default till the window resets)
+func (p *Policy) CountsFailures() bool {
+	return len(p.FailureStatuses) > 0
+}
+
+//IsFailure check if the response status is counted
+func (p *Policy) IsFailure(status int) bool {
+	for _, s := range p.FailureStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+//LockoutDuration denied time once a window is used up, 0 if none
+func (p *Policy) LockoutDuration() time.Duration {
+	d, err := time.ParseDuration(p.Lockout)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+//FailureKeysOf counter keys of the ip and username, the ones with an empty part are left out
+func (p *Policy) FailureKeysOf(ip, username string) []string {
+	dims := p.FailureKeys
+	if len(dims) == 0 {
+		dims = []string{FailureKeyIP, FailureKeyUsername, FailureKeyIPUsername}
+	}
+	username = strings.ToLower(username)
+	var all []string
+	for _, dim := range dims {
+		switch {
+		case dim == FailureKeyIP && ip != "":
+			all = append(all, failHeadIP+ip)
+		case dim == FailureKeyUsername && username != "":
+			all = append(all, failHeadUsername+username)
+		case dim == FailureKeyIPUsername && ip != "" && username != "":
+			all = append(all, failHeadIPUsername+ip+"::"+username)
+		}
+	}
+	return all
+}
+
+//ParseFailureKey dimension, ip and username of a key of FailureKeysOf; the ip of an
+//ip+username key is the shortest part that is an ip, so ipv6 and usernames with "::" still split
+func ParseFailureKey(key string) (dim, ip, username string, oks bool) {
+	switch {
+	case strings.HasPrefix(key, failHeadIP):
+		return FailureKeyIP, strings.TrimPrefix(key, failHeadIP), "", true
+	case strings.HasPrefix(key, failHeadUsername):
+		return FailureKeyUsername, "", strings.TrimPrefix(key, failHeadUsername), true
+	case !strings.HasPrefix(key, failHeadIPUsername):
+		return "", "", "", false
+	}
+	rest := strings.TrimPrefix(key, failHeadIPUsername)
+	first := -1
+	for i := 1; i+2 < len(rest); i++ {
+		if rest[i:i+2] != "::" {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		if net.ParseIP(rest[:i]) != nil {
+			return FailureKeyIPUsername, rest[:i], rest[i+2:], true
+		}
+	}
+	//not an ip, the 1st separator
+	if first < 0 {
+		return "", "", "", false
+	}
+	return FailureKeyIPUsername, rest[:first], rest[first+2:], true
+}
+
+//MaxLimit biggest window limit, enough to clear all the windows of a key
+func (p *Policy) MaxLimit() int {
+	max := 0
+	for _, w := range p.Windows {
+		if w != nil && w.Limit > max {
+			max = w.Limit
+		}
+	}
+	return max
+}
+
+func (p *Policy) validateFailures() error {
+	for _, s := range p.FailureStatuses {
+		if s < 100 || s > 599 {
+			return fmt.Errorf("policy %q: invalid failure status %d", p.Name, s)
+		}
+	}
+	for _, dim := range p.FailureKeys {
+		if dim != FailureKeyIP && dim != FailureKeyUsername && dim != FailureKeyIPUsername {
+			return fmt.Errorf("policy %q: invalid failure key %q", p.Name, dim)
+		}
+	}
+	if p.Lockout != "" {
+		if d, err := time.ParseDuration(p.Lockout); err != nil || d < 0 {
+			return fmt.Errorf("policy %q: invalid lockout %q", p.Name, p.Lockout)
+		}
+	}
+	return nil
+}
+
+//Lockout 1 locked key of a policy
+type Lockout struct {
+	Policy string
+	Key    string
+}
+
+//LockoutTracker locked failure keys on the shared counters, so all the instances see them
+type LockoutTracker struct {
+	store CounterStore
+	Keys  *KeySpace
+	Clock Clock
+}
+
+//NewLockoutTracker new instance
+func NewLockoutTracker(store CounterStore) *LockoutTracker {
+	return &LockoutTracker{
+		store: store,
+		Keys:  DefaultKeys,
+		Clock: SystemClock{},
+	}
+}
+
+func (t *LockoutTracker) key(policy, key string) string {
+	return t.Keys.Join(t.Keys.Lockout, policy, key)
+}
+
+//Lock the key of the policy for d
+func (t *LockoutTracker) Lock(policy, key string, d time.Duration) error {
+	return t.store.Add([]*CounterDelta{{Key: t.key(policy, key), N: 1, Expires: t.Clock.Now().Add(d)}})
+}
+
+//Locked check if the key of the policy is locked
+func (t *LockoutTracker) Locked(policy, key string) (bool, error) {
+	n, err := t.store.Get(t.key(policy, key))
+	return n > 0, err
+}
+
+//Unlock the key of the policy, false if it was not locked
+func (t *LockoutTracker) Unlock(policy, key string) (bool, error) {
+	n, _, err := t.store.Take(t.key(policy, key))
+	return n > 0, err
+}
+
+//List the locked keys
+func (t *LockoutTracker) List() ([]*Lockout, error) {
+	head := t.Keys.Lockout + t.Keys.Sep
+	keys, err := t.store.Keys(head)
+	if err != nil {
+		return nil, err
+	}
+	all := make([]*Lockout, 0, len(keys))
+	for _, k := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(k, head), t.Keys.Sep, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		all = append(all, &Lockout{Policy: parts[0], Key: parts[1]})
+	}
+	return all, nil
+}
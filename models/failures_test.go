@@ -0,0 +1,50 @@
+package models
+
+import (
+	"testing"
+)
+
+//TestParseFailureKey keys of FailureKeysOf split back to the ip and username
+func TestParseFailureKey(t *testing.T) {
+	p := &Policy{Name: "login", FailureStatuses: []int{401}}
+	mockLists := []struct {
+		IP       string
+		Username string
+	}{
+		{"10.1.2.3", "jerry"},
+		{"2001:db8::1", "jerry"},
+		{"fe80::", "jerry"},
+		{"::", "ben"},
+		//usernames are taken as sent
+		{"10.1.2.3", "ben::jerry"},
+		{"2001:db8::1", "1::2"},
+	}
+	for i, rec := range mockLists {
+		keys := p.FailureKeysOf(rec.IP, rec.Username)
+		if len(keys) != 3 {
+			t.Fatalf("%d FailureKeysOf failed: %v", i+1, keys)
+		}
+		for j, want := range []struct{ Dim, IP, Username string }{
+			{FailureKeyIP, rec.IP, ""},
+			{FailureKeyUsername, "", rec.Username},
+			{FailureKeyIPUsername, rec.IP, rec.Username},
+		} {
+			dim, ip, username, oks := ParseFailureKey(keys[j])
+			if !oks || dim != want.Dim || ip != want.IP || username != want.Username {
+				t.Fatalf("%d ParseFailureKey failed: %q %q %q %q", i+1, keys[j], dim, ip, username)
+			}
+		}
+		t.Log(i+1, "OKAY", keys[2])
+	}
+
+	//another ipv6 of the same head is not the ip
+	if _, ip, _, _ := ParseFailureKey("fail::ip_user::2001:db8::1::jerry"); ip == "2001:db8" {
+		t.Fatal("ParseFailureKey failed: prefix of the ip")
+	}
+	for _, key := range []string{"fail::ip_user::10.1.2.3", "THROTTLE::LOCKOUT::x", "fail::ip_user::::"} {
+		if _, _, _, oks := ParseFailureKey(key); oks {
+			t.Fatalf("ParseFailureKey failed: %q is taken", key)
+		}
+	}
+	t.Log("OK")
+}
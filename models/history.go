@@ -0,0 +1,401 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/driver"
+)
+
+const (
+	//HistoryBatchSize default records per insert
+	HistoryBatchSize = 500
+	//HistoryFlushInterval default max wait of a partial batch
+	HistoryFlushInterval = time.Second
+	//HistoryLoadWindow records loaded from mysql, older ones via Range
+	HistoryLoadWindow = 24 * time.Hour
+)
+
+//BatchHistoryStore history store that saves many records at once
+type BatchHistoryStore interface {
+	HistoryStore
+	//SaveBatch add the records under their unique ids
+	SaveBatch(ids []string, infos []*TrackerIP) error
+	//BatchSize max records per batch
+	BatchSize() int
+	//FlushInterval max wait of a partial batch
+	FlushInterval() time.Duration
+}
+
+//HistoryReporter history store with the aggregate reports
+type HistoryReporter interface {
+	//Report counts of the records within from and to, top n denied ips
+	Report(from, to time.Time, top int) (*HistoryReport, error)
+}
+
+//HistoryCount 1 group of the report
+type HistoryCount struct {
+	Name  string
+	Count int64
+}
+
+//HistoryPolicyCount records of 1 policy by status
+type HistoryPolicyCount struct {
+	Policy string
+	Counts map[string]int64
+}
+
+//HistoryReport aggregate of the records
+type HistoryReport struct {
+	From      string
+	To        string
+	Total     int64
+	Statuses  []*HistoryCount
+	Policies  []*HistoryPolicyCount
+	TopDenied []*HistoryCount
+	Hourly    []*HistoryCount
+}
+
+//MultiHistoryStore save to all, load and report from the 1st that can
+type MultiHistoryStore []HistoryStore
+
+//Save add the record to all
+func (m MultiHistoryStore) Save(id string, info *TrackerIP) error {
+	return m.SaveBatch([]string{id}, []*TrackerIP{info})
+}
+
+//SaveBatch add the records to all, 1 by 1 on the stores without batches
+func (m MultiHistoryStore) SaveBatch(ids []string, infos []*TrackerIP) error {
+	var failed []string
+	for _, s := range m {
+		if b, oks := s.(BatchHistoryStore); oks {
+			if err := b.SaveBatch(ids, infos); err != nil {
+				failed = append(failed, err.Error())
+			}
+			continue
+		}
+		for i := range infos {
+			if err := s.Save(ids[i], infos[i]); err != nil {
+				failed = append(failed, err.Error())
+				break
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("history: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+//BatchSize largest of the stores, 1 if none has batches
+func (m MultiHistoryStore) BatchSize() int {
+	size := 1
+	for _, s := range m {
+		if b, oks := s.(BatchHistoryStore); oks && b.BatchSize() > size {
+			size = b.BatchSize()
+		}
+	}
+	return size
+}
+
+//FlushInterval shortest of the stores
+func (m MultiHistoryStore) FlushInterval() time.Duration {
+	interval := HistoryFlushInterval
+	for i, s := range m {
+		if b, oks := s.(BatchHistoryStore); oks && (i == 0 || b.FlushInterval() < interval) {
+			interval = b.FlushInterval()
+		}
+	}
+	return interval
+}
+
+//Load the records of the 1st store
+func (m MultiHistoryStore) Load() ([]*TrackerIP, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	return m[0].Load()
+}
+
+//Report of the 1st store that has reports
+func (m MultiHistoryStore) Report(from, to time.Time, top int) (*HistoryReport, error) {
+	for _, s := range m {
+		if r, oks := s.(HistoryReporter); oks {
+			return r.Report(from, to, top)
+		}
+	}
+	return nil, ErrNoHistoryReport
+}
+
+//ErrNoHistoryReport the history store has no reports
+var ErrNoHistoryReport = fmt.Errorf("history: store has no reports")
+
+//MysqlHistoryConfig history on mysql, the credentials are the mysql config
+//
+//  batch_size     = records per insert (default 500)
+//  flush_interval = max wait of a partial batch (default "1s")
+type MysqlHistoryConfig struct {
+	BatchSize     int    `json:"batch_size"`
+	FlushInterval string `json:"flush_interval"`
+	//KeepRedis also save to redis (history_store both)
+	KeepRedis bool                      `json:"-"`
+	Db        *driver.DbConnectorConfig `json:"-"`
+}
+
+//Validate sanity check
+func (c *MysqlHistoryConfig) Validate() error {
+	if c.BatchSize < 0 {
+		return fmt.Errorf("history: invalid batch_size %d", c.BatchSize)
+	}
+	if c.FlushInterval != "" {
+		if d, err := time.ParseDuration(c.FlushInterval); err != nil || d <= 0 {
+			return fmt.Errorf("history: invalid flush_interval %q", c.FlushInterval)
+		}
+	}
+	return nil
+}
+
+//Interval flush interval, default if not set
+func (c *MysqlHistoryConfig) Interval() time.Duration {
+	if d, err := time.ParseDuration(c.FlushInterval); err == nil && d > 0 {
+		return d
+	}
+	return HistoryFlushInterval
+}
+
+//MysqlHistoryStore records on the throttle_events table
+type MysqlHistoryStore struct {
+	dbh       *sql.DB
+	batchSize int
+	interval  time.Duration
+}
+
+//NewMysqlHistoryStore new instance, the table is made by the migrations
+func NewMysqlHistoryStore(dbh *sql.DB, cfg *MysqlHistoryConfig) *MysqlHistoryStore {
+	if cfg == nil {
+		cfg = &MysqlHistoryConfig{}
+	}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = HistoryBatchSize
+	}
+	return &MysqlHistoryStore{dbh: dbh, batchSize: batchSize, interval: cfg.Interval()}
+}
+
+//BatchSize max records per insert
+func (s *MysqlHistoryStore) BatchSize() int {
+	return s.batchSize
+}
+
+//FlushInterval max wait of a partial batch
+func (s *MysqlHistoryStore) FlushInterval() time.Duration {
+	return s.interval
+}
+
+//Save add the record
+func (s *MysqlHistoryStore) Save(id string, info *TrackerIP) error {
+	return s.SaveBatch([]string{id}, []*TrackerIP{info})
+}
+
+const historyColumns = `event_id, ip, forwarded_for, url, method, user_agent, referrer, status, policy, request_id, created_at`
+
+//SaveBatch add the records in 1 insert, ids already saved are skipped
+func (s *MysqlHistoryStore) SaveBatch(ids []string, infos []*TrackerIP) error {
+	if len(infos) == 0 {
+		return nil
+	}
+	holders := make([]string, len(infos))
+	args := make([]interface{}, 0, len(infos)*11)
+	for i, info := range infos {
+		holders[i] = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		at, err := time.Parse(time.RFC3339Nano, info.DateTime)
+		if err != nil {
+			at = time.Now()
+		}
+		args = append(args,
+			clip(ids[i], 128),
+			clip(info.IP, 64),
+			clip(info.XForwardedFor, 255),
+			clip(info.URL, 2048),
+			clip(info.Method, 16),
+			clip(info.UserAgent, 512),
+			clip(info.Referrer, 2048),
+			clip(info.Status, 16),
+			clip(info.Policy, 128),
+			clip(info.RequestID, 128),
+			at.UTC(),
+		)
+	}
+	_, err := s.dbh.Exec(`INSERT IGNORE INTO throttle_events (`+historyColumns+`) VALUES `+strings.Join(holders, ", "), args...)
+	return err
+}
+
+//clip to the column size (chars), not within a multi-byte char
+func clip(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+//Load the allowed and denied records of the last HistoryLoadWindow, oldest 1st
+func (s *MysqlHistoryStore) Load() ([]*TrackerIP, error) {
+	var all []*TrackerIP
+	to := time.Now()
+	err := s.Range(to.Add(-HistoryLoadWindow), to, func(trk *TrackerIP) error {
+		all = append(all, trk)
+		return nil
+	})
+	return all, err
+}
+
+//Range pass the allowed and denied records within from and to to fn 1 by 1, oldest 1st;
+//an error of fn stops it
+func (s *MysqlHistoryStore) Range(from, to time.Time, fn func(*TrackerIP) error) error {
+	rows, err := s.dbh.Query(`SELECT ip, forwarded_for, url, method, user_agent, referrer, status, policy, request_id, created_at
+		FROM throttle_events WHERE created_at >= ? AND created_at < ? AND status <> ? ORDER BY created_at`,
+		from.UTC(), to.UTC(), StatusWouldDeny)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var trk TrackerIP
+		var at time.Time
+		if err := rows.Scan(&trk.IP, &trk.XForwardedFor, &trk.URL, &trk.Method, &trk.UserAgent, &trk.Referrer,
+			&trk.Status, &trk.Policy, &trk.RequestID, &at); err != nil {
+			return err
+		}
+		trk.DateTime = at.Format(time.RFC3339Nano)
+		if err := fn(&trk); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//Report counts within from and to
+func (s *MysqlHistoryStore) Report(from, to time.Time, top int) (*HistoryReport, error) {
+	report := &HistoryReport{From: from.Format(time.RFC3339), To: to.Format(time.RFC3339)}
+	from, to = from.UTC(), to.UTC()
+	counts := func(query string, args ...interface{}) ([]*HistoryCount, error) {
+		rows, err := s.dbh.Query(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var all []*HistoryCount
+		for rows.Next() {
+			var c HistoryCount
+			if err := rows.Scan(&c.Name, &c.Count); err != nil {
+				return nil, err
+			}
+			all = append(all, &c)
+		}
+		return all, rows.Err()
+	}
+	var err error
+	if report.Statuses, err = counts(`SELECT status, COUNT(*) FROM throttle_events
+		WHERE created_at >= ? AND created_at < ? GROUP BY status ORDER BY status`, from, to); err != nil {
+		return nil, err
+	}
+	for _, c := range report.Statuses {
+		report.Total += c.Count
+	}
+	if report.TopDenied, err = counts(`SELECT ip, COUNT(*) AS n FROM throttle_events
+		WHERE created_at >= ? AND created_at < ? AND status = 'Denied'
+		GROUP BY ip ORDER BY n DESC, ip LIMIT ?`, from, to, top); err != nil {
+		return nil, err
+	}
+	if report.Hourly, err = counts(`SELECT DATE_FORMAT(created_at, '%Y-%m-%dT%H:00:00Z') AS h, COUNT(*) FROM throttle_events
+		WHERE created_at >= ? AND created_at < ? GROUP BY h ORDER BY h`, from, to); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.dbh.Query(`SELECT policy, status, COUNT(*) FROM throttle_events
+		WHERE created_at >= ? AND created_at < ? GROUP BY policy, status ORDER BY policy, status`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byPolicy := make(map[string]*HistoryPolicyCount)
+	for rows.Next() {
+		var policy, status string
+		var n int64
+		if err := rows.Scan(&policy, &status, &n); err != nil {
+			return nil, err
+		}
+		report.Policies = policyCount(report.Policies, byPolicy, policy, status, n)
+	}
+	return report, rows.Err()
+}
+
+//policyCount add n to the status of the policy
+func policyCount(all []*HistoryPolicyCount, byPolicy map[string]*HistoryPolicyCount, policy, status string, n int64) []*HistoryPolicyCount {
+	pc, oks := byPolicy[policy]
+	if !oks {
+		pc = &HistoryPolicyCount{Policy: policy, Counts: make(map[string]int64)}
+		byPolicy[policy] = pc
+		all = append(all, pc)
+	}
+	pc.Counts[status] += n
+	return all
+}
+
+//Report counts within from and to, same as the mysql report
+func (s *MemoryHistoryStore) Report(from, to time.Time, top int) (*HistoryReport, error) {
+	report := &HistoryReport{From: from.Format(time.RFC3339), To: to.Format(time.RFC3339)}
+	statuses := make(map[string]int64)
+	denied := make(map[string]int64)
+	hourly := make(map[string]int64)
+	byPolicy := make(map[string]*HistoryPolicyCount)
+	var policies []*HistoryPolicyCount
+	for _, key := range []string{DefaultKeys.IPAllowed, DefaultKeys.IPDenied, DefaultKeys.IPShadow} {
+		for _, trk := range s.Records(key) {
+			at, err := time.Parse(time.RFC3339Nano, trk.DateTime)
+			if err != nil || at.Before(from) || !at.Before(to) {
+				continue
+			}
+			report.Total++
+			statuses[trk.Status]++
+			if trk.Status == "Denied" {
+				denied[trk.IP]++
+			}
+			hourly[at.UTC().Format("2006-01-02T15:00:00Z")]++
+			policies = policyCount(policies, byPolicy, trk.Policy, trk.Status, 1)
+		}
+	}
+	report.Statuses = sortedCounts(statuses, false)
+	report.Hourly = sortedCounts(hourly, false)
+	report.TopDenied = sortedCounts(denied, true)
+	if top >= 0 && len(report.TopDenied) > top {
+		report.TopDenied = report.TopDenied[:top]
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Policy < policies[j].Policy })
+	report.Policies = policies
+	return report, nil
+}
+
+//sortedCounts by name, or by count (desc) then name
+func sortedCounts(m map[string]int64, byCount bool) []*HistoryCount {
+	all := make([]*HistoryCount, 0, len(m))
+	for name, n := range m {
+		all = append(all, &HistoryCount{Name: name, Count: n})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if byCount && all[i].Count != all[j].Count {
+			return all[i].Count > all[j].Count
+		}
+		return all[i].Name < all[j].Name
+	})
+	return all
+}
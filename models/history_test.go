@@ -0,0 +1,31 @@
+package models
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+//TestClip cut to the column size in chars, never within a char
+func TestClip(t *testing.T) {
+	mockLists := []struct {
+		In   string
+		Size int
+		Out  string
+	}{
+		{"GET", 16, "GET"},
+		{"Mozilla/5.0", 7, "Mozilla"},
+		{"日本語のブラウザ", 3, "日本語"},
+		{"naïve", 3, "naï"},
+		{"naïve", 5, "naïve"},
+		{"😀😀😀", 2, "😀😀"},
+		{"abc", 0, ""},
+	}
+	for i, rec := range mockLists {
+		out := clip(rec.In, rec.Size)
+		if out != rec.Out || !utf8.ValidString(out) {
+			t.Fatalf("%d Clip failed: %q", i+1, out)
+		}
+		t.Log(i+1, "OKAY", out)
+	}
+	t.Log("OK")
+}
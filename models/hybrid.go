@@ -0,0 +1,210 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/utils"
+)
+
+const (
+	//HybridSyncInterval default push/pull of the local deltas
+	HybridSyncInterval = 100 * time.Millisecond
+	//HybridLocalShare default share of a window an instance can spend between syncs
+	HybridLocalShare = 0.1
+)
+
+//HybridConfig local counters synced to redis
+//
+//  sync_interval = how often the local deltas are pushed and the totals read back (default 100ms)
+//  local_share   = share of each window limit an instance can spend before it has to
+//                  settle with redis right away, 0 is always redis, 1 is sync interval only (default 0.1)
+type HybridConfig struct {
+	SyncInterval string   `json:"sync_interval"`
+	LocalShare   *float64 `json:"local_share"`
+}
+
+//Validate sanity check
+func (c *HybridConfig) Validate() error {
+	if c.SyncInterval != "" {
+		if d, err := time.ParseDuration(c.SyncInterval); err != nil || d <= 0 {
+			return fmt.Errorf("hybrid: invalid sync_interval %q", c.SyncInterval)
+		}
+	}
+	if c.LocalShare != nil && (*c.LocalShare < 0 || *c.LocalShare > 1) {
+		return fmt.Errorf("hybrid: local_share must be within 0 and 1")
+	}
+	return nil
+}
+
+//HybridLimiter local window counters, the deltas are batched to the counter store
+//(redis or the redis shards) and the totals of all the instances are read back on every sync
+type HybridLimiter struct {
+	*TrackerIPHistory
+	store    CounterStore
+	interval time.Duration
+	share    float64
+	Keys     *KeySpace
+	Metrics  *Metrics
+}
+
+//NewHybridLimiter new instance on top of the tracker counters
+func NewHybridLimiter(h *TrackerIPHistory, store CounterStore, cfg *HybridConfig) *HybridLimiter {
+	l := &HybridLimiter{
+		TrackerIPHistory: h,
+		store:            store,
+		Keys:             DefaultKeys,
+		interval:         HybridSyncInterval,
+		share:            HybridLocalShare,
+	}
+	//only the slots with pending hits are synced
+	h.Counters.trackDirty()
+	if cfg != nil {
+		if d, err := time.ParseDuration(cfg.SyncInterval); err == nil && d > 0 {
+			l.interval = d
+		}
+		if cfg.LocalShare != nil {
+			l.share = *cfg.LocalShare
+		}
+	}
+	return l
+}
+
+//Allow take the cost locally while within the local share, otherwise settle the key with redis first
+func (l *HybridLimiter) Allow(s string, p *Policy, cost int) *Decision {
+	if len(p.Windows) == 0 {
+		return &Decision{Allowed: true, Policy: p.Name, Cost: cost}
+	}
+	dec, keys := l.allow(s, p, cost, true)
+	if keys == nil {
+		return dec
+	}
+
+	//local share is used up
+	l.Metrics.Add("hybrid::flushes", 1)
+	sh := l.Counters.shard(s)
+	if err := l.push(l.snapshot(sh, keys)); err != nil {
+		//fail open on the local counts
+		log.Println("HYBRID", s, err)
+	}
+	dec, _ = l.allow(s, p, cost, false)
+	return dec
+}
+
+//allow the local decision, the slot keys are returned if the local share is used up
+func (l *HybridLimiter) allow(s string, p *Policy, cost int, shared bool) (*Decision, []string) {
+	now := l.Clock.Now()
+	sh := l.Counters.shard(s)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	keys, slots := windowSlots(sh, s, p, now, true)
+	dec := decideSlots(p, slots, cost, now)
+	if !dec.Allowed {
+		return dec, nil
+	}
+	if shared {
+		for i, w := range p.Windows {
+			if float64(slots[i].Pending+cost) > l.share*float64(w.Limit) {
+				return dec, keys
+			}
+		}
+	}
+	for i, slot := range slots {
+		sh.add(keys[i], slot, cost)
+	}
+	dec.key, dec.keys = s, keys
+	utils.Dumper("hybrid::q", s, p.Name, cost, dec.Remaining)
+	return dec, nil
+}
+
+type hybridDelta struct {
+	sh      *counterShard
+	key     string
+	pending int
+	expires time.Time
+}
+
+//snapshot take out the pending hits of the slots, all the dirty ones of the shard if no keys
+func (l *HybridLimiter) snapshot(sh *counterShard, keys []string) []*hybridDelta {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if keys == nil {
+		keys = make([]string, 0, len(sh.dirty))
+		for key := range sh.dirty {
+			keys = append(keys, key)
+		}
+	}
+	var all []*hybridDelta
+	for _, key := range keys {
+		delete(sh.dirty, key)
+		e, oks := sh.entries[key]
+		if !oks {
+			continue
+		}
+		//0 pending still reads back the total
+		slot := e.Value.(*counterEntry).slot
+		all = append(all, &hybridDelta{sh: sh, key: key, pending: slot.Pending, expires: slot.Expires})
+		slot.Pending = 0
+	}
+	return all
+}
+
+//push add the deltas to the store in 1 batch and keep the totals of all the instances
+func (l *HybridLimiter) push(all []*hybridDelta) error {
+	if len(all) == 0 {
+		return nil
+	}
+	deltas := make([]*CounterDelta, len(all))
+	for i, d := range all {
+		deltas[i] = &CounterDelta{Key: l.Keys.Join(l.Keys.Hybrid, d.key), N: int64(d.pending), Expires: d.expires}
+	}
+	err := l.store.Add(deltas)
+	for i, d := range all {
+		d.sh.lock.Lock()
+		if slot, oks := d.sh.entries[d.key]; oks {
+			ent := slot.Value.(*counterEntry)
+			if err != nil {
+				//try again on the next sync
+				ent.slot.Pending += d.pending
+				d.sh.dirty[d.key] = struct{}{}
+			} else {
+				ent.slot.Count = int(deltas[i].Total) + ent.slot.Pending
+			}
+		}
+		d.sh.lock.Unlock()
+	}
+	return err
+}
+
+//Sync push all the pending hits
+func (l *HybridLimiter) Sync() error {
+	var all []*hybridDelta
+	for _, sh := range l.Counters.shards {
+		all = append(all, l.snapshot(sh, nil)...)
+	}
+	l.Metrics.Add("hybrid::syncs", 1)
+	if err := l.push(all); err != nil {
+		l.Metrics.Add("hybrid::sync_errors", 1)
+		return err
+	}
+	return nil
+}
+
+//ManageSync push the local deltas every sync interval
+func (l *HybridLimiter) ManageSync(isReady chan bool) {
+	//ready
+	isReady <- true
+	utils.Dumper("ManageSync::IsReady")
+	for {
+		select {
+		case <-l.Clock.After(l.interval):
+			if err := l.Sync(); err != nil {
+				log.Println("HYBRID_SYNC", err)
+			}
+		case <-l.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+//downStore counter store that can be taken down, counts the pushed deltas
+type downStore struct {
+	*MemoryCounterStore
+	down   bool
+	pushed int
+}
+
+func (s *downStore) Add(all []*CounterDelta) error {
+	if s.down {
+		return errors.New("down: connection refused")
+	}
+	s.pushed += len(all)
+	return s.MemoryCounterStore.Add(all)
+}
+
+//total of the hybrid counters on the store
+func (s *downStore) total(t *testing.T) int64 {
+	keys, err := s.Keys(DefaultKeys.Hybrid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	for _, key := range keys {
+		v, _ := s.Get(key)
+		n += v
+	}
+	return n
+}
+
+func newHybrid(clock Clock, store CounterStore, share float64) *HybridLimiter {
+	h := NewTrackerIPHistory()
+	h.Clock = clock
+	l := NewHybridLimiter(h, store, &HybridConfig{LocalShare: &share})
+	l.Metrics = NewMetrics()
+	return l
+}
+
+//TestHybridLimiter local share, sync of the dirty slots only, re-queue on failure and read back
+func TestHybridLimiter(t *testing.T) {
+
+	clock := NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))
+	store := &downStore{MemoryCounterStore: NewMemoryCounterStore()}
+	store.Clock = clock
+	p := NewPolicy("hybrid-test", "", 10, "minute")
+
+	//half of the limit is spent locally
+	one, two := newHybrid(clock, store, 0.5), newHybrid(clock, store, 0.5)
+	step := func(i int, l *HybridLimiter, allowed bool, used int, total int64) {
+		if dec := l.Allow("10.0.0.1", p, 1); dec.Allowed != allowed || dec.Used != used {
+			t.Fatalf("%d Allow failed: %v %d", i, dec.Allowed, dec.Used)
+		}
+		if got := store.total(t); got != total {
+			t.Fatalf("%d Store failed: %d", i, got)
+		}
+		t.Log(i, "OKAY", allowed, used, total)
+	}
+	for i := 1; i <= 5; i++ {
+		step(i, one, true, i, 0)
+	}
+	//local share is used up, settled right away
+	step(6, one, true, 6, 5)
+
+	//only the dirty slots are pushed
+	if err := one.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	pushed := store.pushed
+	if err := one.Sync(); err != nil || store.pushed != pushed {
+		t.Fatalf("Sync failed: %d pushed again", store.pushed-pushed)
+	}
+
+	//totals of the other instance are read back on its push
+	step(7, two, true, 1, 6)
+	if err := two.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if dec := two.Peek("10.0.0.1", p); dec.Used != 7 {
+		t.Fatalf("Read back failed: %d", dec.Used)
+	}
+
+	//kept for the next sync while the store is down
+	store.down = true
+	step(8, two, true, 8, 7)
+	step(9, two, true, 9, 7)
+	if err := two.Sync(); err == nil || two.Metrics.Count("hybrid::sync_errors") != 1 {
+		t.Fatal("Sync failed: no error")
+	}
+	store.down = false
+	if err := two.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.total(t); got != 9 {
+		t.Fatalf("Re-queue failed: %d", got)
+	}
+	if err := one.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	t.Log("OKAY", "re-queued", store.total(t))
+
+	//local count till the next push, denied ones are not counted
+	step(10, one, true, 7, 9)
+	if err := one.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	step(11, one, false, 10, 10)
+	t.Log("OK")
+}
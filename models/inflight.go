@@ -0,0 +1,268 @@
+package models
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/driver"
+	"github.com/google/uuid"
+	redis "gopkg.in/redis.v3"
+)
+
+const (
+	InflightGlobalKey = "global"
+
+	//InflightStale slots not refreshed for this long are dropped (crashed instances)
+	InflightStale = 2 * time.Minute
+	//InflightRefresh how often the held slots are refreshed, well within the stale time
+	InflightRefresh = InflightStale / 4
+)
+
+//Semaphore counting slots of in-flight requests per key
+type Semaphore interface {
+	//Acquire take 1 slot if below the limit, the token is needed on release
+	Acquire(key string, limit int) (string, bool, error)
+	//Release give back the slot
+	Release(key, token string) error
+	//Refresh keep the slot from going stale, false if it is already gone
+	Refresh(key, token string) (bool, error)
+}
+
+//InflightLimiter cap the in-flight requests per key and globally
+type InflightLimiter struct {
+	Sem    Semaphore
+	Global int
+	//RefreshEvery how often the held slots are refreshed (default InflightRefresh)
+	RefreshEvery time.Duration
+
+	lock    sync.Mutex
+	held    map[*inflightSlot]struct{}
+	quit    chan struct{}
+	closing sync.Once
+}
+
+type inflightSlot struct {
+	key   string
+	token string
+}
+
+//NewInflightLimiter new instance
+func NewInflightLimiter(sem Semaphore, global int) *InflightLimiter {
+	return &InflightLimiter{
+		Sem:          sem,
+		Global:       global,
+		RefreshEvery: InflightRefresh,
+		held:         make(map[*inflightSlot]struct{}),
+		quit:         make(chan struct{}),
+	}
+}
+
+//ManageRefresh refresh the held slots till closed, long requests keep their slots
+func (l *InflightLimiter) ManageRefresh(isReady chan bool) {
+	every := l.RefreshEvery
+	if every <= 0 {
+		every = InflightRefresh
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	isReady <- true
+	for {
+		select {
+		case <-ticker.C:
+			l.Refresh()
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+//Refresh all the held slots
+func (l *InflightLimiter) Refresh() {
+	l.lock.Lock()
+	all := make([]*inflightSlot, 0, len(l.held))
+	for slot := range l.held {
+		all = append(all, slot)
+	}
+	l.lock.Unlock()
+	for _, slot := range all {
+		oks, err := l.Sem.Refresh(slot.key, slot.token)
+		if err != nil {
+			log.Println("INFLIGHT", slot.key, err)
+			continue
+		}
+		if !oks {
+			log.Println("INFLIGHT", slot.key, "slot went stale")
+		}
+	}
+}
+
+//Close stop the refresh manager
+func (l *InflightLimiter) Close() {
+	l.closing.Do(func() { close(l.quit) })
+}
+
+//Enabled check if any slot needs to be taken
+func (l *InflightLimiter) Enabled(limit int) bool {
+	return l != nil && l.Sem != nil && (l.Global > 0 || limit > 0)
+}
+
+//Acquire take the global and the key slots, the release func is safe to call many times
+func (l *InflightLimiter) Acquire(key string, limit int) (func(), bool) {
+	var held []func()
+	release := func() {
+		for _, fn := range held {
+			fn()
+		}
+	}
+	take := func(k string, max int) bool {
+		if max <= 0 {
+			return true
+		}
+		token, oks, err := l.Sem.Acquire(k, max)
+		if err != nil {
+			//fail open
+			log.Println("INFLIGHT", k, err)
+			return true
+		}
+		if oks {
+			slot := &inflightSlot{key: k, token: token}
+			l.lock.Lock()
+			l.held[slot] = struct{}{}
+			l.lock.Unlock()
+			held = append(held, func() {
+				l.lock.Lock()
+				delete(l.held, slot)
+				l.lock.Unlock()
+				if err := l.Sem.Release(k, token); err != nil {
+					log.Println("INFLIGHT", k, err)
+				}
+			})
+		}
+		return oks
+	}
+	if !l.Enabled(limit) {
+		return func() {}, true
+	}
+	if !take(InflightGlobalKey, l.Global) || !take(key, limit) {
+		release()
+		return func() {}, false
+	}
+	var once sync.Once
+	return func() { once.Do(release) }, true
+}
+
+//LocalSemaphore in-process slots
+type LocalSemaphore struct {
+	lock     sync.Mutex
+	inflight map[string]int
+}
+
+//NewLocalSemaphore new instance
+func NewLocalSemaphore() *LocalSemaphore {
+	return &LocalSemaphore{
+		inflight: make(map[string]int),
+	}
+}
+
+//Acquire take 1 slot if below the limit
+func (s *LocalSemaphore) Acquire(key string, limit int) (string, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.inflight[key] >= limit {
+		return "", false, nil
+	}
+	s.inflight[key]++
+	return "", true, nil
+}
+
+//Release give back the slot
+func (s *LocalSemaphore) Release(key, token string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.inflight[key] <= 1 {
+		delete(s.inflight, key)
+		return nil
+	}
+	s.inflight[key]--
+	return nil
+}
+
+//Refresh nothing goes stale in-process
+func (s *LocalSemaphore) Refresh(key, token string) (bool, error) {
+	return true, nil
+}
+
+//inflightAcquireScript drop the stale slots then add 1 if still below the limit
+var inflightAcquireScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZCARD', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[4])
+	redis.call('EXPIRE', KEYS[1], ARGV[5])
+	return 1
+end
+return 0
+`)
+
+//inflightRefreshScript move the slot to now if it is still there
+var inflightRefreshScript = redis.NewScript(`
+if redis.call('ZSCORE', KEYS[1], ARGV[2]) then
+	redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+	redis.call('EXPIRE', KEYS[1], ARGV[3])
+	return 1
+end
+return 0
+`)
+
+//RedisSemaphore slots shared by all instances, 1 sorted set per key
+type RedisSemaphore struct {
+	cache driver.RedisClient
+	Keys  *KeySpace
+}
+
+//NewRedisSemaphore new instance
+func NewRedisSemaphore(cache driver.RedisClient) *RedisSemaphore {
+	return &RedisSemaphore{cache: cache, Keys: DefaultKeys}
+}
+
+func (s *RedisSemaphore) key(k string) string {
+	return s.Keys.Join(s.Keys.Inflight, k)
+}
+
+//Acquire take 1 slot if below the limit
+func (s *RedisSemaphore) Acquire(key string, limit int) (string, bool, error) {
+	now := time.Now()
+	token := uuid.New().String()
+	res, err := inflightAcquireScript.Run(s.cache, []string{s.key(key)}, []string{
+		strconv.FormatInt(now.Add(-InflightStale).UnixNano()/int64(time.Millisecond), 10),
+		strconv.Itoa(limit),
+		strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10),
+		token,
+		strconv.Itoa(int(InflightStale.Seconds())),
+	}).Result()
+	if err != nil {
+		return "", false, err
+	}
+	oks, _ := res.(int64)
+	return token, oks == 1, nil
+}
+
+//Release give back the slot
+func (s *RedisSemaphore) Release(key, token string) error {
+	return s.cache.ZRem(s.key(key), token).Err()
+}
+
+//Refresh move the slot to now, before it goes stale
+func (s *RedisSemaphore) Refresh(key, token string) (bool, error) {
+	res, err := inflightRefreshScript.Run(s.cache, []string{s.key(key)}, []string{
+		strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10),
+		token,
+		strconv.Itoa(int(InflightStale.Seconds())),
+	}).Result()
+	if err != nil {
+		return false, err
+	}
+	oks, _ := res.(int64)
+	return oks == 1, nil
+}
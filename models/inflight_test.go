@@ -0,0 +1,143 @@
+package models
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/driver"
+)
+
+//countingSemaphore local slots that count the refreshes
+type countingSemaphore struct {
+	*LocalSemaphore
+	lock      sync.Mutex
+	refreshed map[string]int
+}
+
+func (s *countingSemaphore) Refresh(key, token string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refreshed[key]++
+	return true, nil
+}
+
+func (s *countingSemaphore) count(key string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.refreshed[key]
+}
+
+//TestInflightLimiter global and per key caps, release is safe to call many times
+func TestInflightLimiter(t *testing.T) {
+	l := NewInflightLimiter(NewLocalSemaphore(), 3)
+	var held []func()
+	mockLists := []struct {
+		Key     string
+		Limit   int
+		Release int
+		Oks     bool
+	}{
+		{"a", 2, -1, true},
+		{"a", 2, -1, true},
+		//key is full
+		{"a", 2, -1, false},
+		{"b", 2, -1, true},
+		//global is full
+		{"b", 2, -1, false},
+		{"c", 0, -1, false},
+		//1 of a is done, twice
+		{"b", 2, 0, true},
+		{"c", 0, 1, true},
+		{"c", 0, -1, false},
+	}
+	for i, rec := range mockLists {
+		if rec.Release >= 0 {
+			held[rec.Release]()
+			held[rec.Release]()
+		}
+		release, oks := l.Acquire(rec.Key, rec.Limit)
+		if oks != rec.Oks {
+			t.Fatalf("%d Acquire failed: %s", i+1, rec.Key)
+		}
+		held = append(held, release)
+		t.Log(i+1, "OKAY", rec.Key, oks)
+	}
+	for _, release := range held {
+		release()
+	}
+	if sem := l.Sem.(*LocalSemaphore); len(sem.inflight) != 0 || len(l.held) != 0 {
+		t.Fatalf("Release failed: %v", sem.inflight)
+	}
+	t.Log("OK")
+}
+
+//TestInflightRefresh held slots are refreshed till released
+func TestInflightRefresh(t *testing.T) {
+	sem := &countingSemaphore{LocalSemaphore: NewLocalSemaphore(), refreshed: make(map[string]int)}
+	l := NewInflightLimiter(sem, 0)
+	l.RefreshEvery = 5 * time.Millisecond
+	isready := make(chan bool, 1)
+	go l.ManageRefresh(isready)
+	<-isready
+	defer l.Close()
+
+	release, oks := l.Acquire("slow", 1)
+	if !oks {
+		t.Fatal("Acquire failed")
+	}
+	for i := 0; i < 200 && sem.count("slow") < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if sem.count("slow") < 3 {
+		t.Fatalf("Refresh failed: %d", sem.count("slow"))
+	}
+	release()
+	done := sem.count("slow")
+	time.Sleep(30 * time.Millisecond)
+	if sem.count("slow") > done+1 {
+		t.Fatalf("Refresh failed: still refreshed %d", sem.count("slow"))
+	}
+	t.Log("OK")
+}
+
+//TestRedisSemaphore on a real redis, REST_API_THROTTLEIP_REDIS=host:port
+func TestRedisSemaphore(t *testing.T) {
+	addr := os.Getenv("REST_API_THROTTLEIP_REDIS")
+	if addr == "" {
+		t.Skip("REST_API_THROTTLEIP_REDIS is not set")
+	}
+	client, err := driver.NewRedisConnector(&driver.RedisConfig{Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sem := NewRedisSemaphore(client)
+	//left over slots expire with the stale time
+	key := "test::" + time.Now().Format("150405.000000")
+
+	first, oks, err := sem.Acquire(key, 2)
+	if err != nil || !oks {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if _, oks, _ = sem.Acquire(key, 2); !oks {
+		t.Fatal("Acquire failed")
+	}
+	if _, oks, _ = sem.Acquire(key, 2); oks {
+		t.Fatal("Acquire failed: over the limit")
+	}
+	if oks, err = sem.Refresh(key, first); err != nil || !oks {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if err = sem.Release(key, first); err != nil {
+		t.Fatal(err)
+	}
+	if oks, _ = sem.Refresh(key, first); oks {
+		t.Fatal("Refresh failed: released slot")
+	}
+	if _, oks, _ = sem.Acquire(key, 2); !oks {
+		t.Fatal("Acquire failed: after release")
+	}
+	t.Log("OK")
+}
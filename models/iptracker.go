@@ -8,16 +8,21 @@ import (
 	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
 )
 
 type TrackerIP struct {
 	IP            string
 	XForwardedFor string
+	Method        string
 	URL           string
 	UserAgent     string
 	Referrer      string
 	Extra         string
 	Status        string
+	Priority      string
+	Policy        string
+	RequestID     string
 	DateTime      string
 }
 
@@ -29,15 +34,74 @@ func (u *TrackerIP) GetIPInfo(ctx context.Context, r *http.Request) *TrackerIP {
 	trk := &TrackerIP{
 		Referrer:      r.Referer(),
 		UserAgent:     r.UserAgent(),
+		Method:        r.Method,
 		URL:           r.URL.String(),
 		XForwardedFor: r.Header.Get("X-Forwarded-For"),
 		Extra:         strings.TrimSpace(chi.URLParam(r, "dummy")),
 		DateTime:      time.Now().Format(time.RFC3339Nano),
 		Status:        "Allowed",
+		Priority:      PriorityFromContext(r.Context()),
+		RequestID:     middleware.GetReqID(r.Context()),
 	}
-	trk.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
-	if trk.XForwardedFor != "" {
-		trk.IP = strings.Split(trk.XForwardedFor, ", ")[0]
-	}
+	//x-forwarded-for is only taken from the trusted proxies (RealIP)
+	trk.IP = PeerIP(r)
 	return trk
 }
+
+//PeerIP ip of the remote addr, the client as far as it can be trusted
+func PeerIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		//no port, ie: already set by the real-ip middleware
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+//ForwardedIP client ip sent by a trusted proxy, empty if the peer is not trusted;
+//the right-most x-forwarded-for entry that is not a trusted proxy, otherwise x-real-ip
+func ForwardedIP(r *http.Request, trusted []*net.IPNet) string {
+	if !inNets(trusted, PeerIP(r)) {
+		return ""
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(hops[i])
+			if net.ParseIP(ip) == nil {
+				//garbage from the client side
+				break
+			}
+			if i == 0 || !inNets(trusted, ip) {
+				return ip
+			}
+		}
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return ""
+}
+
+//ParseCIDRs networks of the list, a plain ip is a single host
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
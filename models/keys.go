@@ -0,0 +1,219 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bayugyug/rest-api-throttleip/driver"
+)
+
+const (
+	//KeyTemplate default layout, same keys as before the namespace
+	KeyTemplate = "THROTTLE{sep}{NAME}"
+	//KeySeparator default separator of the default layout
+	KeySeparator = "::"
+)
+
+//DefaultKeys the fixed keys of a single deployment
+var DefaultKeys, _ = NewKeySpace(nil)
+
+//KeyConfig redis key namespace, so several deployments can share 1 redis
+//
+//  prefix    = put in front of every key, i.e. "shop:"
+//  template  = layout of the keys with {app}, {env} and {name} (lower case) or {NAME}
+//              (upper case), i.e. "{app}:{env}:throttle:{name}"
+//              (default "THROTTLE{sep}{NAME}", same as the old fixed keys)
+//  app, env  = values of {app} and {env}
+//  separator = between the parts of a name and the sub keys, {sep} on the template
+//              (default "::", ":" if there is a template)
+type KeyConfig struct {
+	Prefix    string `json:"prefix"`
+	Template  string `json:"template"`
+	App       string `json:"app"`
+	Env       string `json:"env"`
+	Separator string `json:"separator"`
+}
+
+//Validate sanity check
+func (c *KeyConfig) Validate() error {
+	if c.Template == "" {
+		return nil
+	}
+	if !strings.Contains(c.Template, "{name}") && !strings.Contains(c.Template, "{NAME}") {
+		return errors.New("keys: template needs {name} or {NAME}")
+	}
+	if strings.Contains(c.Template, "{app}") && c.App == "" {
+		return errors.New("keys: template has {app} but app is not set")
+	}
+	if strings.Contains(c.Template, "{env}") && c.Env == "" {
+		return errors.New("keys: template has {env} but env is not set")
+	}
+	return nil
+}
+
+//KeySpace redis keys of 1 deployment; the sub keys (per ip, quota cycle, ...) are
+//joined to the base keys with Sep
+type KeySpace struct {
+	IPAllowed    string
+	IPDenied     string
+	IPShadow     string
+	Hybrid       string
+	Quota        string
+	QuotaOverage string
+	Inflight     string
+	Lockout      string
+	Sep          string
+}
+
+//NewKeySpace keys of the config, the old fixed keys if nil
+func NewKeySpace(cfg *KeyConfig) (*KeySpace, error) {
+	if cfg == nil {
+		cfg = &KeyConfig{}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	tmpl, sep := cfg.Template, cfg.Separator
+	if tmpl == "" {
+		tmpl = KeyTemplate
+		if sep == "" {
+			sep = KeySeparator
+		}
+	}
+	if sep == "" {
+		sep = ":"
+	}
+	name := func(parts ...string) string {
+		s := strings.Replace(tmpl, "{app}", cfg.App, -1)
+		s = strings.Replace(s, "{env}", cfg.Env, -1)
+		s = strings.Replace(s, "{sep}", sep, -1)
+		s = strings.Replace(s, "{name}", strings.ToLower(strings.Join(parts, sep)), -1)
+		s = strings.Replace(s, "{NAME}", strings.ToUpper(strings.Join(parts, sep)), -1)
+		return cfg.Prefix + s
+	}
+	return &KeySpace{
+		IPAllowed:    name("ip", "allowed"),
+		IPDenied:     name("ip", "denied"),
+		IPShadow:     name("ip", "shadow"),
+		Hybrid:       name("hybrid"),
+		Quota:        name("quota"),
+		QuotaOverage: name("quota", "overage"),
+		Inflight:     name("inflight"),
+		Lockout:      name("lockout"),
+		Sep:          sep,
+	}, nil
+}
+
+//Join base key and its sub keys
+func (k *KeySpace) Join(parts ...string) string {
+	return strings.Join(parts, k.Sep)
+}
+
+//History hash of the record based on its status
+func (k *KeySpace) History(info *TrackerIP) string {
+	switch {
+	case strings.EqualFold(info.Status, StatusWouldDeny):
+		return k.IPShadow
+	case info.Denied():
+		return k.IPDenied
+	}
+	return k.IPAllowed
+}
+
+//fixed 1 key each (hashes)
+func (k *KeySpace) fixed() []string {
+	return []string{k.IPAllowed, k.IPDenied, k.IPShadow, k.QuotaOverage}
+}
+
+//prefixed 1 key per sub key
+func (k *KeySpace) prefixed() []string {
+	return []string{k.Hybrid, k.Quota, k.Inflight, k.Lockout}
+}
+
+//KeyMove 1 key to rename
+type KeyMove struct {
+	From string
+	To   string
+	//Conflict the new key is already there, left alone
+	Conflict bool
+}
+
+//KeyMigration report of MigrateKeys
+type KeyMigration struct {
+	Moved     int
+	Conflicts int
+	DryRun    bool
+	Keys      []*KeyMove
+}
+
+//MigrateKeys rename the keys of 1 namespace to another, existing new keys are not
+//overwritten; on a cluster the old and new key must be on the same slot
+func MigrateKeys(cache driver.RedisClient, from, to *KeySpace, dryRun bool) (*KeyMigration, error) {
+	report := &KeyMigration{DryRun: dryRun}
+	var moves []*KeyMove
+	fromFixed, toFixed := from.fixed(), to.fixed()
+	skip := make(map[string]bool)
+	for i := range fromFixed {
+		skip[fromFixed[i]], skip[toFixed[i]] = true, true
+		if fromFixed[i] == toFixed[i] {
+			continue
+		}
+		oks, err := cache.Exists(fromFixed[i]).Result()
+		if err != nil {
+			return report, err
+		}
+		if oks {
+			moves = append(moves, &KeyMove{From: fromFixed[i], To: toFixed[i]})
+		}
+	}
+	fromPrefixed, toPrefixed := from.prefixed(), to.prefixed()
+	for i := range fromPrefixed {
+		if fromPrefixed[i] == toPrefixed[i] && from.Sep == to.Sep {
+			continue
+		}
+		head, newHead := fromPrefixed[i]+from.Sep, toPrefixed[i]+to.Sep
+		var cursor int64
+		for {
+			next, page, err := cache.Scan(cursor, head+"*", 1000).Result()
+			if err != nil {
+				return report, err
+			}
+			for _, key := range page {
+				//already moved, or a fixed key with the same head
+				if skip[key] || strings.HasPrefix(key, newHead) {
+					continue
+				}
+				moves = append(moves, &KeyMove{From: key, To: newHead + strings.TrimPrefix(key, head)})
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+	}
+	for _, m := range moves {
+		report.Keys = append(report.Keys, m)
+		if dryRun {
+			exists, err := cache.Exists(m.To).Result()
+			if err != nil {
+				return report, err
+			}
+			if m.Conflict = exists; !exists {
+				report.Moved++
+			} else {
+				report.Conflicts++
+			}
+			continue
+		}
+		done, err := cache.RenameNX(m.From, m.To).Result()
+		if err != nil {
+			return report, fmt.Errorf("keys: %s: %v", m.From, err)
+		}
+		if m.Conflict = !done; done {
+			report.Moved++
+		} else {
+			report.Conflicts++
+		}
+	}
+	return report, nil
+}
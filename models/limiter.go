@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+//Limiter counts the policy windows per key, used by the middleware and the decision api
+type Limiter interface {
+	//Allow take the cost if all the windows have room
+	Allow(key string, p *Policy, cost int) *Decision
+	//Adjust add n (negative for refund) to the windows of an allowed decision
+	Adjust(dec *Decision, n int)
+	//Peek the tightest window without spending
+	Peek(key string, p *Policy) *Decision
+	//Reserve book the cost on the earliest windows with room within the max wait
+	Reserve(key string, p *Policy, cost int, maxWait time.Duration) *Decision
+	//Refund give back n tokens to the current windows
+	Refund(key string, p *Policy, n int) *Decision
+}
@@ -0,0 +1,294 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//MemoryHistoryStore records kept in-process, for tests and redis-less runs
+type MemoryHistoryStore struct {
+	lock    sync.Mutex
+	records map[string]map[string]*TrackerIP
+}
+
+//NewMemoryHistoryStore new instance
+func NewMemoryHistoryStore() *MemoryHistoryStore {
+	return &MemoryHistoryStore{
+		records: make(map[string]map[string]*TrackerIP),
+	}
+}
+
+//Save add the record
+func (s *MemoryHistoryStore) Save(id string, info *TrackerIP) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := DefaultKeys.History(info)
+	if s.records[key] == nil {
+		s.records[key] = make(map[string]*TrackerIP)
+	}
+	saved := *info
+	s.records[key][id] = &saved
+	return nil
+}
+
+//Load records from the allowed and denied lists
+func (s *MemoryHistoryStore) Load() ([]*TrackerIP, error) {
+	return append(s.Records(DefaultKeys.IPAllowed), s.Records(DefaultKeys.IPDenied)...), nil
+}
+
+//Records of 1 list (the IPAllowed, IPDenied or IPShadow of the DefaultKeys) in id order
+func (s *MemoryHistoryStore) Records(key string) []*TrackerIP {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ids := make([]string, 0, len(s.records[key]))
+	for id := range s.records[key] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	all := make([]*TrackerIP, 0, len(ids))
+	for _, id := range ids {
+		all = append(all, s.records[key][id])
+	}
+	return all
+}
+
+//MemoryQuotaStore quota counters kept in-process, for tests and redis-less runs
+type MemoryQuotaStore struct {
+	lock     sync.Mutex
+	used     map[string]int64
+	expires  map[string]time.Time
+	overages map[string]int64
+	Clock    Clock
+}
+
+//NewMemoryQuotaStore new instance
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{
+		used:     make(map[string]int64),
+		expires:  make(map[string]time.Time),
+		overages: make(map[string]int64),
+		Clock:    SystemClock{},
+	}
+}
+
+//Incr add n to the cycle counter
+func (s *MemoryQuotaStore) Incr(key string, n int64, expires time.Time) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire(key)
+	s.used[key] += n
+	s.expires[key] = expires
+	return s.used[key], nil
+}
+
+//Used current cycle counter
+func (s *MemoryQuotaStore) Used(key string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire(key)
+	return s.used[key], nil
+}
+
+//Flag add to the billing overage
+func (s *MemoryQuotaStore) Flag(key string, n int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.overages[key] += n
+	return nil
+}
+
+//Overage billed overage of the counter
+func (s *MemoryQuotaStore) Overage(key string) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.overages[key]
+}
+
+func (s *MemoryQuotaStore) expire(key string) {
+	if at, oks := s.expires[key]; oks && !s.Clock.Now().Before(at) {
+		delete(s.used, key)
+		delete(s.expires, key)
+	}
+}
+
+//MemoryCounterStore shared counters kept in-process, for tests and redis-less runs
+type MemoryCounterStore struct {
+	lock    sync.Mutex
+	counts  map[string]int64
+	expires map[string]time.Time
+	Clock   Clock
+}
+
+//NewMemoryCounterStore new instance
+func NewMemoryCounterStore() *MemoryCounterStore {
+	return &MemoryCounterStore{
+		counts:  make(map[string]int64),
+		expires: make(map[string]time.Time),
+		Clock:   SystemClock{},
+	}
+}
+
+//Add the deltas
+func (s *MemoryCounterStore) Add(all []*CounterDelta) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, d := range all {
+		s.expire(d.Key)
+		s.counts[d.Key] += d.N
+		if !d.Expires.IsZero() {
+			s.expires[d.Key] = d.Expires
+		}
+		d.Total = s.counts[d.Key]
+	}
+	return nil
+}
+
+//Get current total
+func (s *MemoryCounterStore) Get(key string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire(key)
+	return s.counts[key], nil
+}
+
+//Take remove the counter
+func (s *MemoryCounterStore) Take(key string) (int64, time.Time, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire(key)
+	n, expires := s.counts[key], s.expires[key]
+	delete(s.counts, key)
+	delete(s.expires, key)
+	return n, expires, nil
+}
+
+//Keys counters with the prefix, sorted
+func (s *MemoryCounterStore) Keys(prefix string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var all []string
+	for key := range s.counts {
+		if s.expire(key); strings.HasPrefix(key, prefix) && s.counts[key] != 0 {
+			all = append(all, key)
+		}
+	}
+	sort.Strings(all)
+	return all, nil
+}
+
+//Ping always up
+func (s *MemoryCounterStore) Ping() error {
+	return nil
+}
+
+func (s *MemoryCounterStore) expire(key string) {
+	if at, oks := s.expires[key]; oks && !s.Clock.Now().Before(at) {
+		delete(s.counts, key)
+		delete(s.expires, key)
+	}
+}
+
+//MemoryUserStore accounts kept in-process, for tests and mysql-less runs
+type MemoryUserStore struct {
+	lock    sync.Mutex
+	users   map[int64]*User
+	otpStep map[int64]int64
+	lastID  int64
+	Clock   Clock
+}
+
+//NewMemoryUserStore new instance
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:   make(map[int64]*User),
+		otpStep: make(map[int64]int64),
+		Clock:   SystemClock{},
+	}
+}
+
+//Create add the user
+func (s *MemoryUserStore) Create(u *User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, other := range s.users {
+		if strings.EqualFold(other.Username, u.Username) {
+			return ErrUserExists
+		}
+	}
+	if u.Role == "" {
+		u.Role = RoleUser
+	}
+	s.lastID++
+	u.ID = s.lastID
+	u.CreatedAt = s.Clock.Now().Format(time.RFC3339)
+	u.UpdatedAt = u.CreatedAt
+	saved := *u
+	s.users[u.ID] = &saved
+	return nil
+}
+
+//Update email, phone and password
+func (s *MemoryUserStore) Update(u *User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	saved, oks := s.users[u.ID]
+	if !oks {
+		return ErrUserNotFound
+	}
+	saved.Email, saved.Phone, saved.PasswordHash = u.Email, u.Phone, u.PasswordHash
+	saved.UpdatedAt = s.Clock.Now().Format(time.RFC3339)
+	return nil
+}
+
+//Get user by id
+func (s *MemoryUserStore) Get(id int64) (*User, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	saved, oks := s.users[id]
+	if !oks {
+		return nil, ErrUserNotFound
+	}
+	u := *saved
+	return &u, nil
+}
+
+//GetByName user by username
+func (s *MemoryUserStore) GetByName(username string) (*User, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, saved := range s.users {
+		if strings.EqualFold(saved.Username, username) {
+			u := *saved
+			return &u, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+//Delete remove the user
+func (s *MemoryUserStore) Delete(id int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, oks := s.users[id]; !oks {
+		return ErrUserNotFound
+	}
+	delete(s.users, id)
+	delete(s.otpStep, id)
+	return nil
+}
+
+//UseOtp keep the last used step
+func (s *MemoryUserStore) UseOtp(id int64, step int64) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, oks := s.users[id]; !oks {
+		return false, ErrUserNotFound
+	}
+	if s.otpStep[id] >= step {
+		return false, nil
+	}
+	s.otpStep[id] = step
+	return true, nil
+}
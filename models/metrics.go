@@ -0,0 +1,37 @@
+package models
+
+import (
+	"expvar"
+)
+
+//Metrics throttle counters of 1 service, served on /debug/vars;
+//not published on the expvar globals, each service has its own
+type Metrics struct {
+	expvar.Map
+}
+
+//NewMetrics new instance
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.Init()
+	return m
+}
+
+//Add add to 1 counter, nothing if not set
+func (m *Metrics) Add(name string, n int64) {
+	if m == nil {
+		return
+	}
+	m.Map.Add(name, n)
+}
+
+//Count value of 1 counter
+func (m *Metrics) Count(name string) int64 {
+	if m == nil {
+		return 0
+	}
+	if v, oks := m.Get(name).(*expvar.Int); oks {
+		return v.Value()
+	}
+	return 0
+}
@@ -0,0 +1,8 @@
+-- quota counters, was created by the quota store before the migrations
+CREATE TABLE IF NOT EXISTS throttle_quota (
+	counter_key VARCHAR(255) NOT NULL PRIMARY KEY,
+	used        BIGINT NOT NULL DEFAULT 0,
+	overage     BIGINT NOT NULL DEFAULT 0,
+	expires_at  DATETIME NOT NULL,
+	updated_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
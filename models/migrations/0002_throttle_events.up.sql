@@ -0,0 +1,20 @@
+-- decision history
+CREATE TABLE throttle_events (
+	id            BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	event_id      VARCHAR(128) NOT NULL,
+	ip            VARCHAR(64) NOT NULL,
+	forwarded_for VARCHAR(255) NOT NULL DEFAULT '',
+	url           VARCHAR(2048) NOT NULL DEFAULT '',
+	method        VARCHAR(16) NOT NULL DEFAULT '',
+	user_agent    VARCHAR(512) NOT NULL DEFAULT '',
+	referrer      VARCHAR(2048) NOT NULL DEFAULT '',
+	status        VARCHAR(16) NOT NULL,
+	policy        VARCHAR(128) NOT NULL DEFAULT '',
+	request_id    VARCHAR(128) NOT NULL DEFAULT '',
+	created_at    DATETIME(3) NOT NULL,
+	UNIQUE KEY uk_throttle_events_event (event_id),
+	KEY idx_throttle_events_created (created_at),
+	KEY idx_throttle_events_ip (ip, created_at),
+	KEY idx_throttle_events_status (status, created_at),
+	KEY idx_throttle_events_policy (policy, created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,13 @@
+-- accounts of the login and otp end-points
+CREATE TABLE users (
+	id            BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	username      VARCHAR(64) NOT NULL,
+	email         VARCHAR(255) NOT NULL DEFAULT '',
+	phone         VARCHAR(32) NOT NULL DEFAULT '',
+	password_hash VARCHAR(255) NOT NULL,
+	otp_secret    VARCHAR(64) NOT NULL,
+	otp_step      BIGINT NOT NULL DEFAULT 0,
+	created_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+	UNIQUE KEY uk_users_username (username)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,2 @@
+-- role of the tokens, only admin tokens pass the admin, limits and debug end-points
+ALTER TABLE users ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'user' AFTER otp_secret;
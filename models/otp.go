@@ -0,0 +1,115 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	//OtpStep life of 1 code (RFC 6238)
+	OtpStep = 30 * time.Second
+	//OtpDigits length of the code
+	OtpDigits = 6
+	//OtpSkew steps before and after now still accepted (clock drift, delivery)
+	OtpSkew = 1
+	//OtpIssuer shown on the authenticator apps
+	OtpIssuer = "rest-api-throttleip"
+)
+
+var otpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//NewOtpSecret random base32 secret of a user
+func NewOtpSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return otpEncoding.EncodeToString(b), nil
+}
+
+//OtpStepAt step number of the time
+func OtpStepAt(t time.Time) int64 {
+	return t.Unix() / int64(OtpStep/time.Second)
+}
+
+//OtpCode code of the secret at the step (HOTP of RFC 4226 on the time step)
+func OtpCode(secret string, step int64) (string, error) {
+	key, err := otpEncoding.DecodeString(secret)
+	if err != nil {
+		return "", fmt.Errorf("otp: invalid secret: %v", err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", OtpDigits, bin%1000000), nil
+}
+
+//OtpVerify step of the code if it is valid within the skew of now, 0 if not
+func OtpVerify(secret, code string, now time.Time) int64 {
+	if len(code) != OtpDigits {
+		return 0
+	}
+	step := OtpStepAt(now)
+	for i := step - OtpSkew; i <= step+OtpSkew; i++ {
+		want, err := OtpCode(secret, i)
+		if err != nil {
+			return 0
+		}
+		if hmac.Equal([]byte(want), []byte(code)) {
+			return i
+		}
+	}
+	return 0
+}
+
+//OtpURL otpauth uri of the secret for the authenticator apps
+func OtpURL(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", OtpIssuer)
+	v.Set("digits", fmt.Sprint(OtpDigits))
+	v.Set("period", fmt.Sprint(int(OtpStep/time.Second)))
+	return "otpauth://totp/" + url.PathEscape(OtpIssuer+":"+username) + "?" + v.Encode()
+}
+
+//OtpSender delivers the one-time code to the user (sms, email, ...)
+type OtpSender interface {
+	Send(u *User, code string) error
+}
+
+//LogOtpSender only logs the code, for dev and tests
+type LogOtpSender struct {
+	lock sync.Mutex
+	last map[string]string
+}
+
+//Send log the code
+func (s *LogOtpSender) Send(u *User, code string) error {
+	log.Println("OTP", u.Username, code)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.last == nil {
+		s.last = make(map[string]string)
+	}
+	s.last[u.Username] = code
+	return nil
+}
+
+//Last code sent to the user
+func (s *LogOtpSender) Last(username string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.last[username]
+}
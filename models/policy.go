@@ -0,0 +1,188 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Window one counting window of a policy, ie: 5 per second
+type Window struct {
+	Limit int    `json:"limit"`
+	Per   string `json:"per"`
+}
+
+//Period parse the window length (second/minute/hour/day or a go duration)
+func (w *Window) Period() time.Duration {
+	switch strings.ToLower(strings.TrimSpace(w.Per)) {
+	case "", "minute", "min", "m":
+		return time.Minute
+	case "second", "sec", "s":
+		return time.Second
+	case "hour", "h":
+		return time.Hour
+	case "day", "d":
+		return 24 * time.Hour
+	}
+	d, err := time.ParseDuration(w.Per)
+	if err != nil || d <= 0 {
+		return time.Minute
+	}
+	return d
+}
+
+//Policy set of windows applied to matching requests
+type Policy struct {
+	Name     string    `json:"name"`
+	Route    string    `json:"route"`
+	Methods  []string  `json:"methods"`
+	Windows  []*Window `json:"windows"`
+	Cost     *Cost     `json:"cost"`
+	Mode     string    `json:"mode"`
+	MaxWait  string    `json:"max_wait"`
+	MaxQueue int       `json:"max_queue"`
+
+	Concurrency int    `json:"concurrency"`
+	Priority    string `json:"priority"`
+
+	Descriptor map[string]string `json:"descriptor"`
+
+	//brute-force, see failures.go
+	FailureStatuses []int    `json:"failure_statuses"`
+	FailureKeys     []string `json:"failure_keys"`
+	UsernameField   string   `json:"username_field"`
+	UsernameHeader  string   `json:"username_header"`
+	Lockout         string   `json:"lockout"`
+}
+
+//NewPolicy single window policy
+func NewPolicy(name, route string, limit int, per string) *Policy {
+	return &Policy{
+		Name:    name,
+		Route:   route,
+		Windows: []*Window{{Limit: limit, Per: per}},
+	}
+}
+
+//Shapes check if over limit requests are held instead of rejected
+func (p *Policy) Shapes() bool {
+	return strings.EqualFold(p.Mode, PolicyModeShape) && p.MaxWaitDuration() > 0
+}
+
+//MaxWaitDuration longest time a request can be held
+func (p *Policy) MaxWaitDuration() time.Duration {
+	d, err := time.ParseDuration(p.MaxWait)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+//Matches check if the policy covers the request route and verb
+func (p *Policy) Matches(r *http.Request) bool {
+	//envoy only
+	if len(p.Descriptor) > 0 {
+		return false
+	}
+	if p.Route != "" && !strings.HasPrefix(r.URL.Path, p.Route) {
+		return false
+	}
+	if len(p.Methods) == 0 {
+		return true
+	}
+	for _, m := range p.Methods {
+		if strings.EqualFold(m, r.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+//MatchesDescriptor check if all the descriptor entries of the policy are there,
+//empty or * value matches any
+func (p *Policy) MatchesDescriptor(entries map[string]string) bool {
+	if len(p.Descriptor) == 0 {
+		return false
+	}
+	for k, v := range p.Descriptor {
+		got, oks := entries[k]
+		if !oks || (v != "" && v != "*" && v != got) {
+			return false
+		}
+	}
+	return true
+}
+
+//Validate sanity check on the windows
+func (p *Policy) Validate() error {
+	if p == nil {
+		return errors.New("policy: empty entry")
+	}
+	if len(p.Windows) == 0 {
+		return fmt.Errorf("policy %q: no windows", p.Name)
+	}
+	for _, w := range p.Windows {
+		if w == nil || w.Limit <= 0 {
+			return fmt.Errorf("policy %q: window limit must be > 0", p.Name)
+		}
+	}
+	if strings.EqualFold(p.Mode, PolicyModeShape) && p.MaxWaitDuration() <= 0 {
+		return fmt.Errorf("policy %q: shape mode needs max_wait > 0", p.Name)
+	}
+	if p.Cost != nil && p.Cost.Latency != "" {
+		if _, err := time.ParseDuration(p.Cost.Latency); err != nil {
+			return fmt.Errorf("policy %q: cost latency %v", p.Name, err)
+		}
+	}
+	return p.validateFailures()
+}
+
+//PolicyList ordered list, first match wins
+type PolicyList []*Policy
+
+//Match return the first enforced policy for the request, otherwise the fallback
+func (l PolicyList) Match(r *http.Request, fallback *Policy) *Policy {
+	for _, p := range l {
+		if p != nil && !p.Shadows() && p.Matches(r) {
+			return p
+		}
+	}
+	return fallback
+}
+
+//MatchDescriptor return the first policy for the envoy descriptor, nil if none
+func (l PolicyList) MatchDescriptor(entries map[string]string) *Policy {
+	for _, p := range l {
+		if p != nil && p.MatchesDescriptor(entries) {
+			return p
+		}
+	}
+	return nil
+}
+
+//ByName return the policy with the name, otherwise the fallback
+func (l PolicyList) ByName(name string, fallback *Policy) *Policy {
+	for _, p := range l {
+		if p != nil && p.Name == name {
+			return p
+		}
+	}
+	return fallback
+}
+
+//Decision result of checking all the windows of a policy
+type Decision struct {
+	Allowed   bool
+	Policy    string
+	Limit     int
+	Used      int
+	Remaining int
+	Window    time.Duration
+	Reset     time.Duration
+	Cost      int
+	Wait      time.Duration
+	key       string
+	keys      []string
+}
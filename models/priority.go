@@ -0,0 +1,198 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/bayugyug/rest-api-throttleip/utils"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+type priorityCtxKey struct{}
+
+//ApiKeyHeader default header of the api key
+const ApiKeyHeader = "X-Api-Key"
+
+//PriorityRule assign a class if the request matches, first match wins
+//
+//  tiers  = tier of the api key (see api_keys)
+//  claim  = jwt claim name, values = accepted claim values (empty = any)
+//  header = header name, values = accepted header values (empty = any)
+//  cidrs  = client ip ranges
+type PriorityRule struct {
+	Class  string   `json:"class"`
+	Tiers  []string `json:"tiers"`
+	Claim  string   `json:"claim"`
+	Header string   `json:"header"`
+	Values []string `json:"values"`
+	CIDRs  []string `json:"cidrs"`
+	nets   []*net.IPNet
+}
+
+//PriorityClassifier assign the priority class of the requests
+type PriorityClassifier struct {
+	Rules     []*PriorityRule
+	ApiKeys   map[string]string
+	KeyHeader string
+	Jwt       *utils.AppJwtConfig
+}
+
+//NewPriorityClassifier new instance, the cidrs are parsed once
+func NewPriorityClassifier(rules []*PriorityRule, apiKeys map[string]string) (*PriorityClassifier, error) {
+	for _, rule := range rules {
+		if rule == nil {
+			return nil, errors.New("priority rule: empty entry")
+		}
+		if _, oks := priorityShares[strings.ToLower(rule.Class)]; !oks {
+			return nil, fmt.Errorf("priority rule: unknown class %q", rule.Class)
+		}
+		nets, err := ParseCIDRs(rule.CIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("priority rule: %v", err)
+		}
+		rule.nets = nets
+	}
+	return &PriorityClassifier{
+		Rules:     rules,
+		ApiKeys:   apiKeys,
+		KeyHeader: ApiKeyHeader,
+		Jwt:       utils.NewAppJwtConfig(""),
+	}, nil
+}
+
+//Classify the 1st matching rule class, otherwise the fallback
+func (c *PriorityClassifier) Classify(r *http.Request, ip string, fallback string) string {
+	if c == nil {
+		return PriorityName(fallback)
+	}
+	tier := c.ApiKeys[strings.TrimSpace(r.Header.Get(c.KeyHeader))]
+	var claims map[string]interface{}
+	for _, rule := range c.Rules {
+		switch {
+		case len(rule.Tiers) > 0:
+			if tier == "" || !containsFold(rule.Tiers, tier) {
+				continue
+			}
+		case rule.Claim != "":
+			if claims == nil {
+				claims = c.jwtClaims(r)
+			}
+			v, oks := claims[rule.Claim]
+			if !oks || (len(rule.Values) > 0 && !containsFold(rule.Values, fmt.Sprint(v))) {
+				continue
+			}
+		case rule.Header != "":
+			v := strings.TrimSpace(r.Header.Get(rule.Header))
+			if v == "" || (len(rule.Values) > 0 && !containsFold(rule.Values, v)) {
+				continue
+			}
+		case len(rule.nets) > 0:
+			if !inNets(rule.nets, ip) {
+				continue
+			}
+		default:
+			continue
+		}
+		return PriorityName(rule.Class)
+	}
+	return PriorityName(fallback)
+}
+
+//jwtClaims claims of a valid bearer token, empty if none or signed with the built-in secret
+func (c *PriorityClassifier) jwtClaims(r *http.Request) map[string]interface{} {
+	claims := make(map[string]interface{})
+	bearer := r.Header.Get("Authorization")
+	if c.Jwt.IsDefault() || len(bearer) < 8 || !strings.EqualFold(bearer[:7], "bearer ") {
+		return claims
+	}
+	token, err := c.Jwt.TokenAuth.Decode(strings.TrimSpace(bearer[7:]))
+	if err != nil || token == nil || !token.Valid {
+		return claims
+	}
+	if mc, oks := token.Claims.(jwt.MapClaims); oks {
+		return mc
+	}
+	return claims
+}
+
+//WithPriority keep the class in the request context
+func WithPriority(ctx context.Context, class string) context.Context {
+	return context.WithValue(ctx, priorityCtxKey{}, class)
+}
+
+//PriorityFromContext class of the request, normal if not yet classified
+func PriorityFromContext(ctx context.Context) string {
+	if s, oks := ctx.Value(priorityCtxKey{}).(string); oks && s != "" {
+		return s
+	}
+	return PriorityNormal
+}
+
+//ShedConfig load shedding thresholds, 0 is no threshold
+type ShedConfig struct {
+	MaxInflight int `json:"max_inflight"`
+	MaxQueue    int `json:"max_queue"`
+}
+
+//LoadShedder drop the lower classes first once the load is over the threshold
+type LoadShedder struct {
+	MaxInflight int
+	MaxQueue    int
+	lock        sync.Mutex
+	inflight    int
+}
+
+//NewLoadShedder new instance
+func NewLoadShedder(maxInflight, maxQueue int) *LoadShedder {
+	return &LoadShedder{
+		MaxInflight: maxInflight,
+		MaxQueue:    maxQueue,
+	}
+}
+
+//Enter admit the class if the load is below its share of the thresholds
+func (s *LoadShedder) Enter(class string, queued int) (func(), bool) {
+	share := PriorityShare(class)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if (s.MaxInflight > 0 && float64(s.inflight) >= float64(s.MaxInflight)*share) ||
+		(s.MaxQueue > 0 && float64(queued) >= float64(s.MaxQueue)*share) {
+		return nil, false
+	}
+	s.inflight++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.lock.Lock()
+			s.inflight--
+			s.lock.Unlock()
+		})
+	}, true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func inNets(nets []*net.IPNet, s string) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
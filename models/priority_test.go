@@ -0,0 +1,53 @@
+package models
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+//TestForwardedIP the forwarded headers are only taken from the trusted proxies
+func TestForwardedIP(t *testing.T) {
+	trusted, err := ParseCIDRs([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockLists := []struct {
+		Remote string
+		XFF    string
+		RealIP string
+		Want   string
+	}{
+		//not a proxy, spoofed
+		{"203.0.113.9:5000", "10.1.2.3", "", ""},
+		{"203.0.113.9:5000", "", "10.1.2.3", ""},
+		{"192.0.2.2:5000", "10.1.2.3", "", ""},
+		//right-most that is not a proxy
+		{"10.0.0.5:5000", "198.51.100.7", "", "198.51.100.7"},
+		{"10.0.0.5:5000", "10.1.2.3, 198.51.100.7, 10.0.0.9", "", "198.51.100.7"},
+		{"192.0.2.1:5000", "10.1.2.3", "", "10.1.2.3"},
+		{"10.0.0.5:5000", "", "198.51.100.7", "198.51.100.7"},
+		{"10.0.0.5:5000", "", "", ""},
+		{"10.0.0.5:5000", "junk, 198.51.100.7", "", "198.51.100.7"},
+		{"10.0.0.5:5000", "198.51.100.7, junk", "", ""},
+		//no port, ie: unix socket
+		{"10.0.0.5", "198.51.100.7", "", "198.51.100.7"},
+	}
+	for i, rec := range mockLists {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = rec.Remote
+		if rec.XFF != "" {
+			r.Header.Set("X-Forwarded-For", rec.XFF)
+		}
+		if rec.RealIP != "" {
+			r.Header.Set("X-Real-IP", rec.RealIP)
+		}
+		if got := ForwardedIP(r, trusted); got != rec.Want {
+			t.Fatalf("%d ForwardedIP failed: %q", i+1, got)
+		}
+		t.Log(i+1, "OKAY", rec.Want)
+	}
+	if _, err := ParseCIDRs([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("ParseCIDRs failed: invalid is accepted")
+	}
+	t.Log("OK")
+}
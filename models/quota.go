@@ -0,0 +1,306 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/driver"
+	"github.com/bayugyug/rest-api-throttleip/utils"
+)
+
+const (
+	QuotaKey = "THROTTLE::QUOTA"
+
+	//overage modes
+	QuotaOverageBlock = "block"
+	QuotaOverageWarn  = "warn"
+	QuotaOverageBill  = "bill"
+)
+
+//Quota long-term request allowance reset on a calendar boundary
+type Quota struct {
+	Name      string `json:"name"`
+	Route     string `json:"route"`
+	Limit     int64  `json:"limit"`
+	Reset     string `json:"reset"`
+	Timezone  string `json:"timezone"`
+	Overage   string `json:"overage"`
+	KeyHeader string `json:"key_header"`
+}
+
+//Validate sanity check on the quota settings
+func (q *Quota) Validate() error {
+	if q == nil {
+		return errors.New("quota: empty entry")
+	}
+	if q.Name == "" || q.Limit <= 0 {
+		return fmt.Errorf("quota %q: name and limit > 0 are required", q.Name)
+	}
+	switch strings.ToLower(q.Reset) {
+	case "daily", "weekly", "monthly":
+	default:
+		return fmt.Errorf("quota %q: reset must be daily/weekly/monthly", q.Name)
+	}
+	switch strings.ToLower(q.Overage) {
+	case "", QuotaOverageBlock, QuotaOverageWarn, QuotaOverageBill:
+	default:
+		return fmt.Errorf("quota %q: overage must be block/warn/bill", q.Name)
+	}
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return fmt.Errorf("quota %q: %v", q.Name, err)
+	}
+	return nil
+}
+
+//Period the calendar cycle (in the quota timezone) where now belongs
+func (q *Quota) Period(now time.Time) (time.Time, time.Time) {
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	t := now.In(loc)
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	switch strings.ToLower(q.Reset) {
+	case "weekly":
+		//monday is the 1st day
+		start = start.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	case "monthly":
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	}
+	return start, start.AddDate(0, 0, 1)
+}
+
+//Owner who is billed for the request, api key header if set otherwise the ip
+func (q *Quota) Owner(r *http.Request, ip string) string {
+	if q.KeyHeader != "" {
+		if s := strings.TrimSpace(r.Header.Get(q.KeyHeader)); s != "" {
+			return s
+		}
+	}
+	return ip
+}
+
+//Matches check if the quota covers the request route
+func (q *Quota) Matches(r *http.Request) bool {
+	return q.Route == "" || strings.HasPrefix(r.URL.Path, q.Route)
+}
+
+//QuotaList all configured quotas
+type QuotaList []*Quota
+
+//QuotaStatus usage of 1 quota for 1 owner
+type QuotaStatus struct {
+	Name      string
+	Owner     string
+	Limit     int64
+	Used      int64
+	Remaining int64
+	ResetAt   string
+	Overage   string
+	Exceeded  bool
+	Blocked   bool
+}
+
+//QuotaStore durable counters of the quota cycles
+type QuotaStore interface {
+	//Incr add n (can be negative) and give back the new total
+	Incr(key string, n int64, expires time.Time) (int64, error)
+	//Used current total
+	Used(key string) (int64, error)
+	//Flag record the overage for billing
+	Flag(key string, n int64) error
+}
+
+//QuotaTracker check and spend the quotas
+type QuotaTracker struct {
+	Quotas QuotaList
+	Store  QuotaStore
+	Clock  Clock
+	Keys   *KeySpace
+}
+
+//NewQuotaTracker new instance
+func NewQuotaTracker(quotas QuotaList, store QuotaStore) *QuotaTracker {
+	return &QuotaTracker{
+		Quotas: quotas,
+		Store:  store,
+		Clock:  SystemClock{},
+		Keys:   DefaultKeys,
+	}
+}
+
+func (t *QuotaTracker) counterKey(q *Quota, owner string, start time.Time) string {
+	return t.Keys.Join(t.Keys.Quota, q.Name, owner, start.Format("20060102"))
+}
+
+//Hit spend 1 from every matching quota, the 1st blocked one is returned
+func (t *QuotaTracker) Hit(r *http.Request, ip string) ([]*QuotaStatus, *QuotaStatus) {
+	return t.check(r, ip, 1)
+}
+
+//Peek remaining of every matching quota without spending
+func (t *QuotaTracker) Peek(r *http.Request, ip string) []*QuotaStatus {
+	all, _ := t.check(r, ip, 0)
+	return all
+}
+
+func (t *QuotaTracker) check(r *http.Request, ip string, n int64) ([]*QuotaStatus, *QuotaStatus) {
+	if t == nil || t.Store == nil {
+		return nil, nil
+	}
+	now := t.Clock.Now()
+	var all []*QuotaStatus
+	var blocked *QuotaStatus
+	for _, q := range t.Quotas {
+		if !q.Matches(r) {
+			continue
+		}
+		owner := q.Owner(r, ip)
+		start, end := q.Period(now)
+		key := t.counterKey(q, owner, start)
+
+		var used int64
+		var err error
+		if n == 0 {
+			used, err = t.Store.Used(key)
+		} else {
+			//keep 1 more cycle for billing
+			used, err = t.Store.Incr(key, n, end.Add(end.Sub(start)))
+		}
+		if err != nil {
+			//fail open, the rate windows still apply
+			log.Println("QUOTA_STORE", q.Name, err)
+			continue
+		}
+		st := &QuotaStatus{
+			Name:     q.Name,
+			Owner:    owner,
+			Limit:    q.Limit,
+			Used:     used,
+			ResetAt:  end.Format(time.RFC3339),
+			Overage:  strings.ToLower(q.Overage),
+			Exceeded: used > q.Limit,
+		}
+		if st.Overage == "" {
+			st.Overage = QuotaOverageBlock
+		}
+		if n > 0 && st.Exceeded {
+			switch st.Overage {
+			case QuotaOverageBlock:
+				//give it back, blocked ones are not counted
+				if used, err = t.Store.Incr(key, -n, end.Add(end.Sub(start))); err == nil {
+					st.Used = used
+				}
+				st.Blocked = true
+				if blocked == nil {
+					blocked = st
+				}
+			case QuotaOverageBill:
+				if err := t.Store.Flag(key, n); err != nil {
+					log.Println("QUOTA_STORE", q.Name, err)
+				}
+			}
+		}
+		st.Remaining = q.Limit - st.Used
+		if st.Remaining < 0 {
+			st.Remaining = 0
+		}
+		all = append(all, st)
+	}
+	utils.Dumper("quota::q", ip, all)
+	return all, blocked
+}
+
+//Tightest the quota with the least remaining
+func (t *QuotaTracker) Tightest(all []*QuotaStatus) *QuotaStatus {
+	var tight *QuotaStatus
+	for _, st := range all {
+		if tight == nil || st.Remaining < tight.Remaining {
+			tight = st
+		}
+	}
+	return tight
+}
+
+//RedisQuotaStore quota counters on redis, the billing overage is kept on the main redis
+//even if the counters are on the redis shards
+type RedisQuotaStore struct {
+	cache    driver.RedisClient
+	Counters CounterStore
+	Keys     *KeySpace
+}
+
+//NewRedisQuotaStore new instance
+func NewRedisQuotaStore(cache driver.RedisClient) *RedisQuotaStore {
+	return &RedisQuotaStore{cache: cache, Counters: NewRedisCounterStore(cache), Keys: DefaultKeys}
+}
+
+//Incr add n to the cycle counter
+func (s *RedisQuotaStore) Incr(key string, n int64, expires time.Time) (int64, error) {
+	d := &CounterDelta{Key: key, N: n, Expires: expires}
+	if err := s.Counters.Add([]*CounterDelta{d}); err != nil {
+		return 0, err
+	}
+	return d.Total, nil
+}
+
+//Used current cycle counter
+func (s *RedisQuotaStore) Used(key string) (int64, error) {
+	return s.Counters.Get(key)
+}
+
+//Flag add to the billing overage
+func (s *RedisQuotaStore) Flag(key string, n int64) error {
+	return s.cache.HIncrBy(s.Keys.QuotaOverage, key, n).Err()
+}
+
+//MysqlQuotaStore quota counters on mysql
+type MysqlQuotaStore struct {
+	dbh *sql.DB
+}
+
+//NewMysqlQuotaStore new instance, the table is made by the migrations
+func NewMysqlQuotaStore(dbh *sql.DB) *MysqlQuotaStore {
+	return &MysqlQuotaStore{dbh: dbh}
+}
+
+//Incr add n to the cycle counter
+func (s *MysqlQuotaStore) Incr(key string, n int64, expires time.Time) (int64, error) {
+	tx, err := s.dbh.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`INSERT INTO throttle_quota (counter_key, used, expires_at) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE used = used + VALUES(used)`, key, n, expires.UTC()); err != nil {
+		return 0, err
+	}
+	var used int64
+	if err = tx.QueryRow(`SELECT used FROM throttle_quota WHERE counter_key = ?`, key).Scan(&used); err != nil {
+		return 0, err
+	}
+	return used, tx.Commit()
+}
+
+//Used current cycle counter
+func (s *MysqlQuotaStore) Used(key string) (int64, error) {
+	var used int64
+	err := s.dbh.QueryRow(`SELECT used FROM throttle_quota WHERE counter_key = ?`, key).Scan(&used)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return used, err
+}
+
+//Flag add to the billing overage
+func (s *MysqlQuotaStore) Flag(key string, n int64) error {
+	_, err := s.dbh.Exec(`UPDATE throttle_quota SET overage = overage + ? WHERE counter_key = ?`, n, key)
+	return err
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+//TestQuotaPeriod calendar cycles in the quota timezone
+func TestQuotaPeriod(t *testing.T) {
+	//sunday 20:00 utc, monday 04:00 in manila
+	now := time.Date(2019, 1, 20, 20, 0, 0, 0, time.UTC)
+	mockLists := []struct {
+		Reset    string
+		Timezone string
+		Now      time.Time
+		Start    string
+		End      string
+	}{
+		{"daily", "", now, "2019-01-20T00:00:00Z", "2019-01-21T00:00:00Z"},
+		{"daily", "Asia/Manila", now, "2019-01-21T00:00:00+08:00", "2019-01-22T00:00:00+08:00"},
+		//monday is the 1st day
+		{"weekly", "UTC", now, "2019-01-14T00:00:00Z", "2019-01-21T00:00:00Z"},
+		{"weekly", "Asia/Manila", now, "2019-01-21T00:00:00+08:00", "2019-01-28T00:00:00+08:00"},
+		{"monthly", "Asia/Manila", now, "2019-01-01T00:00:00+08:00", "2019-02-01T00:00:00+08:00"},
+		//dst starts within the month
+		{"monthly", "America/New_York", time.Date(2019, 3, 15, 12, 0, 0, 0, time.UTC), "2019-03-01T00:00:00-05:00", "2019-04-01T00:00:00-04:00"},
+		{"daily", "America/New_York", time.Date(2019, 3, 10, 12, 0, 0, 0, time.UTC), "2019-03-10T00:00:00-05:00", "2019-03-11T00:00:00-04:00"},
+	}
+	for i, rec := range mockLists {
+		q := &Quota{Name: "q", Limit: 1, Reset: rec.Reset, Timezone: rec.Timezone}
+		if err := q.Validate(); err != nil {
+			t.Fatalf("%d Validate failed: %v", i+1, err)
+		}
+		start, end := q.Period(rec.Now)
+		if start.Format(time.RFC3339) != rec.Start || end.Format(time.RFC3339) != rec.End {
+			t.Fatalf("%d Period failed: %s %s", i+1, start.Format(time.RFC3339), end.Format(time.RFC3339))
+		}
+		t.Log(i+1, "OKAY", rec.Reset, rec.Timezone, rec.Start)
+	}
+	t.Log("OK")
+}
+
+//TestQuotaOverage block gives back and rejects, warn and bill let it through
+func TestQuotaOverage(t *testing.T) {
+	clock := NewManualClock(time.Date(2019, 1, 20, 8, 0, 0, 0, time.UTC))
+	store := NewMemoryQuotaStore()
+	store.Clock = clock
+	quotas := QuotaList{
+		{Name: "block", Route: "/block", Limit: 2, Reset: "daily"},
+		{Name: "warn", Route: "/warn", Limit: 2, Reset: "daily", Overage: QuotaOverageWarn},
+		{Name: "bill", Route: "/bill", Limit: 2, Reset: "daily", Overage: QuotaOverageBill},
+	}
+	trk := NewQuotaTracker(quotas, store)
+	trk.Clock = clock
+
+	mockLists := []struct {
+		Route    string
+		Used     int64
+		Exceeded bool
+		Blocked  bool
+	}{
+		{"/block", 1, false, false},
+		{"/block", 2, false, false},
+		{"/block", 2, true, true},
+		{"/block", 2, true, true},
+		{"/warn", 1, false, false},
+		{"/warn", 2, false, false},
+		{"/warn", 3, true, false},
+		{"/bill", 1, false, false},
+		{"/bill", 2, false, false},
+		{"/bill", 3, true, false},
+		{"/bill", 4, true, false},
+	}
+	for i, rec := range mockLists {
+		all, blocked := trk.Hit(httptest.NewRequest("GET", rec.Route, nil), "10.0.0.1")
+		if len(all) != 1 {
+			t.Fatalf("%d Match failed: %d", i+1, len(all))
+		}
+		st := all[0]
+		if st.Used != rec.Used || st.Exceeded != rec.Exceeded || st.Blocked != rec.Blocked || (blocked != nil) != rec.Blocked {
+			t.Fatalf("%d Overage failed: %+v", i+1, st)
+		}
+		if st.Exceeded && st.Remaining != 0 {
+			t.Fatalf("%d Remaining failed: %+v", i+1, st)
+		}
+		t.Log(i+1, "OKAY", st.Name, st.Used, st.Overage)
+	}
+
+	//billed once per request over the limit
+	start, _ := quotas[2].Period(clock.Now())
+	if n := store.Overage(trk.counterKey(quotas[2], "10.0.0.1", start)); n != 2 {
+		t.Fatalf("Bill failed: %d", n)
+	}
+	if n := store.Overage(trk.counterKey(quotas[1], "10.0.0.1", start)); n != 0 {
+		t.Fatalf("Warn failed: %d", n)
+	}
+
+	//next day, new cycle
+	clock.Advance(16 * time.Hour)
+	all, blocked := trk.Hit(httptest.NewRequest("GET", "/block", nil), "10.0.0.1")
+	if blocked != nil || all[0].Used != 1 || all[0].ResetAt != "2019-01-22T00:00:00Z" {
+		t.Fatalf("Reset failed: %+v", all[0])
+	}
+	t.Log("OK")
+}
@@ -2,14 +2,14 @@ package models
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/bayugyug/rest-api-throttleip/driver"
 	"github.com/bayugyug/rest-api-throttleip/utils"
 	"github.com/google/uuid"
-	redis "gopkg.in/redis.v3"
 )
 
 const (
@@ -18,87 +18,395 @@ const (
 )
 
 type TrackerIPHistory struct {
-	lock           sync.Mutex
 	HistoryChannel chan *TrackerIP
+	quit           chan struct{}
+	closing        sync.Once
+	//saved closed once the history manager is done with the last records
+	saved     chan struct{}
+	savedOnce sync.Once
+
+	//Clock of the windows, manual on tests and the simulator
+	Clock Clock
+
+	//Counters window slots, sharded and bounded
+	Counters *ShardedCounters
 }
 
 func NewTrackerIPHistory() *TrackerIPHistory {
-	return &TrackerIPHistory{
+	h := &TrackerIPHistory{
 		HistoryChannel: make(chan *TrackerIP, 5000),
+		quit:           make(chan struct{}),
+		saved:          make(chan struct{}),
+		Clock:          SystemClock{},
+		Counters:       NewShardedCounters(nil),
 	}
+	return h
+}
+
+//Close stop the q and history managers
+func (h *TrackerIPHistory) Close() {
+	h.closing.Do(func() { close(h.quit) })
 }
 
-var IPHistoryLogs map[string]int
+//WindowCount hit counter of 1 window slot
+type WindowCount struct {
+	Count   int
+	Expires time.Time
+	//Pending local hits not yet pushed to the shared counters (hybrid)
+	Pending int
+}
+
+//add n to the slot, floored at 0
+func (w *WindowCount) add(n int) {
+	if w.Count+n < 0 {
+		n = -w.Count
+	}
+	w.Count += n
+	w.Pending += n
+}
 
 //ManageQ the ip history logs
 func (h *TrackerIPHistory) ManageQ(isReady chan bool) {
 
 	//get new set of history
-	IPHistoryLogs = h.InitQ()
-
-	//now its minute ;-)
-	ticker := time.NewTicker(time.Second * 60)
+	h.ResetQ()
 
 	//ready
 	isReady <- true
 	utils.Dumper("ManageQ::IsReady")
 	for {
+		//now its minute ;-)
 		select {
-		case <-ticker.C:
-			//init every n minute
-			IPHistoryLogs = h.InitQ()
+		case <-h.Clock.After(time.Second * 60):
+			//drop the expired window slots every n minute
+			h.SweepQ(h.Clock.Now())
 			utils.Dumper("history::q refresh")
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+//ResetQ drop all the window slots
+func (h *TrackerIPHistory) ResetQ() {
+	h.Counters.Reset()
+}
+
+//SweepQ remove the window slots that already ended
+func (h *TrackerIPHistory) SweepQ(now time.Time) {
+	h.Counters.Sweep(now)
+}
+
+//windowSlots the window counters of the policy at the given time, created only if asked,
+//the shard of the key must be locked
+func windowSlots(sh *counterShard, s string, p *Policy, at time.Time, create bool) ([]string, []*WindowCount) {
+	slots := make([]*WindowCount, len(p.Windows))
+	keys := make([]string, len(p.Windows))
+	for i, w := range p.Windows {
+		period := w.Period()
+		start := at.Truncate(period)
+		key := fmt.Sprintf("%s::%s::%s::%d", s, p.Name, period, start.Unix())
+		slot, oks := sh.get(key)
+		if !oks || !at.Before(slot.Expires) {
+			slot = sh.fresh(key, start.Add(period))
+			if create {
+				sh.put(key, slot)
+			}
 		}
+		slots[i] = slot
+		keys[i] = key
 	}
+	return keys, slots
 }
 
-//InitQ set new map of queue data
-func (h *TrackerIPHistory) InitQ() map[string]int {
-	return make(map[string]int)
+//decideSlots tightest decision of taking the cost from all the slots,
+//the exhausted one that frees up last if denied
+func decideSlots(p *Policy, slots []*WindowCount, cost int, now time.Time) *Decision {
+	var tight, denied *Decision
+	for i, w := range p.Windows {
+		slot := slots[i]
+		dec := &Decision{
+			Allowed:   slot.Count+cost <= w.Limit,
+			Policy:    p.Name,
+			Limit:     w.Limit,
+			Used:      slot.Count + cost,
+			Remaining: w.Limit - slot.Count - cost,
+			Window:    w.Period(),
+			Reset:     slot.Expires.Sub(now),
+			Cost:      cost,
+		}
+		//exhausted, report the one that frees up last
+		if !dec.Allowed {
+			dec.Used = slot.Count
+			dec.Remaining = 0
+			if denied == nil || dec.Reset > denied.Reset {
+				denied = dec
+			}
+			continue
+		}
+		if tight == nil || dec.Remaining < tight.Remaining ||
+			(dec.Remaining == tight.Remaining && dec.Reset > tight.Reset) {
+			tight = dec
+		}
+	}
+	if denied != nil {
+		return denied
+	}
+	return tight
 }
 
-//GetIP return count
-func (h *TrackerIPHistory) GetIP(s string) int {
+//Allow check all the windows of the policy at once, take the cost only if all have room
+func (h *TrackerIPHistory) Allow(s string, p *Policy, cost int) *Decision {
+	now := h.Clock.Now()
+	if len(p.Windows) == 0 {
+		return &Decision{Allowed: true, Policy: p.Name, Cost: cost}
+	}
+
 	//just in case ;-)
-	h.lock.Lock()
-	defer h.lock.Unlock()
-	if _, oks := IPHistoryLogs[s]; !oks {
-		IPHistoryLogs[s] = 1
-	} else {
-		IPHistoryLogs[s]++
-	}
-	utils.Dumper("history::q", s, IPHistoryLogs[s])
+	sh := h.Counters.shard(s)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	keys, slots := windowSlots(sh, s, p, now, true)
+	dec := decideSlots(p, slots, cost, now)
+	if !dec.Allowed {
+		utils.Dumper("history::q", s, p.Name, "denied", dec.Limit, dec.Window.String())
+		return dec
+	}
+
+	//all good, hit every window
+	for i, slot := range slots {
+		sh.add(keys[i], slot, cost)
+	}
+	dec.key, dec.keys = s, keys
+	utils.Dumper("history::q", s, p.Name, cost, dec.Remaining)
 	//give it back
-	return IPHistoryLogs[s]
+	return dec
+}
+
+//Peek the tightest window without spending
+func (h *TrackerIPHistory) Peek(s string, p *Policy) *Decision {
+	now := h.Clock.Now()
+	if len(p.Windows) == 0 {
+		return &Decision{Allowed: true, Policy: p.Name}
+	}
+	sh := h.Counters.shard(s)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	_, slots := windowSlots(sh, s, p, now, false)
+	dec := decideSlots(p, slots, 0, now)
+	dec.Allowed = dec.Remaining > 0
+	return dec
+}
+
+//Reserve book the cost on the earliest windows that have room within the max wait,
+//the decision Wait is how long till the tokens can be used
+func (h *TrackerIPHistory) Reserve(s string, p *Policy, cost int, maxWait time.Duration) *Decision {
+	now := h.Clock.Now()
+	if len(p.Windows) == 0 {
+		return &Decision{Allowed: true, Policy: p.Name, Cost: cost}
+	}
+	sh := h.Counters.shard(s)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	at := now
+	for {
+		_, slots := windowSlots(sh, s, p, at, false)
+		dec := decideSlots(p, slots, cost, at)
+		if dec.Allowed {
+			keys, slots := windowSlots(sh, s, p, at, true)
+			for i, slot := range slots {
+				sh.add(keys[i], slot, cost)
+			}
+			dec.key, dec.keys = s, keys
+			dec.Wait = at.Sub(now)
+			dec.Reset += dec.Wait
+			utils.Dumper("history::q", s, p.Name, "reserve", cost, dec.Wait.String())
+			return dec
+		}
+		//never fits or too far
+		next := at.Add(dec.Reset)
+		if dec.Used == 0 || next.Sub(now) > maxWait {
+			dec.Wait = next.Sub(now)
+			dec.Reset = next.Sub(now)
+			return dec
+		}
+		at = next
+	}
+}
+
+//Adjust add n (negative for refund) to the window slots used by an allowed decision
+func (h *TrackerIPHistory) Adjust(dec *Decision, n int) {
+	if dec == nil || n == 0 {
+		return
+	}
+	sh := h.Counters.shard(dec.key)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	for _, key := range dec.keys {
+		//already rolled to the next window or evicted
+		slot, oks := sh.get(key)
+		if !oks {
+			continue
+		}
+		sh.add(key, slot, n)
+	}
+	dec.Cost += n
+	utils.Dumper("history::q", dec.Policy, "adjust", n)
 }
 
-//ManageHistory
-func (h *TrackerIPHistory) ManageHistory(isReady chan bool, cache *redis.Client) {
+//Refund give back n tokens to the current windows of the key
+func (h *TrackerIPHistory) Refund(s string, p *Policy, n int) *Decision {
+	now := h.Clock.Now()
+	if len(p.Windows) == 0 {
+		return &Decision{Allowed: true, Policy: p.Name}
+	}
+	sh := h.Counters.shard(s)
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	keys, slots := windowSlots(sh, s, p, now, false)
+	for i, slot := range slots {
+		sh.add(keys[i], slot, -n)
+	}
+	dec := decideSlots(p, slots, 0, now)
+	dec.Allowed = dec.Remaining > 0
+	utils.Dumper("history::q", s, p.Name, "refund", n)
+	return dec
+}
+
+//ManageHistory save the records, in batches if the store can
+func (h *TrackerIPHistory) ManageHistory(isReady chan bool, store HistoryStore) {
+	defer h.savedOnce.Do(func() { close(h.saved) })
+
+	batch, _ := store.(BatchHistoryStore)
+	size, interval := 1, HistoryFlushInterval
+	if batch != nil {
+		size, interval = batch.BatchSize(), batch.FlushInterval()
+	}
+	var ids []string
+	var infos []*TrackerIP
+	flush := func() {
+		if len(infos) == 0 {
+			return
+		}
+		if err := batch.SaveBatch(ids, infos); err != nil {
+			log.Println("FAILED_TO_ADD_HISTORY", len(infos), err)
+		}
+		ids, infos = ids[:0], infos[:0]
+	}
+	add := func(info *TrackerIP) {
+		if info.IP == "" {
+			return
+		}
+		id := h.Clock.Now().Format("20060102-150405") + "::" + uuid.New().String() + "::" + info.IP
+		if size <= 1 {
+			if err := store.Save(id, info); err != nil {
+				log.Println("FAILED_TO_ADD_HISTORY", err)
+			}
+			return
+		}
+		ids, infos = append(ids, id), append(infos, info)
+		if len(infos) >= size {
+			flush()
+		}
+	}
+
+	//real ticker, the partial batch is flushed on wall time even on a manual clock
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
 	//ready
 	isReady <- true
 	utils.Dumper("ManageHistory::IsReady")
-	pipe := cache.Pipeline()
 	for {
 		select {
 		case info := <-h.HistoryChannel:
-			if info.IP != "" {
-				data, derr := json.Marshal(info)
-				if derr != nil {
-					log.Println("FAILED_TO_ADD_REDIS", derr)
-					continue
-				}
-				key := IPAllowedKey
-				if strings.EqualFold(info.Status, "Denied") {
-					key = IPDeniedKey
-				}
-				pipe.HSet(key, time.Now().Format("20060102-150405")+"::"+uuid.New().String()+"::"+info.IP, string(data)) //no expiry on the summary list
-				_, err := pipe.Exec()
-				if err != nil {
-					log.Println("FAILED_TO_ADD_REDIS", err)
+			add(info)
+		case <-ticker.C:
+			flush()
+		case <-h.quit:
+			//whatever is queued goes with the last batch
+			for {
+				select {
+				case info := <-h.HistoryChannel:
+					add(info)
+				default:
+					flush()
+					return
 				}
+			}
+		}
+	}
+}
+
+//WaitHistory wait for the last records after Close, up to the timeout
+func (h *TrackerIPHistory) WaitHistory(timeout time.Duration) bool {
+	select {
+	case <-h.saved:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+//HistoryStore where the tracker records are kept
+type HistoryStore interface {
+	//Save add the record under the unique id
+	Save(id string, info *TrackerIP) error
+	//Load the allowed and denied records
+	Load() ([]*TrackerIP, error)
+}
+
+//RedisHistoryStore records on the allowed, denied and shadow hashes
+type RedisHistoryStore struct {
+	cache driver.RedisClient
+	pipe  driver.RedisPipeline
+	Keys  *KeySpace
+}
+
+//NewRedisHistoryStore new instance
+func NewRedisHistoryStore(cache driver.RedisClient) *RedisHistoryStore {
+	return &RedisHistoryStore{
+		cache: cache,
+		pipe:  cache.Pipeline(),
+		Keys:  DefaultKeys,
+	}
+}
 
+//Save add the record
+func (s *RedisHistoryStore) Save(id string, info *TrackerIP) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	s.pipe.HSet(s.Keys.History(info), id, string(data)) //no expiry on the summary list
+	_, err = s.pipe.Exec()
+	return err
+}
+
+//Load records from the allowed and denied hashes
+func (s *RedisHistoryStore) Load() ([]*TrackerIP, error) {
+	var all []*TrackerIP
+	for _, key := range []string{s.Keys.IPAllowed, s.Keys.IPDenied} {
+		var cursor int64
+		for {
+			next, page, err := s.cache.HScan(key, cursor, "", 1000).Result()
+			if err != nil {
+				return nil, err
+			}
+			//field, value pairs
+			for i := 1; i < len(page); i += 2 {
+				var trk TrackerIP
+				if err := json.Unmarshal([]byte(page[i]), &trk); err != nil {
+					continue
+				}
+				all = append(all, &trk)
+			}
+			if cursor = next; cursor == 0 {
+				break
 			}
 		}
 	}
+	return all, nil
 }
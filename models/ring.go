@@ -0,0 +1,102 @@
+package models
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+const (
+	//RingVirtualNodes default points of each node on the ring
+	RingVirtualNodes = 160
+)
+
+//HashRing consistent hashing of keys to node names, each node is placed on
+//several points so adding or removing one only moves its share of the keys
+type HashRing struct {
+	replicas int
+	points   []uint32
+	owners   map[uint32]string
+	nodes    map[string]bool
+}
+
+//NewHashRing new instance, default virtual nodes if 0
+func NewHashRing(replicas int) *HashRing {
+	if replicas <= 0 {
+		replicas = RingVirtualNodes
+	}
+	return &HashRing{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+		nodes:    make(map[string]bool),
+	}
+}
+
+func ringHash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+//Add place the node on the ring
+func (r *HashRing) Add(name string) {
+	if r.nodes[name] {
+		return
+	}
+	r.nodes[name] = true
+	for i := 0; i < r.replicas; i++ {
+		h := ringHash(name + "#" + strconv.Itoa(i))
+		if _, oks := r.owners[h]; oks {
+			//collision, first one keeps it
+			continue
+		}
+		r.owners[h] = name
+		r.points = append(r.points, h)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+//Remove take the node off the ring
+func (r *HashRing) Remove(name string) {
+	if !r.nodes[name] {
+		return
+	}
+	delete(r.nodes, name)
+	points := r.points[:0]
+	for _, h := range r.points {
+		if r.owners[h] == name {
+			delete(r.owners, h)
+			continue
+		}
+		points = append(points, h)
+	}
+	r.points = points
+}
+
+//Get node of the key, empty if there is none
+func (r *HashRing) Get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+//Has check if the node is on the ring
+func (r *HashRing) Has(name string) bool {
+	return r.nodes[name]
+}
+
+//Nodes on the ring, sorted
+func (r *HashRing) Nodes() []string {
+	all := make([]string, 0, len(r.nodes))
+	for name := range r.nodes {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+	return all
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"embed"
+
+	"github.com/bayugyug/rest-api-throttleip/driver"
+)
+
+//migrationFiles {version}_{name}.up.sql and .down.sql, never edit the applied ones
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+//Migrations mysql schema of the quota counters and the history, in version order
+var Migrations = driver.MustLoadMigrations(migrationFiles, "migrations")
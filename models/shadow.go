@@ -0,0 +1,80 @@
+package models
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	//PolicyModeShadow count and record what would be denied, never reject
+	PolicyModeShadow = "shadow"
+
+	//StatusWouldDeny history status of a request a shadow policy would have denied
+	StatusWouldDeny = "WouldDeny"
+)
+
+//Shadows check if the policy only records its decisions
+func (p *Policy) Shadows() bool {
+	return strings.EqualFold(p.Mode, PolicyModeShadow)
+}
+
+//Shadows all the shadow policies for the request, they run next to the enforced one
+func (l PolicyList) Shadows(r *http.Request) []*Policy {
+	var all []*Policy
+	for _, p := range l {
+		if p != nil && p.Shadows() && p.Matches(r) {
+			all = append(all, p)
+		}
+	}
+	return all
+}
+
+//Policy count the decision of the policy,
+//policy::name::allowed, policy::name::denied or policy::name::would_deny
+func (m *Metrics) Policy(p *Policy, dec *Decision) {
+	outcome := "allowed"
+	switch {
+	case dec.Allowed:
+	case p.Shadows():
+		outcome = "would_deny"
+	default:
+		outcome = "denied"
+	}
+	m.Add("policy::"+p.Name+"::"+outcome, 1)
+}
+
+//PolicyReport decisions of 1 policy since start
+type PolicyReport struct {
+	Name      string
+	Mode      string
+	Allowed   int64
+	Denied    int64
+	WouldDeny int64
+}
+
+//PolicyReports decisions of all the policies, shadow and enforced side by side
+func (m *Metrics) PolicyReports(l PolicyList, fallback *Policy) []*PolicyReport {
+	all := make([]*Policy, 0, len(l)+1)
+	all = append(all, l...)
+	if fallback != nil {
+		all = append(all, fallback)
+	}
+	reports := make([]*PolicyReport, 0, len(all))
+	for _, p := range all {
+		if p == nil {
+			continue
+		}
+		mode := "enforce"
+		if p.Mode != "" {
+			mode = strings.ToLower(p.Mode)
+		}
+		reports = append(reports, &PolicyReport{
+			Name:      p.Name,
+			Mode:      mode,
+			Allowed:   m.Count("policy::" + p.Name + "::allowed"),
+			Denied:    m.Count("policy::" + p.Name + "::denied"),
+			WouldDeny: m.Count("policy::" + p.Name + "::would_deny"),
+		})
+	}
+	return reports
+}
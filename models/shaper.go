@@ -0,0 +1,109 @@
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	//PolicyModeShape hold the over limit requests instead of rejecting
+	PolicyModeShape = "shape"
+
+	//ShapeMaxQueue default cap of waiting requests per key
+	ShapeMaxQueue = 10
+)
+
+//Shaper track the requests waiting for a slot per key, the waiting ones are let out
+//1 at a time at the drain rate of the window (leaky bucket) instead of all at the reset
+type Shaper struct {
+	lock  sync.Mutex
+	queue map[string]*shapeQueue
+}
+
+type shapeQueue struct {
+	waiting int
+	//next release time of the key
+	next time.Time
+}
+
+//NewShaper new instance
+func NewShaper() *Shaper {
+	return &Shaper{
+		queue: make(map[string]*shapeQueue),
+	}
+}
+
+//Enter join the queue of the key, false if full
+func (s *Shaper) Enter(key string, max int) bool {
+	if max <= 0 {
+		max = ShapeMaxQueue
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.queue[key]
+	if q == nil {
+		q = &shapeQueue{}
+		s.queue[key] = q
+	}
+	if q.waiting >= max {
+		return false
+	}
+	q.waiting++
+	return true
+}
+
+//Next book the release time of a waiting request of the key, the earliest is from (the window reset)
+//and each booking is spaced from the previous one; nothing is booked if it is after the deadline
+func (s *Shaper) Next(key string, from time.Time, spacing time.Duration, deadline time.Time) (time.Time, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.queue[key]
+	if q == nil {
+		return from, false
+	}
+	at := from
+	if q.next.After(at) {
+		at = q.next
+	}
+	if at.After(deadline) {
+		return at, false
+	}
+	q.next = at.Add(spacing)
+	return at, true
+}
+
+//Leave drop out of the queue of the key
+func (s *Shaper) Leave(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.queue[key]
+	if q == nil {
+		return
+	}
+	if q.waiting <= 1 {
+		delete(s.queue, key)
+		return
+	}
+	q.waiting--
+}
+
+//Total requests on hold for all keys
+func (s *Shaper) Total() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	total := 0
+	for _, q := range s.queue {
+		total += q.waiting
+	}
+	return total
+}
+
+//Waiting total requests on hold for the key
+func (s *Shaper) Waiting(key string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if q := s.queue[key]; q != nil {
+		return q.waiting
+	}
+	return 0
+}
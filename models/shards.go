@@ -0,0 +1,489 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bayugyug/rest-api-throttleip/driver"
+	"github.com/bayugyug/rest-api-throttleip/utils"
+	redis "gopkg.in/redis.v3"
+)
+
+var (
+	//ErrNoShards all the counter nodes are down
+	ErrNoShards = errors.New("shards: no counter node is up")
+)
+
+//CounterDelta hits to add to a shared counter, Total is set back after
+type CounterDelta struct {
+	Key     string
+	N       int64
+	Expires time.Time
+	Total   int64
+}
+
+//CounterStore shared counters of all the instances (hybrid windows, quotas)
+type CounterStore interface {
+	//Add the deltas in 1 batch, the new totals are set on each
+	Add(all []*CounterDelta) error
+	//Get current total, 0 if none
+	Get(key string) (int64, error)
+	//Take remove the counter, its total and expiry are given back
+	Take(key string) (int64, time.Time, error)
+	//Keys counters with the prefix
+	Keys(prefix string) ([]string, error)
+	//Ping check if reachable
+	Ping() error
+}
+
+//RedisCounterStore counters on 1 redis (node, sentinel or cluster)
+type RedisCounterStore struct {
+	cache driver.RedisClient
+}
+
+//NewRedisCounterStore new instance
+func NewRedisCounterStore(cache driver.RedisClient) *RedisCounterStore {
+	return &RedisCounterStore{cache: cache}
+}
+
+//Add the deltas in 1 pipeline
+func (s *RedisCounterStore) Add(all []*CounterDelta) error {
+	if len(all) == 0 {
+		return nil
+	}
+	pipe := s.cache.Pipeline()
+	defer pipe.Close()
+	totals := make([]*redis.IntCmd, len(all))
+	for i, d := range all {
+		totals[i] = pipe.IncrBy(d.Key, d.N)
+		if !d.Expires.IsZero() {
+			pipe.ExpireAt(d.Key, d.Expires)
+		}
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+	for i, d := range all {
+		d.Total = totals[i].Val()
+	}
+	return nil
+}
+
+//Get current total
+func (s *RedisCounterStore) Get(key string) (int64, error) {
+	n, err := s.cache.Get(key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+//counterTakeScript get, ttl and del at once; non counters are left alone
+var counterTakeScript = redis.NewScript(`
+if redis.call('TYPE', KEYS[1]).ok ~= 'string' then
+	return {'0', -2}
+end
+local n = redis.call('GET', KEYS[1])
+local ttl = redis.call('PTTL', KEYS[1])
+redis.call('DEL', KEYS[1])
+return {n, ttl}
+`)
+
+//Take remove the counter
+func (s *RedisCounterStore) Take(key string) (int64, time.Time, error) {
+	res, err := counterTakeScript.Run(s.cache, []string{key}, nil).Result()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	vals, oks := res.([]interface{})
+	if !oks || len(vals) != 2 {
+		return 0, time.Time{}, fmt.Errorf("shards: unexpected take reply %v", res)
+	}
+	var n int64
+	if s, oks := vals[0].(string); oks {
+		fmt.Sscan(s, &n)
+	}
+	var expires time.Time
+	if ttl, oks := vals[1].(int64); oks && ttl > 0 {
+		expires = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+	return n, expires, nil
+}
+
+//Keys scan the counters with the prefix
+func (s *RedisCounterStore) Keys(prefix string) ([]string, error) {
+	var all []string
+	var cursor int64
+	for {
+		next, page, err := s.cache.Scan(cursor, prefix+"*", 1000).Result()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	return all, nil
+}
+
+//Ping check if reachable
+func (s *RedisCounterStore) Ping() error {
+	return s.cache.Ping().Err()
+}
+
+//ShardConfig counters spread over independent redis nodes
+//
+//  nodes         = name: redis config, the names (not the addrs) place the node on the ring
+//  virtual_nodes = points of each node on the ring (default 160)
+//  drain         = names of the nodes being removed, their counters are moved to the
+//                  rest of the nodes on start and nothing new is counted on them
+type ShardConfig struct {
+	Nodes        map[string]*driver.RedisConfig `json:"nodes"`
+	VirtualNodes int                            `json:"virtual_nodes"`
+	Drain        []string                       `json:"drain"`
+}
+
+//Validate sanity check
+func (c *ShardConfig) Validate() error {
+	live := 0
+	for name, node := range c.Nodes {
+		if node == nil {
+			return fmt.Errorf("shards: node %s has no config", name)
+		}
+		if err := node.Validate(); err != nil {
+			return fmt.Errorf("shards: node %s: %v", name, err)
+		}
+		if !c.Draining(name) {
+			live++
+		}
+	}
+	for _, name := range c.Drain {
+		if c.Nodes[name] == nil {
+			return fmt.Errorf("shards: drain node %s is not in the nodes", name)
+		}
+	}
+	if live == 0 {
+		return errors.New("shards: at least 1 node that is not drained is needed")
+	}
+	return nil
+}
+
+//Draining check if the node is being removed
+func (c *ShardConfig) Draining(name string) bool {
+	for _, s := range c.Drain {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+//Names of the nodes, sorted
+func (c *ShardConfig) Names() []string {
+	all := make([]string, 0, len(c.Nodes))
+	for name := range c.Nodes {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+	return all
+}
+
+//ShardedCounterStore counters assigned to the nodes by consistent hashing;
+//a node that fails is taken off the ring (its keys count on the next node) and
+//pinged like the connector does till it is back or given up
+type ShardedCounterStore struct {
+	lock  sync.RWMutex
+	ring  *HashRing
+	nodes map[string]CounterStore
+	//failed pings of the nodes that are down
+	down map[string]int
+
+	//Prefixes of the counters moved on rebalancing
+	Prefixes []string
+	Clock    Clock
+	Metrics  *Metrics
+
+	quit    chan struct{}
+	closing sync.Once
+}
+
+//NewShardedCounterStore new instance, default virtual nodes if 0
+func NewShardedCounterStore(replicas int) *ShardedCounterStore {
+	return &ShardedCounterStore{
+		ring:     NewHashRing(replicas),
+		nodes:    make(map[string]CounterStore),
+		down:     make(map[string]int),
+		Prefixes: []string{DefaultKeys.Hybrid, DefaultKeys.Quota, DefaultKeys.Lockout},
+		Clock:    SystemClock{},
+		quit:     make(chan struct{}),
+	}
+}
+
+//Nodes on the ring (up)
+func (s *ShardedCounterStore) Nodes() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.ring.Nodes()
+}
+
+//Owner node name of the key
+func (s *ShardedCounterStore) Owner(key string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.ring.Get(key)
+}
+
+func (s *ShardedCounterStore) owner(key string) (string, CounterStore) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	name := s.ring.Get(key)
+	return name, s.nodes[name]
+}
+
+//AddNode place the node on the ring, the keys it now owns are moved to it
+func (s *ShardedCounterStore) AddNode(name string, node CounterStore) {
+	s.lock.Lock()
+	s.nodes[name] = node
+	delete(s.down, name)
+	s.ring.Add(name)
+	s.lock.Unlock()
+	s.rebalance()
+}
+
+//AddDownNode keep the node that is not reachable off the ring, healed on the retry interval
+func (s *ShardedCounterStore) AddDownNode(name string, node CounterStore, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nodes[name] = node
+	s.down[name] = 0
+	s.Metrics.Add("shards::down", 1)
+	log.Println("SHARDS_DOWN", name, err)
+}
+
+//RemoveNode take the node off the ring, its keys are moved to the rest
+func (s *ShardedCounterStore) RemoveNode(name string) {
+	s.lock.Lock()
+	node := s.nodes[name]
+	s.ring.Remove(name)
+	delete(s.nodes, name)
+	delete(s.down, name)
+	s.lock.Unlock()
+	if node != nil {
+		s.DrainNode(name, node)
+	}
+}
+
+//DrainNode move all the keys of a node that is not on the ring to their owners
+func (s *ShardedCounterStore) DrainNode(name string, node CounterStore) {
+	for _, prefix := range s.Prefixes {
+		keys, err := node.Keys(prefix)
+		if err != nil {
+			log.Println("SHARDS_DRAIN", name, err)
+			return
+		}
+		for _, key := range keys {
+			s.move(name, node, key)
+		}
+	}
+}
+
+//rebalance move the keys that are on the wrong node
+func (s *ShardedCounterStore) rebalance() {
+	s.lock.RLock()
+	names := s.ring.Nodes()
+	nodes := make([]CounterStore, len(names))
+	for i, name := range names {
+		nodes[i] = s.nodes[name]
+	}
+	s.lock.RUnlock()
+	for i, name := range names {
+		for _, prefix := range s.Prefixes {
+			keys, err := nodes[i].Keys(prefix)
+			if err != nil {
+				log.Println("SHARDS_REBALANCE", name, err)
+				break
+			}
+			for _, key := range keys {
+				if owner, _ := s.owner(key); owner != name {
+					s.move(name, nodes[i], key)
+				}
+			}
+		}
+	}
+}
+
+//move take the key out of the node and add it to its owner, counts are summed
+//with whatever the owner got in the meantime
+func (s *ShardedCounterStore) move(name string, node CounterStore, key string) {
+	n, expires, err := node.Take(key)
+	if err != nil {
+		log.Println("SHARDS_MOVE", name, key, err)
+		return
+	}
+	if n == 0 {
+		return
+	}
+	if expires.IsZero() || expires.After(s.Clock.Now()) {
+		if err := s.Add([]*CounterDelta{{Key: key, N: n, Expires: expires}}); err != nil {
+			log.Println("SHARDS_MOVE", name, key, err)
+			return
+		}
+	}
+	s.Metrics.Add("shards::moved", 1)
+	utils.Dumper("shards::moved", key, name, n)
+}
+
+//markDown take the failed node off the ring
+func (s *ShardedCounterStore) markDown(name string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.ring.Has(name) {
+		return
+	}
+	s.ring.Remove(name)
+	s.down[name] = 0
+	s.Metrics.Add("shards::down", 1)
+	log.Println("SHARDS_DOWN", name, err)
+}
+
+//Add group the deltas by node, the ones of a failed node are counted on the next owner
+func (s *ShardedCounterStore) Add(all []*CounterDelta) error {
+	for len(all) > 0 {
+		groups := make(map[string][]*CounterDelta)
+		stores := make(map[string]CounterStore)
+		s.lock.RLock()
+		for _, d := range all {
+			name := s.ring.Get(d.Key)
+			if name == "" {
+				s.lock.RUnlock()
+				return ErrNoShards
+			}
+			groups[name] = append(groups[name], d)
+			stores[name] = s.nodes[name]
+		}
+		s.lock.RUnlock()
+		var retry []*CounterDelta
+		for name, group := range groups {
+			if err := stores[name].Add(group); err != nil {
+				s.markDown(name, err)
+				retry = append(retry, group...)
+			}
+		}
+		all = retry
+	}
+	return nil
+}
+
+//Get current total from the owner
+func (s *ShardedCounterStore) Get(key string) (int64, error) {
+	for {
+		name, node := s.owner(key)
+		if node == nil {
+			return 0, ErrNoShards
+		}
+		n, err := node.Get(key)
+		if err == nil {
+			return n, nil
+		}
+		s.markDown(name, err)
+	}
+}
+
+//Take remove the counter from the owner
+func (s *ShardedCounterStore) Take(key string) (int64, time.Time, error) {
+	for {
+		name, node := s.owner(key)
+		if node == nil {
+			return 0, time.Time{}, ErrNoShards
+		}
+		n, expires, err := node.Take(key)
+		if err == nil {
+			return n, expires, nil
+		}
+		s.markDown(name, err)
+	}
+}
+
+//Keys counters with the prefix over the nodes that are up
+func (s *ShardedCounterStore) Keys(prefix string) ([]string, error) {
+	s.lock.RLock()
+	names := s.ring.Nodes()
+	nodes := make([]CounterStore, len(names))
+	for i, name := range names {
+		nodes[i] = s.nodes[name]
+	}
+	s.lock.RUnlock()
+	var all []string
+	for i, name := range names {
+		keys, err := nodes[i].Keys(prefix)
+		if err != nil {
+			s.markDown(name, err)
+			continue
+		}
+		all = append(all, keys...)
+	}
+	return all, nil
+}
+
+//Ping check if any node is up
+func (s *ShardedCounterStore) Ping() error {
+	if len(s.Nodes()) == 0 {
+		return ErrNoShards
+	}
+	return nil
+}
+
+//Heal ping the nodes that are down, back on the ring if reachable,
+//given up after as many tries as the connector
+func (s *ShardedCounterStore) Heal() {
+	s.lock.RLock()
+	down := make(map[string]CounterStore)
+	for name := range s.down {
+		down[name] = s.nodes[name]
+	}
+	s.lock.RUnlock()
+	for name, node := range down {
+		err := node.Ping()
+		if err == nil {
+			s.Metrics.Add("shards::up", 1)
+			log.Println("SHARDS_UP", name)
+			s.AddNode(name, node)
+			continue
+		}
+		s.lock.Lock()
+		if _, oks := s.down[name]; oks {
+			s.down[name]++
+			if s.down[name] >= driver.RedisRetries {
+				log.Println("SHARDS_GIVEUP", name, err)
+				delete(s.down, name)
+				delete(s.nodes, name)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+//ManageNodes ping the nodes that are down on the connector retry interval
+func (s *ShardedCounterStore) ManageNodes(isReady chan bool) {
+	//ready
+	isReady <- true
+	utils.Dumper("ManageNodes::IsReady")
+	for {
+		select {
+		case <-s.Clock.After(driver.RedisRetryInterval):
+			s.Heal()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+//Close stop the node manager
+func (s *ShardedCounterStore) Close() {
+	s.closing.Do(func() { close(s.quit) })
+}
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+//SimKeyReport replay result of 1 key (ip)
+type SimKeyReport struct {
+	Key       string
+	Allowed   int
+	Denied    int
+	FirstDeny string
+	//NewDenies allowed before, denied now
+	NewDenies int
+	//NewAllows denied before, allowed now
+	NewAllows int
+}
+
+//SimReport replay result of all the records
+type SimReport struct {
+	Records   int
+	Skipped   int
+	Allowed   int
+	Denied    int
+	NewDenies int
+	NewAllows int
+	From      string
+	To        string
+	Keys      []*SimKeyReport
+}
+
+//Simulator replay recorded requests through a set of policies on a simulated clock,
+//shadow policies are replayed as enforced
+type Simulator struct {
+	Policies PolicyList
+	Default  *Policy
+	history  *TrackerIPHistory
+	clock    *ManualClock
+}
+
+//NewSimulator new instance
+func NewSimulator(policies PolicyList, fallback *Policy) *Simulator {
+	s := &Simulator{
+		Default: fallback,
+		history: NewTrackerIPHistory(),
+		clock:   NewManualClock(time.Time{}),
+	}
+	for _, p := range policies {
+		if p == nil {
+			continue
+		}
+		enforced := *p
+		if enforced.Shadows() {
+			enforced.Mode = ""
+		}
+		s.Policies = append(s.Policies, &enforced)
+	}
+	s.history.Clock = s.clock
+	return s
+}
+
+//Run replay the records in timestamp order
+func (s *Simulator) Run(records []*TrackerIP) *SimReport {
+	type replay struct {
+		at  time.Time
+		trk *TrackerIP
+	}
+	report := &SimReport{}
+	all := make([]*replay, 0, len(records))
+	for _, trk := range records {
+		at, err := time.Parse(time.RFC3339Nano, trk.DateTime)
+		if err != nil || trk.IP == "" {
+			report.Skipped++
+			continue
+		}
+		all = append(all, &replay{at: at, trk: trk})
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].at.Before(all[j].at) })
+
+	//fresh windows
+	s.history.ResetQ()
+	keys := make(map[string]*SimKeyReport)
+	var order []string
+	var swept time.Time
+	for _, rec := range all {
+		s.clock.Set(rec.at)
+		if rec.at.Sub(swept) >= time.Minute {
+			s.history.SweepQ(rec.at)
+			swept = rec.at
+		}
+
+		r, err := rec.trk.Request()
+		if err != nil {
+			report.Skipped++
+			continue
+		}
+		policy := s.Policies.Match(r, s.Default)
+		dec := s.history.Allow(rec.trk.IP, policy, policy.Cost.Upfront(r))
+
+		kr, oks := keys[rec.trk.IP]
+		if !oks {
+			kr = &SimKeyReport{Key: rec.trk.IP}
+			keys[rec.trk.IP] = kr
+			order = append(order, rec.trk.IP)
+		}
+		report.Records++
+		if report.From == "" {
+			report.From = rec.trk.DateTime
+		}
+		report.To = rec.trk.DateTime
+		before := rec.trk.Denied()
+		if dec.Allowed {
+			kr.Allowed++
+			report.Allowed++
+			if before {
+				kr.NewAllows++
+				report.NewAllows++
+			}
+			continue
+		}
+		kr.Denied++
+		report.Denied++
+		if kr.FirstDeny == "" {
+			kr.FirstDeny = rec.trk.DateTime
+		}
+		if !before {
+			kr.NewDenies++
+			report.NewDenies++
+		}
+	}
+	for _, k := range order {
+		report.Keys = append(report.Keys, keys[k])
+	}
+	return report
+}
+
+//Request rebuild the request of the record, GET if the method was not recorded
+func (u *TrackerIP) Request() (*http.Request, error) {
+	method := u.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	r, err := http.NewRequest(method, u.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.RemoteAddr = u.IP
+	return r, nil
+}
+
+//Denied check if the recorded request was rejected
+func (u *TrackerIP) Denied() bool {
+	return strings.EqualFold(u.Status, "Denied") || strings.EqualFold(u.Status, "Shed")
+}
+
+//ReadTrackerJSONL records from an exported file, 1 json per line
+func ReadTrackerJSONL(rd io.Reader) ([]*TrackerIP, error) {
+	var all []*TrackerIP
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var trk TrackerIP
+		if err := json.Unmarshal([]byte(line), &trk); err != nil {
+			return nil, err
+		}
+		all = append(all, &trk)
+	}
+	return all, scanner.Err()
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+//TestSimulator per-key counts, first denies and the diff against the recorded decisions
+func TestSimulator(t *testing.T) {
+
+	//out of order, as exported
+	records, err := ReadTrackerJSONL(strings.NewReader(`
+{"IP":"10.0.0.1","URL":"/v1/api/request/a","Status":"Denied","DateTime":"2019-01-20T08:01:05Z"}
+{"IP":"10.0.0.1","URL":"/v1/api/request/a","Status":"Allowed","DateTime":"2019-01-20T08:00:00Z"}
+{"IP":"10.0.0.1","URL":"/v1/api/request/a","Status":"Allowed","DateTime":"2019-01-20T08:00:10Z"}
+{"IP":"10.0.0.2","Method":"POST","URL":"/v1/api/other","Status":"Allowed","DateTime":"2019-01-20T08:00:05Z"}
+{"IP":"10.0.0.1","URL":"/v1/api/request/a","Status":"Allowed","DateTime":"2019-01-20T08:00:20Z"}
+{"IP":"10.0.0.2","Method":"POST","URL":"/v1/api/other","Status":"Allowed","DateTime":"2019-01-20T08:00:06Z"}
+{"IP":"10.0.0.1","URL":"/v1/api/request/a","Status":"Denied","DateTime":"2019-01-20T08:00:30Z"}
+
+{"IP":"10.0.0.3","URL":"/v1/api/request/a","Status":"Allowed","DateTime":"yesterday"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//shadow is replayed as enforced
+	shadow := NewPolicy("sim-shadow", "/v1/api/other", 1, "minute")
+	shadow.Mode = PolicyModeShadow
+	sim := NewSimulator(PolicyList{NewPolicy("sim", "/v1/api/request", 2, "minute"), shadow, nil}, NewPolicy("default", "", 10, "minute"))
+	report := sim.Run(records)
+
+	if report.Records != 7 || report.Skipped != 1 || report.Allowed != 4 || report.Denied != 3 ||
+		report.NewDenies != 2 || report.NewAllows != 1 {
+		t.Fatalf("Run failed: %+v", report)
+	}
+	if report.From != "2019-01-20T08:00:00Z" || report.To != "2019-01-20T08:01:05Z" {
+		t.Fatalf("Run failed: %s - %s", report.From, report.To)
+	}
+	mockLists := []SimKeyReport{
+		{Key: "10.0.0.1", Allowed: 3, Denied: 2, FirstDeny: "2019-01-20T08:00:20Z", NewDenies: 1, NewAllows: 1},
+		{Key: "10.0.0.2", Allowed: 1, Denied: 1, FirstDeny: "2019-01-20T08:00:06Z", NewDenies: 1, NewAllows: 0},
+	}
+	if len(report.Keys) != len(mockLists) {
+		t.Fatalf("Run failed: %d keys", len(report.Keys))
+	}
+	for i, rec := range mockLists {
+		if *report.Keys[i] != rec {
+			t.Fatalf("%d Key failed: %+v", i+1, report.Keys[i])
+		}
+		t.Log(i+1, "OKAY", rec.Key, rec.Allowed, rec.Denied, rec.FirstDeny)
+	}
+
+	//fresh windows on every run
+	if again := sim.Run(records); again.Allowed != report.Allowed || again.Denied != report.Denied {
+		t.Fatalf("Run failed: %+v", again)
+	}
+	t.Log("OK")
+}
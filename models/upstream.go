@@ -0,0 +1,33 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+//Upstream route prefix forwarded to an upstream service in gateway mode
+type Upstream struct {
+	Prefix      string `json:"prefix"`
+	URL         string `json:"url"`
+	StripPrefix bool   `json:"strip_prefix"`
+}
+
+//Validate sanity check on the upstream settings
+func (u *Upstream) Validate() error {
+	if u == nil {
+		return errors.New("upstream: empty entry")
+	}
+	if !strings.HasPrefix(u.Prefix, "/") {
+		return fmt.Errorf("upstream %q: prefix must start with /", u.Prefix)
+	}
+	target, err := url.Parse(u.URL)
+	if err != nil {
+		return fmt.Errorf("upstream %q: %v", u.Prefix, err)
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return fmt.Errorf("upstream %q: url needs the scheme and host", u.Prefix)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	//PasswordMinLength shortest password accepted
+	PasswordMinLength = 8
+	//PasswordMaxLength bcrypt only uses the 1st 72 bytes
+	PasswordMaxLength = 72
+
+	//RoleUser role of the signed up accounts
+	RoleUser = "user"
+	//RoleAdmin role of the admin, limits and debug end-points, only set on the users table
+	RoleAdmin = "admin"
+)
+
+var (
+	//ErrUserNotFound no user with the id or username
+	ErrUserNotFound = errors.New("user: not found")
+	//ErrUserExists username is taken
+	ErrUserExists = errors.New("user: username already exists")
+
+	usernameFormat = regexp.MustCompile(`^[A-Za-z0-9_.@-]{3,64}$`)
+
+	//compared when the user is missing, same time as a wrong password
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+)
+
+//User account of the login and otp end-points
+type User struct {
+	ID           int64
+	Username     string
+	Email        string
+	Phone        string
+	PasswordHash string `json:"-"`
+	OtpSecret    string `json:"-"`
+	Role         string
+	CreatedAt    string
+	UpdatedAt    string
+}
+
+//ValidateUsername sanity check
+func ValidateUsername(s string) error {
+	if !usernameFormat.MatchString(s) {
+		return errors.New("user: username must be 3-64 of letters, digits and _.@-")
+	}
+	return nil
+}
+
+//SetPassword bcrypt hash of the password
+func (u *User) SetPassword(password string) error {
+	if len(password) < PasswordMinLength || len(password) > PasswordMaxLength {
+		return fmt.Errorf("user: password must be %d-%d characters", PasswordMinLength, PasswordMaxLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+//CheckPassword compare with the hash, nil user takes the same time
+func (u *User) CheckPassword(password string) bool {
+	hash := dummyHash
+	if u != nil {
+		hash = []byte(u.PasswordHash)
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && u != nil
+}
+
+//UserStore where the accounts are kept
+type UserStore interface {
+	//Create add the user, its id is set
+	Create(u *User) error
+	//Update email, phone and password of the user
+	Update(u *User) error
+	Get(id int64) (*User, error)
+	GetByName(username string) (*User, error)
+	Delete(id int64) error
+	//UseOtp mark the otp step of the user as used, false if it or a later 1 was already used
+	UseOtp(id int64, step int64) (bool, error)
+}
+
+//MysqlUserStore accounts on the users table
+type MysqlUserStore struct {
+	dbh *sql.DB
+}
+
+//NewMysqlUserStore new instance, the table is made by the migrations
+func NewMysqlUserStore(dbh *sql.DB) *MysqlUserStore {
+	return &MysqlUserStore{dbh: dbh}
+}
+
+//Create add the user
+func (s *MysqlUserStore) Create(u *User) error {
+	if u.Role == "" {
+		u.Role = RoleUser
+	}
+	res, err := s.dbh.Exec(`INSERT INTO users (username, email, phone, password_hash, otp_secret, role) VALUES (?, ?, ?, ?, ?, ?)`,
+		u.Username, u.Email, u.Phone, u.PasswordHash, u.OtpSecret, u.Role)
+	if me, oks := err.(*mysql.MySQLError); oks && me.Number == 1062 {
+		return ErrUserExists
+	}
+	if err != nil {
+		return err
+	}
+	if u.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	saved, err := s.Get(u.ID)
+	if err != nil {
+		return err
+	}
+	u.CreatedAt, u.UpdatedAt = saved.CreatedAt, saved.UpdatedAt
+	return nil
+}
+
+//Update email, phone and password
+func (s *MysqlUserStore) Update(u *User) error {
+	res, err := s.dbh.Exec(`UPDATE users SET email = ?, phone = ?, password_hash = ? WHERE id = ?`,
+		u.Email, u.Phone, u.PasswordHash, u.ID)
+	if err != nil {
+		return err
+	}
+	//same values are not counted as changed
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := s.Get(u.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const userColumns = `id, username, email, phone, password_hash, otp_secret, role, created_at, updated_at`
+
+//Get user by id
+func (s *MysqlUserStore) Get(id int64) (*User, error) {
+	return s.scan(s.dbh.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+}
+
+//GetByName user by username
+func (s *MysqlUserStore) GetByName(username string) (*User, error) {
+	return s.scan(s.dbh.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+}
+
+func (s *MysqlUserStore) scan(row *sql.Row) (*User, error) {
+	var u User
+	var created, updated time.Time
+	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.Phone, &u.PasswordHash, &u.OtpSecret, &u.Role, &created, &updated)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.CreatedAt, u.UpdatedAt = created.Format(time.RFC3339), updated.Format(time.RFC3339)
+	return &u, nil
+}
+
+//Delete remove the user
+func (s *MysqlUserStore) Delete(id int64) error {
+	res, err := s.dbh.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+//UseOtp keep the last used step, atomic across the instances
+func (s *MysqlUserStore) UseOtp(id int64, step int64) (bool, error) {
+	res, err := s.dbh.Exec(`UPDATE users SET otp_step = ? WHERE id = ? AND otp_step < ?`, step, id, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+//AuthPolicies strict brute-force policies of the login and otp end-points,
+//a configured policy with the same name is used instead; login only counts the
+//failures per ip, username and ip+username
+func AuthPolicies() PolicyList {
+	return PolicyList{
+		{
+			Name:            "login",
+			Route:           "/v1/api/login",
+			Methods:         []string{"POST"},
+			Windows:         []*Window{{Limit: 5, Per: "minute"}, {Limit: 20, Per: "hour"}},
+			FailureStatuses: []int{401},
+			Lockout:         "15m",
+		},
+		{
+			Name:    "otp",
+			Route:   "/v1/api/otp",
+			Methods: []string{"POST"},
+			Windows: []*Window{{Limit: 3, Per: "minute"}, {Limit: 10, Per: "hour"}},
+		},
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bayugyug/rest-api-throttleip/config"
+	"github.com/bayugyug/rest-api-throttleip/driver"
+	"github.com/bayugyug/rest-api-throttleip/models"
+	"github.com/bayugyug/rest-api-throttleip/utils"
+)
+
+//simulate replay the recorded history through a policy file, the report is printed as json
+//
+//  rest-api-throttleip simulate -policies policies.json -file history.jsonl
+//  rest-api-throttleip simulate -policies policies.json -spool /var/spool/throttle
+//  rest-api-throttleip simulate -policies policies.json -redis 127.0.0.1:6379
+//  rest-api-throttleip simulate -policies policies.json -redis '{"sentinel_master":"mymaster",...}'
+//  rest-api-throttleip simulate -policies policies.json -redis 127.0.0.1:6379 -keys '{"prefix":"shop:"}'
+func simulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	policyFile := fs.String("policies", "", "policy file (or inline json), {\"policies\":[...]} or a list")
+	file := fs.String("file", "", "exported history, 1 json per line")
+	spool := fs.String("spool", "", "dir of *.jsonl history files")
+	redisHost := fs.String("redis", "", "redis host (or the json of the redis config) of the ALLOWED/DENIED history")
+	keyCfg := fs.String("keys", "", "json of the key namespace of the redis history")
+	perMinute := fs.Int("default", config.RequestsPerMinute, "requests per minute of the default policy")
+	top := fs.Int("top", 0, "only show the n keys with the most denies (0: all)")
+	fs.Parse(args)
+
+	//report only
+	utils.ShowMeLog = false
+
+	policies, err := loadPolicies(*policyFile)
+	if err != nil {
+		return err
+	}
+
+	//recorded history
+	var records []*models.TrackerIP
+	switch {
+	case *file != "":
+		records, err = readHistoryFiles([]string{*file})
+	case *spool != "":
+		var files []string
+		if files, err = filepath.Glob(filepath.Join(*spool, "*.jsonl")); err == nil {
+			records, err = readHistoryFiles(files)
+		}
+	case *redisHost != "":
+		keys, kerr := parseKeysFlag(*keyCfg)
+		if kerr != nil {
+			return kerr
+		}
+		client, cerr := connectRedisFlag(*redisHost)
+		if cerr != nil {
+			return cerr
+		}
+		defer client.Close()
+		store := models.NewRedisHistoryStore(client)
+		store.Keys = keys
+		records, err = store.Load()
+	default:
+		return errors.New("simulate: one of -file, -spool or -redis is needed")
+	}
+	if err != nil {
+		return err
+	}
+
+	sim := models.NewSimulator(policies, models.NewPolicy("default", "", *perMinute, "minute"))
+	report := sim.Run(records)
+	sort.SliceStable(report.Keys, func(i, j int) bool { return report.Keys[i].Denied > report.Keys[j].Denied })
+	if *top > 0 && len(report.Keys) > *top {
+		report.Keys = report.Keys[:*top]
+	}
+	out, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+//loadPolicies from a file or inline json, same shape as the config policies
+func loadPolicies(s string) (models.PolicyList, error) {
+	if s == "" {
+		return nil, errors.New("simulate: -policies is needed")
+	}
+	data := []byte(s)
+	if t := strings.TrimSpace(s); !strings.HasPrefix(t, "{") && !strings.HasPrefix(t, "[") {
+		var err error
+		if data, err = ioutil.ReadFile(s); err != nil {
+			return nil, err
+		}
+	}
+	var policies models.PolicyList
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		if err := json.Unmarshal(data, &policies); err != nil {
+			return nil, err
+		}
+	} else {
+		var cfg config.ParameterConfig
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, err
+		}
+		policies = cfg.Policies
+	}
+	for _, p := range policies {
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return policies, nil
+}
+
+//connectRedisFlag redis of a host:port or the json of the redis config
+func connectRedisFlag(s string) (driver.RedisClient, error) {
+	cfg := &driver.RedisConfig{Addr: s}
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		cfg = &driver.RedisConfig{}
+		if err := json.Unmarshal([]byte(s), cfg); err != nil {
+			return nil, err
+		}
+	}
+	return driver.NewRedisConnector(cfg)
+}
+
+//parseKeysFlag key namespace of the json, the old fixed keys if empty
+func parseKeysFlag(s string) (*models.KeySpace, error) {
+	var cfg *models.KeyConfig
+	if strings.TrimSpace(s) != "" {
+		cfg = &models.KeyConfig{}
+		if err := json.Unmarshal([]byte(s), cfg); err != nil {
+			return nil, err
+		}
+	}
+	return models.NewKeySpace(cfg)
+}
+
+func readHistoryFiles(files []string) ([]*models.TrackerIP, error) {
+	var all []*models.TrackerIP
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		records, err := models.ReadTrackerJSONL(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		all = append(all, records...)
+	}
+	return all, nil
+}
@@ -1,29 +1,38 @@
 package utils
 
 import (
-	"log"
-
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/jwtauth"
 )
 
 const (
+	//TokenAuthSecret built-in default, the user and admin end-points are off while in use
 	TokenAuthSecret = "/v1/api/S3cr3T/benjerry/icecream/choco"
 	TokenAuthExpDay = 365
 )
 
 type AppJwtConfig struct {
 	TokenAuth *jwtauth.JWTAuth `json:",omitempty"`
+	isDefault bool
 }
 
-func NewAppJwtConfig() *AppJwtConfig {
+//NewAppJwtConfig signed with the secret, the built-in default if empty
+func NewAppJwtConfig(secret string) *AppJwtConfig {
+	if secret == "" {
+		secret = TokenAuthSecret
+	}
 	return &AppJwtConfig{
-		TokenAuth: jwtauth.New("HS256", []byte(TokenAuthSecret), nil),
+		TokenAuth: jwtauth.New("HS256", []byte(secret), nil),
+		isDefault: secret == TokenAuthSecret,
 	}
 }
 
 func (t *AppJwtConfig) GenToken(claims jwt.MapClaims) (string, error) {
 	_, tokenString, err := t.TokenAuth.Encode(claims)
-	log.Println("jwt token:", tokenString, err)
 	return tokenString, err
 }
+
+//IsDefault signed with the built-in default secret
+func (t *AppJwtConfig) IsDefault() bool {
+	return t.isDefault
+}